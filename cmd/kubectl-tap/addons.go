@@ -0,0 +1,94 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+// The addons bundled with kubetap are loaded by every mitmproxy tap. Their settings are
+// JSON files in the tap ConfigMap, which they read again once a ConfigMap update reaches
+// the Pod, so that the settings can be changed without restarting the proxy.
+const (
+	// mitmproxyFaultsAddon enforces the fault rules in mitmproxyFaultsFile.
+	mitmproxyFaultsAddon = "kubetap_faults.py"
+	mitmproxyFaultsFile  = "kubetap-faults.json"
+	// mitmproxyMirrorAddon duplicates requests to the target in mitmproxyMirrorFile.
+	mitmproxyMirrorAddon = "kubetap_mirror.py"
+	mitmproxyMirrorFile  = "kubetap-mirror.json"
+	// mitmproxyRedactAddon redacts secrets from captured flows with the rules in
+	// mitmproxyRedactFile.
+	mitmproxyRedactAddon = "kubetap_redact.py"
+	mitmproxyRedactFile  = "kubetap-redact.json"
+	// mitmproxyAddonModule is the Python module shared by the bundled addons. It is
+	// imported by them rather than loaded by mitmproxy.
+	mitmproxyAddonModule = "kubetap_addon"
+	mitmproxyAddonHelper = mitmproxyAddonModule + ".py"
+)
+
+// bundledAddons are the addon scripts mitmproxy loads into every tap.
+var bundledAddons = []string{mitmproxyFaultsAddon, mitmproxyMirrorAddon, mitmproxyRedactAddon}
+
+// bundledAddonSources are the files of the bundled addons stored in the tap ConfigMap.
+var bundledAddonSources = map[string]string{
+	mitmproxyFaultsAddon: mitmproxyFaultsAddonSource,
+	mitmproxyMirrorAddon: mitmproxyMirrorAddonSource,
+	mitmproxyRedactAddon: mitmproxyRedactAddonSource,
+	mitmproxyAddonHelper: mitmproxyAddonHelperSource,
+}
+
+// isBundledAddon reports whether a script name belongs to a file kubetap stores with every
+// mitmproxy tap.
+func isBundledAddon(name string) bool {
+	_, ok := bundledAddonSources[name]
+	return ok
+}
+
+// mitmproxyAddonHelperSource reads the settings of a bundled addon. The ConfigMap volume
+// is updated in place, so a changed modification time means new settings. The last
+// settings that could be read are kept while the file is missing or invalid.
+const mitmproxyAddonHelperSource = `# Managed by kubetap, changes are overwritten.
+import json
+import logging
+import os
+
+DIR = os.path.dirname(os.path.abspath(__file__))
+
+
+class ConfigFile:
+    """A JSON file of the tap ConfigMap. parse converts its content for value, raising
+    ValueError if it is invalid, and empty is the content of a file holding null."""
+
+    def __init__(self, name, description, empty, parse=None):
+        self.path = os.path.join(DIR, name)
+        self.description = description
+        self.empty = empty
+        self.parse = parse or (lambda content: content)
+        self.value = self.parse(empty)
+        self.mtime = None
+
+    def load(self):
+        """Reads the file again if it changed, returning whether value was replaced."""
+        try:
+            mtime = os.stat(self.path).st_mtime
+        except FileNotFoundError:
+            return False
+        if mtime == self.mtime:
+            return False
+        try:
+            with open(self.path) as f:
+                content = json.load(f)
+            value = self.parse(self.empty if content is None else content)
+        except (OSError, ValueError) as e:
+            logging.error("kubetap: cannot read the %s: %s", self.description, e)
+            return False
+        self.mtime, self.value = mtime, value
+        return True
+`
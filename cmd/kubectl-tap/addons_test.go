@@ -0,0 +1,105 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// addonHelperHarness exercises the ConfigFile loader of the addon helper module.
+const addonHelperHarness = `import os
+import sys
+
+sys.path.insert(0, sys.argv[1])
+
+from kubetap_addon import ConfigFile
+
+path = os.path.join(sys.argv[1], "settings.json")
+
+
+def write(content, mtime):
+    with open(path, "w") as f:
+        f.write(content)
+    os.utime(path, (mtime, mtime))
+
+
+def parse(content):
+    if "bad" in content:
+        raise ValueError("bad settings")
+    return content
+
+
+settings = ConfigFile("settings.json", "settings", {}, parse)
+assert not settings.load() and settings.value == {}, "a missing file reads as empty"
+write('{"a": 1}', 1)
+assert settings.load() and settings.value == {"a": 1}
+assert not settings.load(), "an unchanged file is read again"
+write('{"bad": true}', 2)
+assert not settings.load() and settings.value == {"a": 1}, "invalid settings replaced the last ones"
+write("not json", 3)
+assert not settings.load() and settings.value == {"a": 1}, "unreadable settings replaced the last ones"
+write("null", 4)
+assert settings.load() and settings.value == {}
+os.remove(path)
+write('{"a": 2}', 4)
+os.remove(path)
+assert not settings.load() and settings.value == {}, "a removed file replaced the last settings"
+print("ok")
+`
+
+func Test_AddonHelper(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap-addon")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	writeBundledAddons(t, dir)
+	harness := filepath.Join(dir, "harness.py")
+	require.Nil(ioutil.WriteFile(harness, []byte(addonHelperHarness), 0600))
+	out, err := exec.Command("python3", harness, dir).CombinedOutput()
+	require.Nil(err, string(out))
+	require.Contains(string(out), "ok")
+}
+
+// writeBundledAddons writes the bundled addons to dir, like the ConfigMap volume of a tap.
+func writeBundledAddons(t *testing.T, dir string) {
+	for name, source := range bundledAddonSources {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0600))
+	}
+}
+
+// getConfigMapFile reads a JSON file of the tap ConfigMap of sample-deployment into v, and
+// returns the value v points to. The bundled addons must be stored alongside.
+func getConfigMapFile(t *testing.T, client *fake.Clientset, name string, v interface{}) interface{} {
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(t, err)
+	for addon, source := range bundledAddonSources {
+		require.Equal(t, source, string(cm.BinaryData[addon]), addon)
+	}
+	require.Nil(t, json.Unmarshal(cm.BinaryData[name], v))
+	return reflect.ValueOf(v).Elem().Interface()
+}
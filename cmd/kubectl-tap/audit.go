@@ -0,0 +1,270 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// eventReasonTapped and eventReasonUntapped are the reasons of the Events recorded on
+	// tapped Services and Deployments.
+	eventReasonTapped   = "Tapped"
+	eventReasonUntapped = "Untapped"
+	// eventSource is the component reporting kubetap Events.
+	eventSource = "kubetap"
+	// unknownUser is recorded when the user cannot be determined.
+	unknownUser = "unknown"
+	// controllerUser is recorded for taps removed by the kubetap controller.
+	controllerUser = "kubetap-controller"
+)
+
+// auditMaskedFlags are flags whose values may hold credentials, such as upstream_auth or
+// an Authorization header, and are masked in the recorded command line.
+var auditMaskedFlags = map[string]bool{
+	"--proxy-set":  true,
+	"--set-header": true,
+}
+
+// selfSubjectReviewVersions are the authentication.k8s.io versions that serve
+// SelfSubjectReview, newest first.
+var selfSubjectReviewVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+// tapAudit records who tapped a Service, from where and when. It is stored as JSON in
+// the annotationAudit annotation of the tapped Service.
+type tapAudit struct {
+	User     string    `json:"user"`
+	Hostname string    `json:"hostname,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	Time     time.Time `json:"time"`
+	// TapUID is the UID of the Tap resource the tap was made for by the controller.
+	TapUID string `json:"tapUID,omitempty"`
+}
+
+// newTapAudit returns the audit record of the running kubetap process acting as user.
+func newTapAudit(user string) tapAudit {
+	hostname, _ := os.Hostname()
+	return tapAudit{
+		User:     user,
+		Hostname: hostname,
+		Version:  version,
+		Command:  auditCommandLine(os.Args),
+		Time:     time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// String describes the actor of the audit record, as user@hostname.
+func (a tapAudit) String() string {
+	if a.Hostname == "" {
+		return a.User
+	}
+	return a.User + "@" + a.Hostname
+}
+
+// tapAuditFromAnnotations reads the audit record of a tapped Service, returning false
+// for Services tapped by versions of kubetap that did not record one.
+func tapAuditFromAnnotations(anns map[string]string) (tapAudit, bool) {
+	var audit tapAudit
+	if err := json.Unmarshal([]byte(anns[annotationAudit]), &audit); err != nil || audit.User == "" {
+		return tapAudit{}, false
+	}
+	return audit, true
+}
+
+// annotation renders the audit record for annotationAudit.
+func (a tapAudit) annotation() string {
+	b, _ := json.Marshal(a)
+	return string(b)
+}
+
+// age is how long ago the audit record was made, as shown by kubectl.
+func (a tapAudit) age() string {
+	if a.Time.IsZero() {
+		return "<unknown>"
+	}
+	return duration.HumanDuration(time.Since(a.Time))
+}
+
+// auditCommandLine joins the arguments of the command, masking the values of the
+// auditMaskedFlags.
+func auditCommandLine(args []string) string {
+	masked := make([]string, len(args))
+	copy(masked, args)
+	for i, arg := range masked {
+		switch {
+		case auditMaskedFlags[arg] && i+1 < len(masked):
+			masked[i+1] = maskFlagValue(masked[i+1])
+		case strings.Contains(arg, "=") && auditMaskedFlags[strings.SplitN(arg, "=", 2)[0]]:
+			kv := strings.SplitN(arg, "=", 2)
+			masked[i] = kv[0] + "=" + maskFlagValue(kv[1])
+		}
+	}
+	return strings.Join(masked, " ")
+}
+
+// maskFlagValue keeps the key of a key=value or NAME=VALUE flag value.
+func maskFlagValue(value string) string {
+	if kv := strings.SplitN(value, "=", 2); len(kv) == 2 {
+		return kv[0] + "=***"
+	}
+	return "***"
+}
+
+// currentUser returns the name the API server knows the user by, using a
+// SelfSubjectReview where the cluster supports it. Otherwise it falls back to the common
+// name of the client certificate, the basic auth user, or the name of the kubeconfig
+// user, which is all that identifies token based users.
+func currentUser(config *rest.Config, kubeconfigUser string) string {
+	if config == nil {
+		return unknownUser
+	}
+	if user := selfSubjectReview(config); user != "" {
+		return user
+	}
+	if cn := clientCertCommonName(config); cn != "" {
+		return cn
+	}
+	if config.Username != "" {
+		return config.Username
+	}
+	if kubeconfigUser != "" {
+		return kubeconfigUser
+	}
+	return unknownUser
+}
+
+// selfSubjectReview asks the API server who the user is. SelfSubjectReviews are newer
+// than the vendored client-go, so the request is made directly.
+func selfSubjectReview(config *rest.Config) string {
+	if config.Host == "" {
+		return ""
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return ""
+	}
+	for _, v := range selfSubjectReviewVersions {
+		body := fmt.Sprintf(`{"apiVersion":"authentication.k8s.io/%s","kind":"SelfSubjectReview"}`, v)
+		raw, err := client.AuthenticationV1().RESTClient().Post().
+			AbsPath("/apis/authentication.k8s.io", v, "selfsubjectreviews").
+			SetHeader("Content-Type", "application/json").
+			Body([]byte(body)).
+			Timeout(5 * time.Second).
+			DoRaw(context.TODO())
+		if err != nil {
+			continue
+		}
+		var review struct {
+			Status struct {
+				UserInfo struct {
+					Username string `json:"username"`
+				} `json:"userInfo"`
+			} `json:"status"`
+		}
+		if json.Unmarshal(raw, &review) == nil && review.Status.UserInfo.Username != "" {
+			return review.Status.UserInfo.Username
+		}
+	}
+	return ""
+}
+
+// clientCertCommonName returns the common name of the client certificate of a config,
+// which Kubernetes uses as the user name.
+func clientCertCommonName(config *rest.Config) string {
+	data := config.CertData
+	if len(data) == 0 && config.CertFile != "" {
+		b, err := ioutil.ReadFile(config.CertFile)
+		if err != nil {
+			return ""
+		}
+		data = b
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return ""
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// recordTapEvent records a Normal Event on a tapped object. Failing to record it does not
+// fail the tap, which would leave it half done, so a warning is printed instead.
+func recordTapEvent(client kubernetes.Interface, out io.Writer, ref v1.ObjectReference, reason, message string, audit tapAudit) {
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// named like the Events of client-go's event recorder
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+			Annotations: map[string]string{
+				annotationAudit: audit.annotation(),
+			},
+		},
+		InvolvedObject:      ref,
+		Reason:              reason,
+		Message:             message,
+		Type:                v1.EventTypeNormal,
+		Source:              v1.EventSource{Component: eventSource, Host: audit.Hostname},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: "kubetap.io/" + eventSource,
+		ReportingInstance:   audit.String(),
+		Action:              reason,
+	}
+	if _, err := client.CoreV1().Events(ref.Namespace).Create(context.TODO(), event, metav1.CreateOptions{}); err != nil {
+		fmt.Fprintf(out, "Warning: could not record a %s Event on %s %q: %v\n", reason, ref.Kind, ref.Name, err)
+	}
+}
+
+// recordTapEvents records an Event on a tapped Service and, if known, its Deployment.
+func recordTapEvents(client kubernetes.Interface, out io.Writer, svc *v1.Service, dpl *k8sappsv1.Deployment, reason, message string, audit tapAudit) {
+	recordTapEvent(client, out, v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Service",
+		Namespace:  svc.Namespace,
+		Name:       svc.Name,
+		UID:        svc.UID,
+	}, reason, message, audit)
+	if dpl == nil {
+		return
+	}
+	recordTapEvent(client, out, v1.ObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Namespace:  dpl.Namespace,
+		Name:       dpl.Name,
+		UID:        dpl.UID,
+	}, reason, message, audit)
+}
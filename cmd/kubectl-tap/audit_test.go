@@ -0,0 +1,109 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_AuditCommandLine(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Args     []string
+		Expected string
+	}{
+		{"plain", []string{"kubectl-tap", "on", "-p80", "sample-service"}, "kubectl-tap on -p80 sample-service"},
+		{"separate_value", []string{"kubectl-tap", "on", "--proxy-set", "upstream_auth=user:pass", "sample-service"}, "kubectl-tap on --proxy-set upstream_auth=*** sample-service"},
+		{"inline_value", []string{"kubectl-tap", "on", "--set-header=Authorization=Bearer abc"}, "kubectl-tap on --set-header=Authorization=***"},
+		{"no_key", []string{"kubectl-tap", "on", "--set-header", "/~q/X-Token/abc"}, "kubectl-tap on --set-header ***"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, auditCommandLine(tc.Args))
+		})
+	}
+}
+
+func Test_NewTapCommandAudit(t *testing.T) {
+	require := require.New(t)
+	hostname, err := os.Hostname()
+	require.Nil(err)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("user", "alice")
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	audit, ok := tapAuditFromAnnotations(svc.Annotations)
+	require.True(ok)
+	require.Equal("alice", audit.User)
+	require.Equal(hostname, audit.Hostname)
+	require.Equal(version, audit.Version)
+	require.False(audit.Time.IsZero())
+	require.Equal([]string{"Deployment/sample-deployment Tapped", "Service/sample-service Tapped"}, tapEvents(t, fakeClient))
+
+	b := bytes.NewBufferString("")
+	cmd.SetOutput(b)
+	require.Nil(NewListCommand(fakeClient, testViper)(cmd, []string{}))
+	require.Contains(b.String(), "sample-service  alice@"+hostname)
+
+	cmd.SetOutput(ioutil.Discard)
+	testViper.Set("user", "bob")
+	require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotContains(svc.Annotations, annotationAudit)
+	require.Equal([]string{
+		"Deployment/sample-deployment Tapped", "Deployment/sample-deployment Untapped",
+		"Service/sample-service Tapped", "Service/sample-service Untapped",
+	}, tapEvents(t, fakeClient))
+
+	events, err := fakeClient.CoreV1().Events("default").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(err)
+	for _, e := range events.Items {
+		if e.Reason == eventReasonUntapped {
+			require.Contains(e.Message, "untapped by bob@"+hostname)
+			require.Contains(e.Message, "it was tapped by alice@"+hostname)
+		}
+	}
+}
+
+// tapEvents lists the Events recorded in the default namespace as "Kind/name Reason".
+func tapEvents(t *testing.T, client *fake.Clientset) []string {
+	events, err := client.CoreV1().Events("default").List(context.TODO(), metav1.ListOptions{})
+	require.Nil(t, err)
+	var got []string
+	for _, e := range events.Items {
+		require.Equal(t, eventSource, e.Source.Component)
+		got = append(got, e.InvolvedObject.Kind+"/"+e.InvolvedObject.Name+" "+e.Reason)
+	}
+	sort.Strings(got)
+	return got
+}
@@ -0,0 +1,332 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// defaultCASecretName is the Secret kubetap stores a supplied CA in, and
+	// which is reused by later taps in the same namespace.
+	defaultCASecretName = "kubetap-ca"
+
+	mitmproxyCAVolName = "kubetap-mitmproxy-ca"
+	mitmproxyCADir     = "/home/mitmproxy/ca/"
+	// mitmproxyCACertFile is the CA certificate mitmproxy writes to its confdir.
+	mitmproxyCACertFile = "/home/mitmproxy/.mitmproxy/mitmproxy-ca-cert.pem"
+
+	// upstreamCAKey is the Secret key holding a CA bundle, as used by cert-manager.
+	upstreamCAKey = "ca.crt"
+)
+
+var (
+	ErrCAInvalid         = errors.New("invalid CA")
+	ErrCASecretExists    = errors.New("the CA Secret already holds a different CA")
+	ErrCASecretInvalid   = errors.New("the CA Secret must be a kubernetes.io/tls Secret containing a CA certificate")
+	ErrTLSSecretInvalid  = errors.New("the TLS Secret must be a kubernetes.io/tls Secret containing a certificate and its key")
+	ErrUpstreamCAInvalid = errors.New("the upstream CA Secret must contain PEM encoded certificates in " + upstreamCAKey)
+)
+
+// proxyCA is a CA given as local files. It is only stored in its Secret once nothing else
+// can fail the tap, so that a failed tap leaves the cluster as it was.
+type proxyCA struct {
+	secret  string
+	cert    []byte
+	key     []byte
+	replace bool
+}
+
+// store writes the CA to its Secret.
+func (ca *proxyCA) store(secretsClient corev1.SecretInterface) error {
+	return storeCASecret(secretsClient, ca.secret, ca.cert, ca.key, ca.replace)
+}
+
+// caSecretFromFlags returns the name of the Secret holding the CA the proxy should use,
+// or an empty string to let mitmproxy generate one. A CA given as local files is validated
+// and returned to be stored in secretName, or in defaultCASecretName if unset, which must
+// not hold a different CA unless replace is set. Without any files, a CA previously stored
+// in defaultCASecretName is reused.
+func caSecretFromFlags(secretsClient corev1.SecretInterface, secretName, certFile, keyFile string, replace bool) (string, *proxyCA, error) {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return "", nil, fmt.Errorf("%w: --ca-cert and --ca-key must be set together", ErrCAInvalid)
+		}
+		cert, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return "", nil, err
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return "", nil, err
+		}
+		if err := validateCA(cert, key); err != nil {
+			return "", nil, err
+		}
+		if secretName == "" {
+			secretName = defaultCASecretName
+		}
+		ca := &proxyCA{secret: secretName, cert: cert, key: key, replace: replace}
+		if err := checkCASecret(secretsClient, ca); err != nil {
+			return "", nil, err
+		}
+		return secretName, ca, nil
+	}
+
+	name := secretName
+	if name == "" {
+		name = defaultCASecretName
+	}
+	secret, err := secretsClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) && secretName == "" {
+			return "", nil, nil
+		}
+		return "", nil, fmt.Errorf("error fetching the CA Secret: %w", err)
+	}
+	if err := validateCA(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]); err != nil {
+		return "", nil, fmt.Errorf("%w: Secret %q: %v", ErrCASecretInvalid, name, err)
+	}
+	return name, nil, nil
+}
+
+// checkCASecret ensures that storing a CA will not replace a different CA, which other taps
+// and clients may already trust, unless the CA is meant to replace it.
+func checkCASecret(secretsClient corev1.SecretInterface, ca *proxyCA) error {
+	secret, err := secretsClient.Get(context.TODO(), ca.secret, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching the CA Secret: %w", err)
+	}
+	sameCA := bytes.Equal(secret.Data[v1.TLSCertKey], ca.cert) && bytes.Equal(secret.Data[v1.TLSPrivateKeyKey], ca.key)
+	if !sameCA && !ca.replace {
+		return fmt.Errorf("%w: Secret %q, use --ca-replace to replace it", ErrCASecretExists, ca.secret)
+	}
+	return nil
+}
+
+// validateCA checks that a PEM encoded certificate and key match and can sign certificates.
+func validateCA(cert, key []byte) error {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCAInvalid, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCAInvalid, err)
+	}
+	if !leaf.BasicConstraintsValid || !leaf.IsCA {
+		return fmt.Errorf("%w: the certificate of %q is not a CA certificate", ErrCAInvalid, leaf.Subject.CommonName)
+	}
+	return nil
+}
+
+// validateProxySecrets checks the Secrets given with --tls-secret,
+// --upstream-client-cert-secret and --upstream-ca-secret, skipping those that are unset.
+func validateProxySecrets(secretsClient corev1.SecretInterface, tlsSecret, upstreamClientCertSecret, upstreamCASecret string) error {
+	if tlsSecret != "" {
+		if err := validateTLSSecret(secretsClient, tlsSecret); err != nil {
+			return err
+		}
+	}
+	if upstreamClientCertSecret != "" {
+		if err := validateTLSSecret(secretsClient, upstreamClientCertSecret); err != nil {
+			return err
+		}
+	}
+	if upstreamCASecret != "" {
+		if err := validateUpstreamCASecret(secretsClient, upstreamCASecret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTLSSecret checks that a Secret holds a certificate and matching key the proxy
+// can present to clients.
+func validateTLSSecret(secretsClient corev1.SecretInterface, name string) error {
+	secret, err := secretsClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching the TLS Secret: %w", err)
+	}
+	if _, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]); err != nil {
+		return fmt.Errorf("%w: Secret %q: %v", ErrTLSSecretInvalid, name, err)
+	}
+	return nil
+}
+
+// validateUpstreamCASecret checks that a Secret holds a CA bundle to verify upstream
+// certificates against.
+func validateUpstreamCASecret(secretsClient corev1.SecretInterface, name string) error {
+	secret, err := secretsClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching the upstream CA Secret: %w", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(secret.Data[upstreamCAKey]) {
+		return fmt.Errorf("%w: Secret %q", ErrUpstreamCAInvalid, name)
+	}
+	return nil
+}
+
+// storeCASecret creates the Secret holding the proxy CA. An existing Secret is only
+// replaced if it holds the same CA, or replace is set.
+func storeCASecret(secretsClient corev1.SecretInterface, name string, cert, key []byte, replace bool) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       cert,
+			v1.TLSPrivateKeyKey: key,
+		},
+	}
+	_, err := secretsClient.Create(context.TODO(), secret, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		if err := checkCASecret(secretsClient, &proxyCA{secret: name, cert: cert, key: key, replace: replace}); err != nil {
+			return err
+		}
+		_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("error storing the CA Secret: %w", err)
+	}
+	return nil
+}
+
+// NewCAExportCommand writes the CA certificate of the proxy tapping a Service, so that
+// test clients can be configured to trust it.
+func NewCAExportCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if targetService.Annotations[annotationOriginalTargetPort] == "" {
+			return ErrServiceNotTapped
+		}
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+
+		var cert []byte
+		proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		switch {
+		case err == nil && proxyOpts.CASecret != "":
+			secret, err := client.CoreV1().Secrets(namespace).Get(context.TODO(), proxyOpts.CASecret, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("error fetching the CA Secret: %w", err)
+			}
+			cert = secret.Data[v1.TLSCertKey]
+		case err == nil || errors.Is(err, ErrProxyOptionsMissing):
+			// the CA was generated by mitmproxy, so it only exists in the running Pod
+			cert, err = readTapPodFile(client, config, namespace, dpl.Name, mitmproxyCACertFile)
+			if err != nil {
+				return fmt.Errorf("error reading the CA from the proxy: %w", err)
+			}
+		default:
+			return err
+		}
+
+		if output := viper.GetString("caOutput"); output != "" {
+			if err := ioutil.WriteFile(output, cert, 0644); err != nil { //nolint: gosec
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Wrote the CA certificate of Service %q to %s\n", targetSvcName, output)
+			return nil
+		}
+		_, err = cmd.OutOrStdout().Write(cert)
+		return err
+	}
+}
+
+// readTapPodFile returns the contents of a file in the kubetap container of a ready tap Pod.
+func readTapPodFile(client kubernetes.Interface, config *rest.Config, namespace, deploymentName, path string) ([]byte, error) {
+	pods, err := listReadyTapPods(client.CoreV1().Pods(namespace), deploymentName)
+	if err != nil {
+		return nil, err
+	}
+	return execTapPod(config, namespace, pods[0].Name, []string{"cat", path}, nil)
+}
+
+// listReadyTapPods returns the ready kubetap Pods of a Deployment, or ErrKubetapPodNoMatch
+// if there are none.
+func listReadyTapPods(podsClient corev1.PodInterface, deploymentName string) ([]v1.Pod, error) {
+	pods, err := podsClient.List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ready []v1.Pod
+	for _, pod := range pods.Items {
+		if isTapPod(pod, deploymentName) && podReady(pod) {
+			ready = append(ready, pod)
+		}
+	}
+	if len(ready) == 0 {
+		return nil, ErrKubetapPodNoMatch
+	}
+	return ready, nil
+}
+
+// execTapPod runs a command in the kubetap container of a Pod and returns its output.
+// stdin is streamed to the command if it is not nil.
+func execTapPod(config *rest.Config, namespace, podName string, command []string, stdin io.Reader) ([]byte, error) {
+	query := url.Values{
+		"container": []string{kubetapContainerName},
+		"command":   command,
+		"stdout":    []string{"true"},
+		"stderr":    []string{"true"},
+	}
+	if stdin != nil {
+		query.Set("stdin", "true")
+	}
+	exec, err := remotecommand.NewSPDYExecutor(config, "POST", &url.URL{
+		Scheme:   "https",
+		Path:     "/api/v1/namespaces/" + namespace + "/pods/" + podName + "/exec",
+		Host:     strings.TrimPrefix(strings.TrimPrefix(config.Host, `http://`), `https://`),
+		RawQuery: query.Encode(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	if err := exec.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: &stdout, Stderr: &stderr}); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
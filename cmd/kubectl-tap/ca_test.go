@@ -0,0 +1,321 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_CASecretFromFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writePair := func(name string, isCA bool) (string, string) {
+		cert, key := testCertificate(t, isCA)
+		certFile := filepath.Join(dir, name+".crt")
+		keyFile := filepath.Join(dir, name+".key")
+		require.Nil(t, ioutil.WriteFile(certFile, cert, 0600))
+		require.Nil(t, ioutil.WriteFile(keyFile, key, 0600))
+		return certFile, keyFile
+	}
+	caCert, caKey := writePair("ca", true)
+	leafCert, leafKey := writePair("leaf", false)
+
+	tests := []struct {
+		Name       string
+		SecretName string
+		CertFile   string
+		KeyFile    string
+		Expected   string
+		Err        error
+	}{
+		{"none", "", "", "", "", nil},
+		{"files", "", caCert, caKey, defaultCASecretName, nil},
+		{"files_named", "my-ca", caCert, caKey, "my-ca", nil},
+		{"missing_key", "", caCert, "", "", ErrCAInvalid},
+		{"mismatched_key", "", caCert, leafKey, "", ErrCAInvalid},
+		{"not_a_ca", "", leafCert, leafKey, "", ErrCAInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			secretsClient := fakeClientUntappedSimple().CoreV1().Secrets("default")
+			name, ca, err := caSecretFromFlags(secretsClient, tc.SecretName, tc.CertFile, tc.KeyFile, false)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Expected, name)
+			if name == "" {
+				require.Nil(ca)
+				return
+			}
+			// the CA is only stored once the tap cannot fail anymore
+			_, err = secretsClient.Get(context.TODO(), name, metav1.GetOptions{})
+			require.True(k8serrors.IsNotFound(err), "the CA was stored before the tap")
+			require.Nil(ca.store(secretsClient))
+			// the stored CA is reused by later taps without any flags
+			name, ca, err = caSecretFromFlags(secretsClient, tc.SecretName, "", "", false)
+			require.Nil(err)
+			require.Nil(ca)
+			require.Equal(tc.Expected, name)
+			// storing the same CA again is not a conflict
+			_, _, err = caSecretFromFlags(secretsClient, tc.SecretName, tc.CertFile, tc.KeyFile, false)
+			require.Nil(err)
+		})
+	}
+
+	// unlike the default Secret, a Secret given with --ca-secret must exist
+	_, _, err = caSecretFromFlags(fakeClientUntappedSimple().CoreV1().Secrets("default"), "my-ca", "", "", false)
+	require.True(t, k8serrors.IsNotFound(errors.Unwrap(err)), "expected a NotFound error, got (%q)", err)
+}
+
+func Test_CASecretReplace(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	secretsClient := fakeClientUntappedSimple().CoreV1().Secrets("default")
+	cert, key := testCertificate(t, true)
+	require.Nil(storeCASecret(secretsClient, defaultCASecretName, cert, key, false))
+
+	// another CA does not replace the one that taps and clients already trust
+	otherCert, otherKey := testCertificate(t, true)
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.crt"), otherCert, 0600))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.key"), otherKey, 0600))
+	_, _, err = caSecretFromFlags(secretsClient, "", filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), false)
+	require.True(errors.Is(err, ErrCASecretExists), "expected (%q), got (%q)", ErrCASecretExists, err)
+	err = storeCASecret(secretsClient, defaultCASecretName, otherCert, otherKey, false)
+	require.True(errors.Is(err, ErrCASecretExists), "expected (%q), got (%q)", ErrCASecretExists, err)
+	secret, err := secretsClient.Get(context.TODO(), defaultCASecretName, metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(cert, secret.Data[v1.TLSCertKey])
+
+	// unless asked to
+	_, ca, err := caSecretFromFlags(secretsClient, "", filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), true)
+	require.Nil(err)
+	require.Nil(ca.store(secretsClient))
+	secret, err = secretsClient.Get(context.TODO(), defaultCASecretName, metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(otherCert, secret.Data[v1.TLSCertKey])
+}
+
+func Test_NewTapCommandCAPreflight(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	cert, key := testCertificate(t, true)
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.crt"), cert, 0600))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.key"), key, 0600))
+
+	// a tap failing its pre-flight checks does not store the CA
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 9999)
+	testViper.Set("caCert", filepath.Join(dir, "ca.crt"))
+	testViper.Set("caKey", filepath.Join(dir, "ca.key"))
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.NotNil(err)
+	require.Contains(err.Error(), "pre-flight checks failed")
+	_, err = fakeClient.CoreV1().Secrets("default").Get(context.TODO(), defaultCASecretName, metav1.GetOptions{})
+	require.True(k8serrors.IsNotFound(err), "the CA was stored by a failed tap")
+}
+
+func Test_NewTapCommandCA(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	cert, key := testCertificate(t, true)
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.crt"), cert, 0600))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.key"), key, 0600))
+
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("caCert", filepath.Join(dir, "ca.crt"))
+	testViper.Set("caKey", filepath.Join(dir, "ca.key"))
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	var mounted bool
+	for _, vol := range dpl.Spec.Template.Spec.Volumes {
+		if vol.Name == mitmproxyCAVolName {
+			require.Equal(defaultCASecretName, vol.Secret.SecretName)
+			mounted = true
+		}
+	}
+	require.True(mounted, "the CA Secret was not mounted")
+
+	b := bytes.NewBufferString("")
+	cmd.SetOutput(b)
+	require.Nil(NewCAExportCommand(fakeClient, &rest.Config{}, viper.New())(cmd, []string{"sample-service"}))
+	require.Equal(string(cert), b.String())
+
+	// untapping leaves the CA for the next tap
+	require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, viper.New())(cmd, []string{"sample-service"}))
+	_, err = fakeClient.CoreV1().Secrets("default").Get(context.TODO(), defaultCASecretName, metav1.GetOptions{})
+	require.Nil(err)
+}
+
+// testCertificate returns a PEM encoded self-signed certificate and its key.
+func testCertificate(t *testing.T, isCA bool) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubetap test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func Test_NewTapCommandTLSSecret(t *testing.T) {
+	cert, key := testCertificate(t, false)
+	tests := []struct {
+		Name   string
+		Secret *v1.Secret
+		Err    error
+	}{
+		{"simple", &v1.Secret{Data: map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key}}, nil},
+		{"missing_key", &v1.Secret{Data: map[string][]byte{v1.TLSCertKey: cert}}, ErrTLSSecretInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			tc.Secret.Name = "sample-tls"
+			_, err := fakeClient.CoreV1().Secrets("default").Create(context.TODO(), tc.Secret, metav1.CreateOptions{})
+			require.Nil(err)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("tlsSecret", "sample-tls")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err = NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+				require.Nil(err)
+				require.Empty(svc.Annotations[annotationOriginalTargetPort], "the Service was tapped despite the invalid Secret")
+				return
+			}
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			var mounted bool
+			for _, vol := range dpl.Spec.Template.Spec.Volumes {
+				if vol.Name == mitmproxyTLSVolName {
+					require.Equal("sample-tls", vol.Secret.SecretName)
+					mounted = true
+				}
+			}
+			require.True(mounted, "the TLS Secret was not mounted")
+			cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Contains(string(cm.BinaryData[mitmproxyConfigFile]), "certs:\n- '*="+mitmproxyTLSCertFile+"'\n")
+		})
+	}
+}
+
+func Test_NewTapCommandUpstreamSecrets(t *testing.T) {
+	cert, key := testCertificate(t, false)
+	caCert, _ := testCertificate(t, true)
+	tests := []struct {
+		Name     string
+		CABundle []byte
+		Err      error
+	}{
+		{"simple", caCert, nil},
+		{"invalid_ca", []byte("not a certificate"), ErrUpstreamCAInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			for _, secret := range []*v1.Secret{
+				{ObjectMeta: metav1.ObjectMeta{Name: "client"}, Data: map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "upstream-ca"}, Data: map[string][]byte{upstreamCAKey: tc.CABundle}},
+			} {
+				_, err := fakeClient.CoreV1().Secrets("default").Create(context.TODO(), secret, metav1.CreateOptions{})
+				require.Nil(err)
+			}
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("https", true)
+			testViper.Set("upstreamClientCertSecret", "client")
+			testViper.Set("upstreamCASecret", "upstream-ca")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			err := NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			secrets := make(map[string]string)
+			for _, vol := range dpl.Spec.Template.Spec.Volumes {
+				if vol.Secret != nil {
+					secrets[vol.Name] = vol.Secret.SecretName
+				}
+			}
+			require.Equal(map[string]string{
+				mitmproxyUpstreamClientVolName: "client",
+				mitmproxyUpstreamCAVolName:     "upstream-ca",
+			}, secrets)
+		})
+	}
+}
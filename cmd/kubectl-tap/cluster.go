@@ -0,0 +1,374 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/pkg/browser"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// ErrInvalidClusterTarget is returned when a --target is not of the form CONTEXT=[NAMESPACE/]SERVICE.
+	ErrInvalidClusterTarget = errors.New("invalid --target, expected CONTEXT=[NAMESPACE/]SERVICE")
+	// ErrClusterUntapFailed is returned when some Services of a multi-cluster session could not be untapped.
+	ErrClusterUntapFailed = errors.New("failed to untap Services")
+)
+
+// clusterTarget is a Service to tap in the cluster of a kubeconfig context.
+type clusterTarget struct {
+	Context   string
+	Namespace string
+	Service   string
+}
+
+// clusterClients are the clients of a kubeconfig context, along with the namespace and the
+// kubeconfig user of the context.
+type clusterClients struct {
+	client    kubernetes.Interface
+	config    *rest.Config
+	namespace string
+	user      string
+}
+
+// clusterTap is a Service tapped as part of a multi-cluster session, and the local ports
+// its proxy web interface and Service ports are forwarded to.
+type clusterTap struct {
+	clusterTarget
+	client      kubernetes.Interface
+	config      *rest.Config
+	viper       *viper.Viper
+	deployment  string
+	proxy       Tap
+	exposeWeb   bool
+	ports       []int32
+	listenPorts []int
+	password    string
+	webPort     int
+	forwardPort int
+}
+
+// parseClusterTargets parses --target values of the form CONTEXT=[NAMESPACE/]SERVICE.
+func parseClusterTargets(values []string) ([]clusterTarget, error) {
+	targets := make([]clusterTarget, 0, len(values))
+	for _, value := range values {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidClusterTarget, value)
+		}
+		target := clusterTarget{Context: kv[0], Service: kv[1]}
+		if i := strings.Index(kv[1], "/"); i >= 0 {
+			target.Namespace, target.Service = kv[1][:i], kv[1][i+1:]
+			if target.Namespace == "" || target.Service == "" || strings.Contains(target.Service, "/") {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidClusterTarget, value)
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// NewMultiClusterTapCommand taps a Service in each of the kubeconfig contexts given with
+// --target. If any of them cannot be tapped, the Services tapped so far are untapped again.
+// With --port-forward, the web interfaces and Services of all proxies are forwarded at once
+// until interrupted, and then all of them are untapped together.
+func NewMultiClusterTapCommand(contextClients func(string) (clusterClients, error), viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
+	return func(cmd *cobra.Command, _ []string) error {
+		targets, err := parseClusterTargets(viper.GetStringSlice("targets"))
+		if err != nil {
+			return err
+		}
+		targetSvcPort := viper.GetInt32("proxyPort")
+		allPorts := viper.GetBool("allPorts")
+		portForward := viper.GetBool("portForward")
+		openBrowser := viper.GetBool("browser")
+		readyTimeout := viper.GetDuration("timeout")
+		if openBrowser {
+			portForward = true
+		}
+		if readyTimeout <= 0 {
+			readyTimeout = defaultReadyTimeout
+		}
+		commandArgs := strings.Fields(viper.GetString("commandArgs"))
+		if targetSvcPort == 0 && !allPorts {
+			return fmt.Errorf("--port flag not provided")
+		}
+		if targetSvcPort != 0 && allPorts {
+			return fmt.Errorf("--port and --all-ports cannot be used together")
+		}
+		out := cmd.OutOrStdout()
+
+		var taps []*clusterTap
+		nextForwardPort := localForwardPort
+		for i, target := range targets {
+			fmt.Fprintf(out, "Tapping Service %q in context %q...\n", target.Service, target.Context)
+			tap, err := tapCluster(cmd, contextClients, viper, target, targetSvcPort, allPorts, commandArgs)
+			if tap != nil {
+				taps = append(taps, tap)
+			}
+			if err != nil {
+				if len(taps) > 0 {
+					fmt.Fprintln(out, "Untapping the Services tapped so far...")
+					_ = untapClusters(cmd, taps)
+				}
+				return fmt.Errorf("context %q: %w", target.Context, err)
+			}
+			tap.webPort = kubetapProxyWebInterfacePort + i
+			tap.forwardPort = nextForwardPort
+			nextForwardPort += len(tap.ports)
+		}
+
+		scheme := "http"
+		if viper.GetBool("https") {
+			scheme = "https"
+		}
+		fmt.Fprintln(out)
+		if err := printClusterTaps(out, taps, scheme); err != nil {
+			return err
+		}
+		if !portForward {
+			fmt.Fprintf(out, "\nThe web interfaces and Services can be accessed at the addresses above\n")
+			fmt.Fprintf(out, "after running the following commands:\n\n")
+			for _, tap := range taps {
+				webTarget := "deploy/" + tap.deployment
+				if tap.exposeWeb {
+					webTarget = "svc/" + tap.Service
+				}
+				fmt.Fprintf(out, "  kubectl --context %s port-forward %s -n %s %d:%d\n", tap.Context, webTarget, tap.Namespace, tap.webPort, kubetapProxyWebInterfacePort)
+				var forwards []string
+				for i, p := range tap.ports {
+					forwards = append(forwards, fmt.Sprintf("%d:%d", tap.forwardPort+i, p))
+				}
+				fmt.Fprintf(out, "  kubectl --context %s port-forward svc/%s -n %s %s\n", tap.Context, tap.Service, tap.Namespace, strings.Join(forwards, " "))
+			}
+			fmt.Fprintf(out, "\nIn the future, you can run with --port-forward or --browser to automate this process.\n")
+			return nil
+		}
+
+		// We're now in an interactive state
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ic := make(chan os.Signal, 1)
+		signal.Notify(ic, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(ic)
+		go func() {
+			select {
+			case <-ic:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		fmt.Fprintln(out)
+		for _, tap := range taps {
+			fmt.Fprintf(out, "Waiting for the proxy of Deployment %q in context %q to become ready...\n", tap.deployment, tap.Context)
+			progress := func(status string) {
+				fmt.Fprintf(out, "  %s\n", status)
+			}
+			if _, err := waitForTapReady(ctx, tap.client, tap.Namespace, tap.deployment, readyTimeout, progress); err != nil {
+				if ctx.Err() != nil {
+					fmt.Fprintln(out, "")
+					fmt.Fprintln(out, "Stopping kubetap...")
+					return untapClusters(cmd, taps)
+				}
+				fmt.Fprintln(out, "Cancelling port-forwards, taps still active.")
+				return fmt.Errorf("context %q: %w", tap.Context, err)
+			}
+		}
+
+		fmt.Fprintf(out, "\nEstablishing port-forward tunnels to the proxies of all clusters...\n")
+		var wg sync.WaitGroup
+		errs := make([]error, len(taps))
+		for i, tap := range taps {
+			forwards := []string{fmt.Sprintf("%d:%d", tap.webPort, kubetapProxyWebInterfacePort)}
+			for j := range tap.ports {
+				forwards = append(forwards, fmt.Sprintf("%d:%d", tap.forwardPort+j, tap.listenPorts[j]))
+			}
+			readyCh := make(chan struct{})
+			wg.Add(1)
+			go func(i int, tap *clusterTap) {
+				defer wg.Done()
+				log := &prefixWriter{prefix: "[" + tap.Context + "] ", w: out}
+				if err := forwardTapPorts(ctx, tap.client, tap.config, tap.Namespace, tap.deployment, forwards, readyCh, log); err != nil {
+					errs[i] = fmt.Errorf("context %q: %w", tap.Context, err)
+					cancel()
+				}
+			}(i, tap)
+			if openBrowser {
+				go func(tap *clusterTap) {
+					select {
+					case <-readyCh:
+					case <-ctx.Done():
+						return
+					}
+					_ = browser.OpenURL("http://127.0.0.1:" + strconv.Itoa(tap.webPort) + "/?token=" + url.QueryEscape(tap.password))
+					_ = browser.OpenURL(scheme + "://127.0.0.1:" + strconv.Itoa(tap.forwardPort))
+				}(tap)
+			}
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				fmt.Fprintln(out, "Cancelling port-forwards, taps still active.")
+				return err
+			}
+		}
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Stopping kubetap...")
+		return untapClusters(cmd, taps)
+	}
+}
+
+// tapCluster taps the Service of a target with the clients of its context. The tap is
+// returned as soon as the Service is tapped, even if an error occurs afterwards, so that
+// it can be untapped again.
+func tapCluster(cmd *cobra.Command, contextClients func(string) (clusterClients, error), viper *viper.Viper, target clusterTarget, targetSvcPort int32, allPorts bool, commandArgs []string) (*clusterTap, error) {
+	clients, err := contextClients(target.Context)
+	if err != nil {
+		return nil, err
+	}
+	if controllerInstalled(clients.client) {
+		return nil, fmt.Errorf("--target is not supported for controller managed taps")
+	}
+	// the namespace of a target overrides --namespace, which overrides the namespace of the context
+	switch {
+	case target.Namespace != "":
+	case cmd.Flags().Changed("namespace"):
+		target.Namespace = targetNamespace(viper)
+	case clients.namespace != "":
+		target.Namespace = clients.namespace
+	default:
+		target.Namespace = defaultNamespace
+	}
+	tapViper := targetViper(viper, target.Namespace, clients.user)
+	exists, err := hasNamespace(clients.client, target.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching namespaces: %w", err)
+	}
+	if !exists {
+		return nil, ErrNamespaceNotExist
+	}
+	proxyOpts, err := tapProxyOptions(clients.client, clients.config, tapViper, target.Service, cmd.OutOrStdout())
+	if err != nil {
+		return nil, err
+	}
+	ports := []int32{targetSvcPort}
+	svcClient := clients.client.CoreV1().Services(target.Namespace)
+	if allPorts {
+		svc, err := svcClient.Get(context.TODO(), target.Service, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ports = tcpServicePorts(svc)
+	}
+	proxy, dpl, err := tapServices(clients.client, proxyOpts, []tapTarget{{target.Service, ports}}, commandArgs, cmd.OutOrStdout())
+	if err != nil {
+		return nil, err
+	}
+	tap := &clusterTap{
+		clusterTarget: target,
+		client:        clients.client,
+		config:        clients.config,
+		viper:         tapViper,
+		deployment:    dpl.Name,
+		proxy:         proxy,
+		exposeWeb:     proxyOpts.ExposeWeb,
+		ports:         ports,
+	}
+	if tap.listenPorts, err = serviceListenPorts(svcClient, target.Service, ports); err != nil {
+		return tap, err
+	}
+	if tap.password, err = webPassword(clients.client.CoreV1().Secrets(target.Namespace), dpl.Name); err != nil {
+		return tap, err
+	}
+	return tap, nil
+}
+
+// targetViper copies the settings of base for a tap in another cluster, which is made in
+// namespace by user.
+func targetViper(base *viper.Viper, namespace, user string) *viper.Viper {
+	v := viper.New()
+	for _, key := range base.AllKeys() {
+		v.Set(key, base.Get(key))
+	}
+	v.Set("namespace", namespace)
+	if user != "" {
+		v.Set("user", user)
+	}
+	return v
+}
+
+// printClusterTaps prints which proxy belongs to which cluster, and the local addresses
+// of their web interfaces and Services.
+func printClusterTaps(out io.Writer, taps []*clusterTap, scheme string) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTEXT\tNAMESPACE\tSERVICE\tPROXY\tWEB INTERFACE\tPASSWORD\tSERVICE PORTS")
+	for _, tap := range taps {
+		var forwards []string
+		for i, p := range tap.ports {
+			forwards = append(forwards, fmt.Sprintf("%d=%s://127.0.0.1:%d", p, scheme, tap.forwardPort+i))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s in deploy/%s\thttp://127.0.0.1:%d\t%s\t%s\n", tap.Context, tap.Namespace, tap.Service,
+			tap.proxy, tap.deployment, tap.webPort, tap.password, strings.Join(forwards, ","))
+	}
+	return w.Flush()
+}
+
+// untapClusters untaps the Services of a multi-cluster session, carrying on if some of
+// them cannot be untapped.
+func untapClusters(cmd *cobra.Command, taps []*clusterTap) error {
+	var failed []string
+	for _, tap := range taps {
+		fmt.Fprintf(cmd.OutOrStdout(), "Context %q:\n", tap.Context)
+		if err := NewUntapCommand(tap.client, tap.config, tap.viper)(cmd, []string{tap.Service}); err != nil {
+			fmt.Fprintf(cmd.OutOrStdout(), "Failed to untap Service %q: %v\n", tap.Service, err)
+			failed = append(failed, fmt.Sprintf("%q in context %q", tap.Service, tap.Context))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", ErrClusterUntapFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// prefixWriter prefixes everything written to w, so that the logs of concurrent
+// port-forwards tell which cluster they are about.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	// a single write keeps the prefix with its line
+	if _, err := p.w.Write(append([]byte(p.prefix), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ParseClusterTargets(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Values  []string
+		Targets []clusterTarget
+		Err     error
+	}{
+		{"service", []string{"edge=api-gateway"}, []clusterTarget{{"edge", "", "api-gateway"}}, nil},
+		{"namespace", []string{"core=payments/checkout"}, []clusterTarget{{"core", "payments", "checkout"}}, nil},
+		{"several", []string{"edge=api-gateway", "core=payments/checkout"}, []clusterTarget{{"edge", "", "api-gateway"}, {"core", "payments", "checkout"}}, nil},
+		{"no_context", []string{"=api-gateway"}, nil, ErrInvalidClusterTarget},
+		{"no_service", []string{"edge="}, nil, ErrInvalidClusterTarget},
+		{"no_separator", []string{"api-gateway"}, nil, ErrInvalidClusterTarget},
+		{"empty_namespace", []string{"edge=/api-gateway"}, nil, ErrInvalidClusterTarget},
+		{"nested_service", []string{"edge=a/b/c"}, nil, ErrInvalidClusterTarget},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			targets, err := parseClusterTargets(tc.Values)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Targets, targets)
+		})
+	}
+}
+
+func Test_NewMultiClusterTapCommand(t *testing.T) {
+	require := require.New(t)
+	clusters := map[string]*fake.Clientset{
+		"edge": fakeClientUntappedSimple(),
+		"core": fakeClientUntappedSimple(),
+	}
+	contextClients := func(name string) (clusterClients, error) {
+		client, ok := clusters[name]
+		if !ok {
+			return clusterClients{}, fmt.Errorf("context %q does not exist in the kubeconfig", name)
+		}
+		return clusterClients{client: client, config: &rest.Config{}, namespace: "default", user: name + "-user"}, nil
+	}
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("targets", []string{"edge=sample-service", "core=default/sample-service"})
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Nil(NewMultiClusterTapCommand(contextClients, testViper)(cmd, nil))
+	for name, client := range clusters {
+		require.True(hasSidecar(getDeployment(t, client)))
+		svc := getService(t, client, "sample-service")
+		require.Contains(svc.Annotations, annotationOriginalTargetPort)
+		// taps are recorded as made by the user of their context
+		require.Contains(svc.Annotations[annotationAudit], name+"-user")
+	}
+	// each proxy gets its own local ports
+	out := b.String()
+	require.Contains(out, "CONTEXT")
+	require.Regexp(`edge +default +sample-service +mitmproxy in deploy/sample-deployment +http://127.0.0.1:2244 +\S+ +80=http://127.0.0.1:4000`, out)
+	require.Regexp(`core +default +sample-service +mitmproxy in deploy/sample-deployment +http://127.0.0.1:2245 +\S+ +80=http://127.0.0.1:4001`, out)
+	require.Contains(out, "kubectl --context core port-forward deploy/sample-deployment -n default 2245:2244")
+	require.Contains(out, "kubectl --context core port-forward svc/sample-service -n default 4001:80")
+
+	// a failing target reverts the taps made before it
+	clusters["edge"] = fakeClientUntappedSimple()
+	testViper.Set("targets", []string{"edge=sample-service", "missing=sample-service"})
+	err := NewMultiClusterTapCommand(contextClients, testViper)(cmd, nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), `context "missing"`)
+	require.False(hasSidecar(getDeployment(t, clusters["edge"])))
+	require.NotContains(getService(t, clusters["edge"], "sample-service").Annotations, annotationOriginalTargetPort)
+
+	// --port and --all-ports conflict before any target is tapped
+	testViper.Set("targets", []string{"edge=sample-service"})
+	testViper.Set("allPorts", true)
+	err = NewMultiClusterTapCommand(contextClients, testViper)(cmd, nil)
+	require.NotNil(err)
+	require.Contains(err.Error(), "--port and --all-ports")
+	require.False(hasSidecar(getDeployment(t, clusters["edge"])))
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serviceCompletions returns the names of the Services in namespace starting with
+// toComplete, either the tapped or the untapped ones.
+func serviceCompletions(client kubernetes.Interface, namespace string, tapped bool, toComplete string) ([]string, error) {
+	services, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range services.Items {
+		if _, ok := svc.Annotations[annotationOriginalTargetPort]; ok != tapped {
+			continue
+		}
+		if strings.HasPrefix(svc.Name, toComplete) {
+			names = append(names, svc.Name)
+		}
+	}
+	return names, nil
+}
+
+// portCompletions returns the ports of a Service starting with toComplete, described by
+// their names.
+func portCompletions(client kubernetes.Interface, namespace, svcName, toComplete string) ([]string, error) {
+	svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), svcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ports []string
+	for _, p := range svc.Spec.Ports {
+		port := strconv.Itoa(int(p.Port))
+		if !strings.HasPrefix(port, toComplete) {
+			continue
+		}
+		if p.Name != "" {
+			// cobra shows what follows a tab as the description of a completion
+			port += "\t" + p.Name
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// completeServices completes the Service argument of a command with the tapped or the
+// untapped Services of the selected namespace.
+func (k *kubeClients) completeServices(tapped bool) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		client, namespace, err := k.completionClient()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		names, err := serviceCompletions(client, namespace, tapped, toComplete)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completePorts completes --port with the ports of the Service given as argument.
+func (k *kubeClients) completePorts(_ *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	client, namespace, err := k.completionClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	ports, err := portCompletions(client, namespace, args[0], toComplete)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	return ports, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completionClient returns the client and the namespace to complete with. Completions do
+// not run the PersistentPreRun of the root command, so the namespace is resolved here.
+func (k *kubeClients) completionClient() (kubernetes.Interface, string, error) {
+	client, _, _, err := k.build()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err := k.flags.ToRawKubeConfigLoader().Namespace()
+	if err != nil || namespace == "" {
+		namespace = defaultNamespace
+	}
+	return client, namespace, nil
+}
+
+// NewCompletionCommand writes the completion script of a shell to the output of the command.
+// The script completes the kubectl-tap binary, the root command is renamed for that as its
+// name contains an em space.
+func NewCompletionCommand() func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		root := cmd.Root()
+		use := root.Use
+		root.Use = "kubectl-tap"
+		defer func() { root.Use = use }()
+		switch args[0] {
+		case "bash":
+			return root.GenBashCompletion(cmd.OutOrStdout())
+		case "zsh":
+			return root.GenZshCompletion(cmd.OutOrStdout())
+		case "fish":
+			return root.GenFishCompletion(cmd.OutOrStdout(), true)
+		}
+		return fmt.Errorf("unsupported shell %q, expected one of bash, zsh or fish", args[0])
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_ServiceCompletions(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Tapped     bool
+		ToComplete string
+		Names      []string
+	}{
+		{"untapped", fakeClientUntappedSimple, false, "", []string{"sample-service"}},
+		{"untapped_for_tapped", fakeClientUntappedSimple, true, "", nil},
+		{"tapped", fakeClientTappedSimple, true, "", []string{"sample-service"}},
+		{"tapped_for_untapped", fakeClientTappedSimple, false, "", nil},
+		{"prefix", fakeClientSelector, false, "sample-", []string{"sample-admin", "sample-service"}},
+		{"prefix_no_match", fakeClientSelector, false, "other-x", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			names, err := serviceCompletions(tc.ClientFunc(), "default", tc.Tapped, tc.ToComplete)
+			require.Nil(err)
+			require.ElementsMatch(tc.Names, names)
+		})
+	}
+}
+
+func Test_PortCompletions(t *testing.T) {
+	require := require.New(t)
+	client := fakeClientSelector()
+	ports, err := portCompletions(client, "default", "sample-service", "")
+	require.Nil(err)
+	require.Equal([]string{"80\tservicePortOne", "443\thttps"}, ports)
+	ports, err = portCompletions(client, "default", "sample-service", "4")
+	require.Nil(err)
+	require.Equal([]string{"443\thttps"}, ports)
+	// unnamed ports have no description
+	ports, err = portCompletions(client, "default", "sample-admin", "")
+	require.Nil(err)
+	require.Equal([]string{"9090"}, ports)
+	_, err = portCompletions(client, "default", "missing-service", "")
+	require.NotNil(err)
+}
+
+func Test_CompletionCommand(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		t.Run(shell, func(t *testing.T) {
+			require := require.New(t)
+			root := NewRootCmd(&MockExiter{})
+			cmd := NewCompletionCmd()
+			root.AddCommand(cmd)
+			b := bytes.NewBufferString("")
+			cmd.SetOutput(b)
+			require.Nil(NewCompletionCommand()(cmd, []string{shell}))
+			require.Contains(b.String(), "completion for kubectl-tap")
+			require.Equal(NewRootCmd(&MockExiter{}).Use, root.Use, "the root command was not restored")
+		})
+	}
+	require.NotNil(t, cobra.ExactValidArgs(1)(NewCompletionCmd(), []string{"powershell"}))
+}
@@ -0,0 +1,1128 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	kubetapControllerName = "kubetap-controller"
+	tapFinalizer          = "kubetap.io/finalizer"
+
+	conditionSidecarReady      = "SidecarReady"
+	conditionServiceRedirected = "ServiceRedirected"
+
+	controllerResyncPeriod  = 10 * time.Minute
+	controllerRequeuePeriod = 5 * time.Second
+)
+
+var (
+	tapGVR = schema.GroupVersionResource{Group: "kubetap.io", Version: "v1alpha1", Resource: "taps"}
+	crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+)
+
+var (
+	ErrTapSpecInvalid  = errors.New("the Tap spec is invalid")
+	ErrTapsRemaining   = errors.New("Tap resources still exist")
+	ErrControllerCache = errors.New("timed out syncing Tap resources")
+)
+
+// tapCRD is the CustomResourceDefinition for the Tap resource.
+const tapCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: taps.kubetap.io
+spec:
+  group: kubetap.io
+  scope: Namespaced
+  names:
+    kind: Tap
+    listKind: TapList
+    plural: taps
+    singular: tap
+  versions:
+  - name: v1alpha1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Service
+      type: string
+      jsonPath: .spec.service
+    - name: Deployment
+      type: string
+      jsonPath: .status.deployment
+    - name: Ready
+      type: string
+      jsonPath: .status.conditions[?(@.type=="SidecarReady")].status
+    - name: Age
+      type: date
+      jsonPath: .metadata.creationTimestamp
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [service, ports]
+            properties:
+              service:
+                type: string
+              ports:
+                type: array
+                minItems: 1
+                items:
+                  type: integer
+                  format: int32
+              protocol:
+                type: string
+                enum: [http]
+              image:
+                type: string
+              https:
+                type: boolean
+              ttl:
+                type: string
+              filters:
+                type: array
+                items:
+                  type: string
+              options:
+                type: object
+                x-kubernetes-preserve-unknown-fields: true
+              caSecret:
+                type: string
+              tlsSecret:
+                type: string
+              upstreamInsecure:
+                type: boolean
+              upstreamClientCertSecret:
+                type: string
+              upstreamCASecret:
+                type: string
+              setHeaders:
+                type: array
+                items:
+                  type: string
+              replaceBody:
+                type: array
+                items:
+                  type: string
+              mirrorTo:
+                type: string
+              exposeWeb:
+                type: boolean
+              redact:
+                type: array
+                items:
+                  type: string
+              redactDefaults:
+                type: boolean
+          status:
+            type: object
+            x-kubernetes-preserve-unknown-fields: true
+`
+
+// TapResource is a declarative tap of a Service, reconciled by the kubetap controller.
+type TapResource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TapSpec   `json:"spec"`
+	Status TapStatus `json:"status,omitempty"`
+}
+
+// TapSpec is the desired state of a Tap.
+type TapSpec struct {
+	// Service is the name of the Service to tap, in the namespace of the Tap
+	Service string `json:"service"`
+	// Ports are the Service ports to tap. Only one port is currently supported.
+	Ports []int32 `json:"ports"`
+	// Protocol is the protocol type, defaults to http
+	Protocol Protocol `json:"protocol,omitempty"`
+	// Image is the proxy image, defaults to the controller's proxy image
+	Image string `json:"image,omitempty"`
+	// HTTPS should be set to true if the target is using HTTPS
+	HTTPS bool `json:"https,omitempty"`
+	// TTL removes the Tap once it has existed for this long
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// Filters are mitmproxy filter expressions limiting the flows shown in the web interface
+	Filters []string `json:"filters,omitempty"`
+	// Options are additional mitmproxy options, as accepted by --proxy-set
+	Options map[string]interface{} `json:"options,omitempty"`
+	// CASecret is a kubernetes.io/tls Secret holding the CA the proxy signs certificates with
+	CASecret string `json:"caSecret,omitempty"`
+	// TLSSecret is a kubernetes.io/tls Secret holding the certificate the proxy presents to clients
+	TLSSecret string `json:"tlsSecret,omitempty"`
+	// UpstreamInsecure disables verification of the upstream certificate
+	UpstreamInsecure bool `json:"upstreamInsecure,omitempty"`
+	// UpstreamClientCertSecret is a kubernetes.io/tls Secret holding the client certificate presented to the upstream
+	UpstreamClientCertSecret string `json:"upstreamClientCertSecret,omitempty"`
+	// UpstreamCASecret is a Secret holding the CA bundle, in ca.crt, the upstream certificate is verified against
+	UpstreamCASecret string `json:"upstreamCASecret,omitempty"`
+	// SetHeaders are mitmproxy modify_headers rules, as accepted by --set-header
+	SetHeaders []string `json:"setHeaders,omitempty"`
+	// ReplaceBody are mitmproxy modify_body rules, as accepted by --replace-body
+	ReplaceBody []string `json:"replaceBody,omitempty"`
+	// MirrorTo is the host:port requests are duplicated to, as accepted by --mirror-to
+	MirrorTo string `json:"mirrorTo,omitempty"`
+	// ExposeWeb adds the proxy web interface to the Service ports, defaults to false
+	ExposeWeb *bool `json:"exposeWeb,omitempty"`
+	// Redact are regular expressions redacted from captured flows, as accepted by --redact
+	Redact []string `json:"redact,omitempty"`
+	// RedactDefaults enables the built-in redaction rules, defaults to true
+	RedactDefaults *bool `json:"redactDefaults,omitempty"`
+}
+
+// TapStatus is the observed state of a Tap.
+type TapStatus struct {
+	// Deployment is the name of the tapped Deployment
+	Deployment string `json:"deployment,omitempty"`
+	// Conditions are SidecarReady and ServiceRedirected
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// DeepCopy returns a copy of the status that shares no memory with the original.
+func (s *TapStatus) DeepCopy() *TapStatus {
+	out := &TapStatus{Deployment: s.Deployment}
+	if s.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(s.Conditions))
+		for i := range s.Conditions {
+			s.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	return out
+}
+
+// NewInstallControllerCommand installs the Tap CustomResourceDefinition and the kubetap
+// controller that reconciles Tap resources.
+func NewInstallControllerCommand(client kubernetes.Interface, dynamicClient dynamic.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		image := viper.GetString("controllerImage")
+		if image == "" {
+			image = defaultImageKubetap
+		}
+		proxyImage := viper.GetString("proxyImage")
+		if proxyImage == "" {
+			proxyImage = defaultImageHTTP
+		}
+		commandArgs := viper.GetString("commandArgs")
+		if commandArgs == "" {
+			commandArgs = "mitmweb"
+		}
+
+		if err := applyTapCRD(dynamicClient); err != nil {
+			return err
+		}
+		if err := ensureSystemNamespace(client); err != nil {
+			return err
+		}
+		meta := metav1.ObjectMeta{
+			Name:      kubetapControllerName,
+			Namespace: kubetapSystemNamespace,
+			Labels:    map[string]string{"app.kubernetes.io/name": kubetapControllerName},
+		}
+		if err := installServiceAccount(client, meta, controllerRules()); err != nil {
+			return err
+		}
+		if err := applyDeployment(client, controllerDeployment(meta, image, proxyImage, commandArgs)); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Installed the kubetap controller in the %s namespace.\n\n", kubetapSystemNamespace)
+		fmt.Fprintf(cmd.OutOrStdout(), "kubectl tap on and off now create and delete Tap resources, which can\n")
+		fmt.Fprintf(cmd.OutOrStdout(), "also be applied directly:\n\n")
+		fmt.Fprintf(cmd.OutOrStdout(), "  kubectl get taps --all-namespaces\n")
+		return nil
+	}
+}
+
+// NewUninstallControllerCommand removes everything created by NewInstallControllerCommand.
+// Taps must be removed first, as their finalizers can only be handled by the controller.
+func NewUninstallControllerCommand(client kubernetes.Interface, dynamicClient dynamic.Interface) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		taps, err := dynamicClient.Resource(tapGVR).List(context.TODO(), metav1.ListOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return fmt.Errorf("error listing Taps: %w", err)
+		}
+		if err == nil && len(taps.Items) > 0 {
+			var names []string
+			for _, t := range taps.Items {
+				names = append(names, t.GetNamespace()+"/"+t.GetName())
+			}
+			return fmt.Errorf("%w, remove them with kubectl tap off first: %s", ErrTapsRemaining, strings.Join(names, ", "))
+		}
+
+		deletes := []func() error{
+			func() error {
+				return client.AppsV1().Deployments(kubetapSystemNamespace).Delete(context.TODO(), kubetapControllerName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.RbacV1().ClusterRoleBindings().Delete(context.TODO(), kubetapControllerName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.RbacV1().ClusterRoles().Delete(context.TODO(), kubetapControllerName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.CoreV1().ServiceAccounts(kubetapSystemNamespace).Delete(context.TODO(), kubetapControllerName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return dynamicClient.Resource(crdGVR).Delete(context.TODO(), tapGVR.GroupResource().String(), metav1.DeleteOptions{})
+			},
+		}
+		for _, del := range deletes {
+			if err := del(); err != nil && !k8serrors.IsNotFound(err) {
+				return fmt.Errorf("error removing the kubetap controller: %w", err)
+			}
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), "Removed the kubetap controller.")
+		return nil
+	}
+}
+
+// NewControllerCommand runs the Tap controller until interrupted. It is run in-cluster by
+// the Deployment created with install-controller.
+func NewControllerCommand(client kubernetes.Interface, dynamicClient dynamic.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ic := make(chan os.Signal, 1)
+		signal.Notify(ic, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(ic)
+		go func() {
+			select {
+			case <-ic:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		c := newTapController(client, dynamicClient, viper.GetString("proxyImage"), strings.Fields(viper.GetString("commandArgs")), cmd.OutOrStdout())
+		fmt.Fprintln(cmd.OutOrStdout(), "Starting kubetap controller")
+		return c.Run(ctx)
+	}
+}
+
+// NewCreateTapCommand taps a Service by creating a Tap resource for the kubetap controller,
+// and is used in place of NewTapCommand when the controller is installed.
+func NewCreateTapCommand(client kubernetes.Interface, dynamicClient dynamic.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		if viper.GetString("selector") != "" || viper.GetBool("allPorts") {
+			return fmt.Errorf("--selector and --all-ports are not supported for controller managed taps")
+		}
+		targetSvcName := args[0]
+		targetSvcPort := viper.GetInt32("proxyPort")
+		namespace := targetNamespace(viper)
+		image := viper.GetString("proxyImage")
+		if targetSvcPort == 0 {
+			return fmt.Errorf("--port flag not provided")
+		}
+		extraOptions, err := mitmproxyOptionsFromFlags(viper.GetStringSlice("proxySet"), viper.GetString("proxyConfig"))
+		if err != nil {
+			return err
+		}
+		if len(viper.GetStringSlice("scripts")) > 0 {
+			return fmt.Errorf("--script is not supported for controller managed taps")
+		}
+		if len(viper.GetStringSlice("mapLocal")) > 0 {
+			return fmt.Errorf("--map-local is not supported for controller managed taps")
+		}
+		// the controller converts header rules itself, so only validate them here
+		if _, err := headerRulesFromFlags(viper.GetStringSlice("setHeaders")); err != nil {
+			return err
+		}
+		replaceBody, err := bodyRulesFromFlags(viper.GetStringSlice("replaceBody"))
+		if err != nil {
+			return err
+		}
+		redact, err := redactPatternsFromFlags(viper.GetStringSlice("redact"))
+		if err != nil {
+			return err
+		}
+		exists, err := hasNamespace(client, namespace)
+		if err != nil {
+			return fmt.Errorf("error fetching namespaces: %w", err)
+		}
+		if !exists {
+			return ErrNamespaceNotExist
+		}
+		// the proxy runs in the Deployment behind the Service, which serves the web interface
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		caSecret, ca, err := caSecretFromFlags(client.CoreV1().Secrets(namespace), viper.GetString("caSecret"), viper.GetString("caCert"), viper.GetString("caKey"), viper.GetBool("caReplace"))
+		if err != nil {
+			return err
+		}
+		tlsSecret := viper.GetString("tlsSecret")
+		upstreamClientCertSecret := viper.GetString("upstreamClientCertSecret")
+		upstreamCASecret := viper.GetString("upstreamCASecret")
+		if err := validateProxySecrets(client.CoreV1().Secrets(namespace), tlsSecret, upstreamClientCertSecret, upstreamCASecret); err != nil {
+			return err
+		}
+		mirrorTo := viper.GetString("mirrorTo")
+		if mirrorTo != "" {
+			if err := validateMirrorTarget(client, namespace, mirrorTo); err != nil {
+				return err
+			}
+		}
+		// leave the image unset so the controller's default applies
+		if image == defaultImageHTTP {
+			image = ""
+		}
+		tap := &TapResource{
+			TypeMeta: metav1.TypeMeta{APIVersion: tapGVR.GroupVersion().String(), Kind: "Tap"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      targetSvcName,
+				Namespace: namespace,
+			},
+			Spec: TapSpec{
+				Service:   targetSvcName,
+				Ports:     []int32{targetSvcPort},
+				Protocol:  Protocol(viper.GetString("protocol")),
+				Image:     image,
+				HTTPS:     viper.GetBool("https"),
+				Options:   extraOptions,
+				CASecret:  caSecret,
+				TLSSecret: tlsSecret,
+
+				UpstreamInsecure:         viper.GetBool("upstreamInsecure"),
+				UpstreamClientCertSecret: upstreamClientCertSecret,
+				UpstreamCASecret:         upstreamCASecret,
+
+				SetHeaders:  viper.GetStringSlice("setHeaders"),
+				ReplaceBody: replaceBody,
+				MirrorTo:    mirrorTo,
+				Redact:      redact,
+			},
+		}
+		if viper.IsSet("exposeWeb") {
+			exposeWeb := viper.GetBool("exposeWeb")
+			tap.Spec.ExposeWeb = &exposeWeb
+		}
+		if viper.IsSet("redactDefaults") {
+			redactDefaults := viper.GetBool("redactDefaults")
+			tap.Spec.RedactDefaults = &redactDefaults
+		}
+		// the controller records the creator of the Tap on the Service it taps
+		audit := newTapAudit(currentUser(config, viper.GetString("user")))
+		tap.Annotations = map[string]string{annotationAudit: audit.annotation()}
+		u, err := tap.toUnstructured()
+		if err != nil {
+			return err
+		}
+		// the flags were validated, so the CA can be stored for the controller to mount
+		if ca != nil {
+			if err := ca.store(client.CoreV1().Secrets(namespace)); err != nil {
+				return err
+			}
+		}
+		if _, err := dynamicClient.Resource(tapGVR).Namespace(namespace).Create(context.TODO(), u, metav1.CreateOptions{}); err != nil {
+			if k8serrors.IsAlreadyExists(err) {
+				return ErrServiceTapped
+			}
+			return fmt.Errorf("error creating Tap: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Created Tap %q, the kubetap controller will tap port %d of Service %q.\n\n", targetSvcName, targetSvcPort, targetSvcName)
+		fmt.Fprintf(cmd.OutOrStdout(), "Follow its progress with:\n\n")
+		fmt.Fprintf(cmd.OutOrStdout(), "  kubectl get tap %s -n %s\n\n", targetSvcName, namespace)
+		fmt.Fprintf(cmd.OutOrStdout(), "Once ready, access the proxy web interface at http://127.0.0.1:2244 after running:\n\n")
+		webTarget := "deploy/" + dpl.Name
+		if tap.Spec.ExposeWeb != nil && *tap.Spec.ExposeWeb {
+			webTarget = "svc/" + targetSvcName
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "  kubectl port-forward %s -n %s 2244:2244\n\n", webTarget, namespace)
+		// a proxy shared with another tap already has its password, otherwise the
+		// controller creates it when it taps the Service
+		password, err := webPassword(client.CoreV1().Secrets(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+		if password != "" {
+			fmt.Fprintf(cmd.OutOrStdout(), "The web interface password is %s\n", password)
+			fmt.Fprintf(cmd.OutOrStdout(), "It is kept in Secret %q until the Service is untapped.\n", kubetapWebSecretPrefix+dpl.Name)
+		} else {
+			fmt.Fprintf(cmd.OutOrStdout(), "The web interface password will be kept in Secret %q, read it with:\n\n", kubetapWebSecretPrefix+dpl.Name)
+			fmt.Fprintf(cmd.OutOrStdout(), "  kubectl get secret %s%s -n %s -o jsonpath='{.data.%s}' | base64 -d\n", kubetapWebSecretPrefix, dpl.Name, namespace, webPasswordKey)
+		}
+		if viper.GetBool("portForward") || viper.GetBool("browser") {
+			fmt.Fprintf(cmd.OutOrStdout(), "\n--port-forward and --browser are not supported for controller managed taps.\n")
+		}
+		return nil
+	}
+}
+
+// NewDeleteTapCommand untaps a Service by deleting its Tap resource, falling back to
+// NewUntapCommand for Services that were tapped directly.
+func NewDeleteTapCommand(client kubernetes.Interface, dynamicClient dynamic.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		err := dynamicClient.Resource(tapGVR).Namespace(namespace).Delete(context.TODO(), targetSvcName, metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			return NewUntapCommand(client, config, viper)(cmd, args)
+		}
+		if err != nil {
+			return fmt.Errorf("error deleting Tap: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Deleted Tap %q, the kubetap controller will untap Service %q.\n", targetSvcName, targetSvcName)
+		return nil
+	}
+}
+
+// controllerInstalled reports whether the kubetap controller is running in the cluster.
+func controllerInstalled(client kubernetes.Interface) bool {
+	_, err := client.AppsV1().Deployments(kubetapSystemNamespace).Get(context.TODO(), kubetapControllerName, metav1.GetOptions{})
+	return err == nil
+}
+
+// tapController reconciles Tap resources using the same logic as kubectl tap on and off.
+type tapController struct {
+	client      kubernetes.Interface
+	dynamic     dynamic.Interface
+	image       string
+	commandArgs []string
+	queue       workqueue.RateLimitingInterface
+	log         io.Writer
+	now         func() time.Time
+}
+
+func newTapController(client kubernetes.Interface, dynamicClient dynamic.Interface, image string, commandArgs []string, log io.Writer) *tapController {
+	if image == "" {
+		image = defaultImageHTTP
+	}
+	if len(commandArgs) == 0 {
+		commandArgs = []string{"mitmweb"}
+	}
+	return &tapController{
+		client:      client,
+		dynamic:     dynamicClient,
+		image:       image,
+		commandArgs: commandArgs,
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		log:         log,
+		now:         time.Now,
+	}
+}
+
+// Run watches Tap resources and reconciles them until ctx is cancelled.
+func (c *tapController) Run(ctx context.Context) error {
+	defer c.queue.ShutDown()
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.dynamic, controllerResyncPeriod)
+	informer := factory.ForResource(tapGVR).Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+		DeleteFunc: c.enqueue,
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return ErrControllerCache
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for c.processNextItem(ctx) {
+		}
+	}, time.Second)
+	<-ctx.Done()
+	return nil
+}
+
+func (c *tapController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		fmt.Fprintf(c.log, "error queueing Tap: %v\n", err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// processNextItem reconciles the next queued Tap, returning false once the queue is shut down.
+func (c *tapController) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key.(string))
+	if err != nil {
+		c.queue.Forget(key)
+		return true
+	}
+	requeue, err := c.reconcile(ctx, namespace, name)
+	switch {
+	case err != nil:
+		fmt.Fprintf(c.log, "error reconciling Tap %q: %v\n", key, err)
+		c.queue.AddRateLimited(key)
+	case requeue > 0:
+		c.queue.Forget(key)
+		c.queue.AddAfter(key, requeue)
+	default:
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// reconcile drives a Tap towards its spec. It returns how long to wait before the Tap
+// should be looked at again, zero if only changes to the Tap matter.
+func (c *tapController) reconcile(ctx context.Context, namespace, name string) (time.Duration, error) { //nolint: gocyclo
+	tapsClient := c.dynamic.Resource(tapGVR).Namespace(namespace)
+	u, err := tapsClient.Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	tap, err := tapResourceFromUnstructured(u)
+	if err != nil {
+		return 0, err
+	}
+
+	if tap.DeletionTimestamp != nil {
+		if !containsString(tap.Finalizers, tapFinalizer) {
+			return 0, nil
+		}
+		if err := c.untap(tap); err != nil {
+			return 0, err
+		}
+		tap.Finalizers = removeString(tap.Finalizers, tapFinalizer)
+		_, err := c.update(ctx, tap)
+		return 0, err
+	}
+	if !containsString(tap.Finalizers, tapFinalizer) {
+		tap.Finalizers = append(tap.Finalizers, tapFinalizer)
+		if tap, err = c.update(ctx, tap); err != nil {
+			return 0, err
+		}
+	}
+
+	var requeue time.Duration
+	if tap.Spec.TTL != nil {
+		remaining := tap.CreationTimestamp.Add(tap.Spec.TTL.Duration).Sub(c.now())
+		if remaining <= 0 {
+			fmt.Fprintf(c.log, "Tap %s/%s expired after %s\n", namespace, name, tap.Spec.TTL.Duration)
+			return 0, tapsClient.Delete(ctx, name, metav1.DeleteOptions{})
+		}
+		requeue = remaining
+	}
+
+	status := tap.Status.DeepCopy()
+	redirected := c.redirect(tap, status)
+	if redirected {
+		if !c.sidecarReady(ctx, tap, status) && (requeue == 0 || requeue > controllerRequeuePeriod) {
+			requeue = controllerRequeuePeriod
+		}
+	} else {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               conditionSidecarReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "NotTapped",
+			Message:            "The Service has not been tapped",
+			ObservedGeneration: tap.Generation,
+		})
+		if requeue == 0 || requeue > controllerRequeuePeriod {
+			requeue = controllerRequeuePeriod
+		}
+	}
+	if !equality.Semantic.DeepEqual(status, &tap.Status) {
+		tap.Status = *status
+		if err := c.updateStatus(ctx, tap); err != nil {
+			return 0, err
+		}
+	}
+	return requeue, nil
+}
+
+// redirect taps the Service of a Tap unless it already has been, recording the result
+// in the ServiceRedirected condition.
+func (c *tapController) redirect(tap *TapResource, status *TapStatus) bool {
+	cond := metav1.Condition{
+		Type:               conditionServiceRedirected,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: tap.Generation,
+	}
+	defer func() {
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}()
+
+	if err := tap.Spec.validate(); err != nil {
+		cond.Reason = "InvalidSpec"
+		cond.Message = err.Error()
+		return false
+	}
+	svc, err := c.client.CoreV1().Services(tap.Namespace).Get(context.TODO(), tap.Spec.Service, metav1.GetOptions{})
+	if err != nil {
+		cond.Reason = "ServiceNotFound"
+		cond.Message = err.Error()
+		return false
+	}
+	if svc.Annotations[annotationOriginalTargetPort] != "" {
+		if !ownsService(tap, svc) {
+			cond.Reason = "AlreadyTapped"
+			cond.Message = ErrServiceTapped.Error()
+			return false
+		}
+		retap, err := c.reapply(tap, svc)
+		if err != nil {
+			cond.Reason = "UpdateFailed"
+			cond.Message = err.Error()
+			return false
+		}
+		if !retap {
+			cond.Status = metav1.ConditionTrue
+			cond.Reason = "Tapped"
+			cond.Message = fmt.Sprintf("Port %d of Service %q is redirected to the proxy", tap.Spec.Ports[0], tap.Spec.Service)
+			return true
+		}
+	}
+
+	proxyOpts := c.proxyOptions(tap)
+	audit, ok := tapAuditFromAnnotations(tap.Annotations)
+	if !ok {
+		// applied directly, so the creator is unknown
+		audit = newTapAudit(unknownUser)
+		audit.Command = "Tap " + tap.Namespace + "/" + tap.Name
+	}
+	// the owner is stored on the Service together with the redirect, so it is known
+	// even if the status update below is lost
+	audit.TapUID = string(tap.UID)
+	proxyOpts.Audit = &audit
+	_, dpl, err := tapService(c.client, proxyOpts, tap.Spec.Ports[0], c.commandArgs, ioutil.Discard)
+	if err != nil {
+		cond.Reason = "TapFailed"
+		cond.Message = err.Error()
+		return false
+	}
+	fmt.Fprintf(c.log, "Tapped Service %s/%s\n", tap.Namespace, tap.Spec.Service)
+	status.Deployment = dpl.Name
+	cond.Status = metav1.ConditionTrue
+	cond.Reason = "Tapped"
+	cond.Message = fmt.Sprintf("Port %d of Service %q is redirected to the proxy", tap.Spec.Ports[0], tap.Spec.Service)
+	return true
+}
+
+// proxyOptions returns the options of the proxy described by the spec of a Tap.
+func (c *tapController) proxyOptions(tap *TapResource) ProxyOptions {
+	image := tap.Spec.Image
+	if image == "" {
+		image = c.image
+	}
+	proxyOpts := ProxyOptions{
+		Target:        tap.Spec.Service,
+		Protocol:      tap.Spec.Protocol,
+		UpstreamHTTPS: tap.Spec.HTTPS,
+		Mode:          "reverse",
+		Namespace:     tap.Namespace,
+		Image:         image,
+		Filters:       tap.Spec.Filters,
+		ExtraOptions:  tap.Spec.Options,
+		CASecret:      tap.Spec.CASecret,
+		TLSSecret:     tap.Spec.TLSSecret,
+
+		UpstreamInsecure:         tap.Spec.UpstreamInsecure,
+		UpstreamClientCertSecret: tap.Spec.UpstreamClientCertSecret,
+		UpstreamCASecret:         tap.Spec.UpstreamCASecret,
+
+		ReplaceBody: tap.Spec.ReplaceBody,
+		MirrorTo:    tap.Spec.MirrorTo,
+		ExposeWeb:   tap.Spec.ExposeWeb != nil && *tap.Spec.ExposeWeb,
+
+		Redact:             tap.Spec.Redact,
+		NoDefaultRedaction: tap.Spec.RedactDefaults != nil && !*tap.Spec.RedactDefaults,
+	}
+	// the spec was validated, so the header rules convert cleanly
+	proxyOpts.SetHeaders, _ = headerRulesFromFlags(tap.Spec.SetHeaders)
+	return proxyOpts
+}
+
+// reapply brings the tap of a Service owned by a Tap in line with the spec of the Tap.
+// Changed options are written to the proxy ConfigMap and roll the Deployment, the same
+// way kubectl tap update does. A changed port, Secret or web interface exposure changes
+// the Service and the volumes of the proxy, so the tap is removed to be made again, and
+// true is returned. A proxy shared with other Services keeps its options, as it does
+// when it is tapped, and only the scheme of the port is updated.
+func (c *tapController) reapply(tap *TapResource, svc *v1.Service) (bool, error) {
+	dpl, err := deploymentFromSelectors(c.client.AppsV1().Deployments(tap.Namespace), svc.Spec.Selector)
+	if err != nil {
+		return false, err
+	}
+	current, err := loadMitmproxyOptions(c.client.CoreV1().ConfigMaps(tap.Namespace), dpl.Name)
+	if err != nil {
+		return false, err
+	}
+	current.Namespace = tap.Namespace
+	desired := c.proxyOptions(tap)
+
+	upstreams := append([]ProxyUpstream{}, tapUpstreams(c.client.CoreV1().Services(tap.Namespace), current)...)
+	var ports []int32
+	shared := false
+	for i, u := range upstreams {
+		if u.Service != tap.Spec.Service {
+			shared = true
+			continue
+		}
+		ports = append(ports, u.Port)
+		upstreams[i].HTTPS = desired.UpstreamHTTPS
+	}
+	retap := !reflect.DeepEqual(ports, tap.Spec.Ports)
+	if !shared {
+		retap = retap || current.ExposeWeb != desired.ExposeWeb ||
+			current.CASecret != desired.CASecret ||
+			current.TLSSecret != desired.TLSSecret ||
+			current.UpstreamClientCertSecret != desired.UpstreamClientCertSecret ||
+			current.UpstreamCASecret != desired.UpstreamCASecret
+	}
+	if retap {
+		fmt.Fprintf(c.log, "Tapping Service %s/%s again for the changed spec\n", tap.Namespace, tap.Spec.Service)
+		return true, c.untap(tap)
+	}
+
+	updated := current
+	updated.setUpstreams(upstreams)
+	if !shared {
+		updated.Protocol = desired.Protocol
+		updated.Image = desired.Image
+		updated.Filters = desired.Filters
+		updated.ExtraOptions = desired.ExtraOptions
+		updated.UpstreamInsecure = desired.UpstreamInsecure
+		updated.SetHeaders = desired.SetHeaders
+		updated.ReplaceBody = desired.ReplaceBody
+		updated.MirrorTo = desired.MirrorTo
+		updated.Redact = desired.Redact
+		updated.NoDefaultRedaction = desired.NoDefaultRedaction
+	}
+	if reflect.DeepEqual(updated, current) {
+		return false, nil
+	}
+
+	proxy := NewMitmproxy(c.client, updated)
+	update, err := proxy.UpdateEnv()
+	if err != nil {
+		return false, err
+	}
+	deploymentsClient := c.client.AppsV1().Deployments(tap.Namespace)
+	var sidecar v1.Container
+	for _, container := range dpl.Spec.Template.Spec.Containers {
+		if container.Name == kubetapContainerName {
+			sidecar = *container.DeepCopy()
+		}
+	}
+	switch {
+	case sidecar.Image != updated.Image:
+		sidecar.Image = updated.Image
+		err = updateSidecar(deploymentsClient, dpl.Name, sidecar)
+	case update.Restart || len(update.Options) > 0:
+		// the controller cannot reach the mitmweb API of the proxy
+		err = restartDeployment(deploymentsClient, dpl.Name)
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(c.log, "Updated the tap of Service %s/%s\n", tap.Namespace, tap.Spec.Service)
+	return false, nil
+}
+
+// sidecarReady records whether the tapped Deployment has rolled out with a ready sidecar
+// in the SidecarReady condition.
+func (c *tapController) sidecarReady(ctx context.Context, tap *TapResource, status *TapStatus) bool {
+	cond := metav1.Condition{
+		Type:               conditionSidecarReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: tap.Generation,
+	}
+	defer func() {
+		meta.SetStatusCondition(&status.Conditions, cond)
+	}()
+
+	dpl, err := c.tappedDeployment(ctx, tap, status)
+	if err != nil {
+		cond.Reason = "DeploymentNotFound"
+		cond.Message = err.Error()
+		return false
+	}
+	podList, err := c.client.CoreV1().Pods(tap.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		cond.Reason = "PodsUnavailable"
+		cond.Message = err.Error()
+		return false
+	}
+	pods := make([]*v1.Pod, len(podList.Items))
+	for i := range podList.Items {
+		pods[i] = &podList.Items[i]
+	}
+	pod, progress, err := tapRolloutStatus(dpl, pods)
+	switch {
+	case err != nil:
+		cond.Reason = "RolloutFailed"
+		cond.Message = err.Error()
+		return false
+	case pod == nil:
+		cond.Reason = "RollingOut"
+		cond.Message = progress
+		return false
+	}
+	cond.Status = metav1.ConditionTrue
+	cond.Reason = "Ready"
+	cond.Message = fmt.Sprintf("The kubetap sidecar in Pod %q is ready", pod.Name)
+	return true
+}
+
+// tappedDeployment returns the Deployment recorded in the status, resolving it through
+// the Service selectors if it has not been recorded yet.
+func (c *tapController) tappedDeployment(ctx context.Context, tap *TapResource, status *TapStatus) (*k8sappsv1.Deployment, error) {
+	deploymentsClient := c.client.AppsV1().Deployments(tap.Namespace)
+	if status.Deployment != "" {
+		return deploymentsClient.Get(ctx, status.Deployment, metav1.GetOptions{})
+	}
+	svc, err := c.client.CoreV1().Services(tap.Namespace).Get(ctx, tap.Spec.Service, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	dpl, err := deploymentFromSelectors(deploymentsClient, svc.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	status.Deployment = dpl.Name
+	return &dpl, nil
+}
+
+// ownsService reports whether the tap of a Service was made for a Tap, as recorded in
+// the audit annotation of the Service. Services tapped before the Tap UID was recorded
+// fall back to the ServiceRedirected condition of the Tap.
+func ownsService(tap *TapResource, svc *v1.Service) bool {
+	if audit, ok := tapAuditFromAnnotations(svc.Annotations); ok && audit.TapUID != "" {
+		return audit.TapUID == string(tap.UID)
+	}
+	return meta.IsStatusConditionTrue(tap.Status.Conditions, conditionServiceRedirected)
+}
+
+// untap removes the tap of a Tap's Service, unless it was made for another Tap or by
+// hand. A Service or Deployment that is already gone is not an error, so that deleting a
+// Tap never gets stuck on its finalizer.
+func (c *tapController) untap(tap *TapResource) error {
+	servicesClient := c.client.CoreV1().Services(tap.Namespace)
+	svc, err := servicesClient.Get(context.TODO(), tap.Spec.Service, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if svc.Annotations[annotationOriginalTargetPort] == "" || !ownsService(tap, svc) {
+		return nil
+	}
+	var dpl *k8sappsv1.Deployment
+	if d, err := deploymentFromSelectors(c.client.AppsV1().Deployments(tap.Namespace), svc.Spec.Selector); err == nil {
+		dpl = &d
+	}
+	err = untapService(c.client, tap.Namespace, tap.Spec.Service)
+	if errors.Is(err, ErrServiceSelectorNoMatch) {
+		err = untapSvc(servicesClient, tap.Spec.Service)
+	}
+	if err != nil {
+		return err
+	}
+	audit := newTapAudit(controllerUser)
+	audit.Command = "Tap " + tap.Namespace + "/" + tap.Name
+	recordTapEvents(c.client, c.log, svc, dpl, eventReasonUntapped, untapMessage(svc, audit), audit)
+	fmt.Fprintf(c.log, "Untapped Service %s/%s\n", tap.Namespace, tap.Spec.Service)
+	return nil
+}
+
+func (c *tapController) update(ctx context.Context, tap *TapResource) (*TapResource, error) {
+	u, err := tap.toUnstructured()
+	if err != nil {
+		return nil, err
+	}
+	u, err = c.dynamic.Resource(tapGVR).Namespace(tap.Namespace).Update(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return tapResourceFromUnstructured(u)
+}
+
+func (c *tapController) updateStatus(ctx context.Context, tap *TapResource) error {
+	u, err := tap.toUnstructured()
+	if err != nil {
+		return err
+	}
+	_, err = c.dynamic.Resource(tapGVR).Namespace(tap.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// validate checks what the CustomResourceDefinition schema cannot.
+func (s TapSpec) validate() error {
+	if s.Service == "" {
+		return fmt.Errorf("%w: spec.service is required", ErrTapSpecInvalid)
+	}
+	if len(s.Ports) != 1 {
+		return fmt.Errorf("%w: exactly one port is currently supported, got %d", ErrTapSpecInvalid, len(s.Ports))
+	}
+	switch s.Protocol {
+	case protocolHTTP, "":
+	default:
+		return fmt.Errorf("%w: protocol %q is currently not supported", ErrTapSpecInvalid, s.Protocol)
+	}
+	if err := validateMitmproxyOptions(s.Options); err != nil {
+		return fmt.Errorf("%w: %v", ErrTapSpecInvalid, err)
+	}
+	if _, err := headerRulesFromFlags(s.SetHeaders); err != nil {
+		return fmt.Errorf("%w: %v", ErrTapSpecInvalid, err)
+	}
+	if _, err := bodyRulesFromFlags(s.ReplaceBody); err != nil {
+		return fmt.Errorf("%w: %v", ErrTapSpecInvalid, err)
+	}
+	if _, err := redactPatternsFromFlags(s.Redact); err != nil {
+		return fmt.Errorf("%w: %v", ErrTapSpecInvalid, err)
+	}
+	return nil
+}
+
+func (t *TapResource) toUnstructured() (*unstructured.Unstructured, error) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(t)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+func tapResourceFromUnstructured(u *unstructured.Unstructured) (*TapResource, error) {
+	var tap TapResource
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &tap); err != nil {
+		return nil, fmt.Errorf("error decoding Tap %q: %w", u.GetName(), err)
+	}
+	return &tap, nil
+}
+
+// applyTapCRD creates or updates the Tap CustomResourceDefinition.
+func applyTapCRD(dynamicClient dynamic.Interface) error {
+	crd := &unstructured.Unstructured{}
+	if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(tapCRD), len(tapCRD)).Decode(&crd.Object); err != nil {
+		return fmt.Errorf("error decoding Tap CustomResourceDefinition: %w", err)
+	}
+	crdClient := dynamicClient.Resource(crdGVR)
+	return createOrUpdate("CustomResourceDefinition", func() error {
+		_, err := crdClient.Create(context.TODO(), crd, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		existing, err := crdClient.Get(context.TODO(), crd.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		crd.SetResourceVersion(existing.GetResourceVersion())
+		_, err = crdClient.Update(context.TODO(), crd, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// controllerRules are the permissions the controller needs to tap and untap Services.
+func controllerRules() []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{APIGroups: []string{tapGVR.Group}, Resources: []string{"taps"}, Verbs: []string{"get", "list", "watch", "update", "delete"}},
+		{APIGroups: []string{tapGVR.Group}, Resources: []string{"taps/status"}, Verbs: []string{"update"}},
+		{APIGroups: []string{""}, Resources: []string{"services"}, Verbs: []string{"get", "list", "update"}},
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "list", "create", "update", "delete"}},
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "create", "update", "delete"}},
+		{APIGroups: []string{""}, Resources: []string{"namespaces", "pods"}, Verbs: []string{"get", "list"}},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"get", "list", "update"}},
+		{APIGroups: []string{"authorization.k8s.io"}, Resources: []string{"selfsubjectaccessreviews"}, Verbs: []string{"create"}},
+	}
+}
+
+// controllerDeployment runs "kubectl tap controller".
+func controllerDeployment(meta metav1.ObjectMeta, image, proxyImage, commandArgs string) *k8sappsv1.Deployment {
+	replicas := int32(1)
+	return &k8sappsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: k8sappsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: meta.Labels},
+			// never run two controllers at once
+			Strategy: k8sappsv1.DeploymentStrategy{Type: k8sappsv1.RecreateDeploymentStrategyType},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: meta.Labels},
+				Spec: v1.PodSpec{
+					ServiceAccountName: kubetapControllerName,
+					Containers: []v1.Container{
+						{
+							Name:  kubetapControllerName,
+							Image: image,
+							Args: []string{
+								"controller",
+								"--proxy-image", proxyImage,
+								"--command-args", commandArgs,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	var out []string
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
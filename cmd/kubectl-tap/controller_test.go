@@ -0,0 +1,385 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ReconcileTap(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Tap        func() *TapResource
+		Redirected metav1.ConditionStatus
+		Reason     string
+	}{
+		{"simple", fakeClientUntappedSimple, sampleTap, metav1.ConditionTrue, "Tapped"},
+		{"already_tapped", fakeClientTappedSimple, sampleTap, metav1.ConditionFalse, "AlreadyTapped"},
+		{"missing_service", fakeClientUntappedSimple, func() *TapResource {
+			tap := sampleTap()
+			tap.Spec.Service = "missing-service"
+			return tap
+		}, metav1.ConditionFalse, "ServiceNotFound"},
+		{"multiple_ports", fakeClientUntappedSimple, func() *TapResource {
+			tap := sampleTap()
+			tap.Spec.Ports = []int32{80, 443}
+			return tap
+		}, metav1.ConditionFalse, "InvalidSpec"},
+		{"reserved_option", fakeClientUntappedSimple, func() *TapResource {
+			tap := sampleTap()
+			tap.Spec.Options = map[string]interface{}{"listen_port": int64(8080)}
+			return tap
+		}, metav1.ConditionFalse, "InvalidSpec"},
+		{"missing_port", fakeClientUntappedSimple, func() *TapResource {
+			tap := sampleTap()
+			tap.Spec.Ports = []int32{9999}
+			return tap
+		}, metav1.ConditionFalse, "TapFailed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			c, dynamicClient := fakeTapController(t, tc.ClientFunc(), tc.Tap())
+			requeue, err := c.reconcile(context.TODO(), "default", "sample-service")
+			require.Nil(err)
+			require.Equal(controllerRequeuePeriod, requeue, "the sidecar is never ready without Pods")
+
+			tap := getTap(t, dynamicClient)
+			require.Contains(tap.Finalizers, tapFinalizer)
+			cond := meta.FindStatusCondition(tap.Status.Conditions, conditionServiceRedirected)
+			require.NotNil(cond)
+			require.Equal(tc.Redirected, cond.Status)
+			require.Equal(tc.Reason, cond.Reason)
+			require.False(meta.IsStatusConditionTrue(tap.Status.Conditions, conditionSidecarReady))
+
+			svc, err := c.client.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			if tc.Redirected == metav1.ConditionTrue {
+				require.Equal("sample-deployment", tap.Status.Deployment)
+				require.NotEmpty(svc.Annotations[annotationOriginalTargetPort])
+				cm, err := c.client.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+				require.Nil(err)
+				require.Contains(string(cm.BinaryData[mitmproxyConfigFile]), "view_filter: (~d example.com)\n")
+			}
+		})
+	}
+}
+
+func Test_ReconcileTapDeletion(t *testing.T) {
+	require := require.New(t)
+	c, dynamicClient := fakeTapController(t, fakeClientUntappedSimple(), sampleTap())
+	_, err := c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	svc, err := c.client.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotEmpty(svc.Annotations[annotationOriginalTargetPort])
+
+	// the fake client does not implement finalizers, so mark the Tap as deleted by hand
+	tap := getTap(t, dynamicClient)
+	now := metav1.Now()
+	tap.DeletionTimestamp = &now
+	_, err = c.update(context.TODO(), tap)
+	require.Nil(err)
+
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	tap = getTap(t, dynamicClient)
+	require.NotContains(tap.Finalizers, tapFinalizer)
+	svc, err = c.client.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(err)
+	require.Empty(svc.Annotations[annotationOriginalTargetPort])
+	dpl, err := c.client.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Len(dpl.Spec.Template.Spec.Containers, 1)
+}
+
+func Test_ReconcileTapOwnership(t *testing.T) {
+	require := require.New(t)
+	client := fakeClientUntappedSimple()
+	c, dynamicClient := fakeTapController(t, client, sampleTap())
+	_, err := c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+
+	// a lost status update leaves the Tap without the ServiceRedirected condition
+	tap := getTap(t, dynamicClient)
+	tap.Status = TapStatus{}
+	require.Nil(c.updateStatus(context.TODO(), tap))
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	tap = getTap(t, dynamicClient)
+	cond := meta.FindStatusCondition(tap.Status.Conditions, conditionServiceRedirected)
+	require.NotNil(cond)
+	require.Equal("Tapped", cond.Reason)
+
+	// another Tap of the same Service neither takes over nor removes the tap
+	other := sampleTap()
+	other.UID = "other-tap-uid"
+	now := metav1.Now()
+	other.DeletionTimestamp = &now
+	other.Finalizers = []string{tapFinalizer}
+	other.Status.Conditions = tap.Status.Conditions
+	require.False(ownsService(other, getService(t, client, "sample-service")))
+	require.Nil(c.untap(other))
+	require.NotEmpty(getService(t, client, "sample-service").Annotations[annotationOriginalTargetPort])
+
+	// deleting the Tap untaps the Service even without the condition
+	tap.Status = TapStatus{}
+	require.Nil(c.updateStatus(context.TODO(), tap))
+	tap = getTap(t, dynamicClient)
+	tap.DeletionTimestamp = &now
+	_, err = c.update(context.TODO(), tap)
+	require.Nil(err)
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	require.Empty(getService(t, client, "sample-service").Annotations[annotationOriginalTargetPort])
+}
+
+func Test_ReconcileTapSpecChange(t *testing.T) {
+	require := require.New(t)
+	client := fakeClientSelector()
+	c, dynamicClient := fakeTapController(t, client, sampleTap())
+	_, err := c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	sidecar := func() v1.Container {
+		for _, container := range getDeployment(t, client).Spec.Template.Spec.Containers {
+			if container.Name == kubetapContainerName {
+				return container
+			}
+		}
+		t.Fatal("the Deployment has no sidecar")
+		return v1.Container{}
+	}
+	restartedAt := func() string {
+		return getDeployment(t, client).Spec.Template.Annotations[annotationRestartedAt]
+	}
+
+	// an unchanged spec leaves the proxy alone
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	require.Empty(restartedAt())
+
+	// changed options are written to the ConfigMap and restart the proxy
+	tap := getTap(t, dynamicClient)
+	tap.Spec.Filters = []string{"~d example.org"}
+	_, err = c.update(context.TODO(), tap)
+	require.Nil(err)
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Contains(string(cm.BinaryData[mitmproxyConfigFile]), "view_filter: (~d example.org)\n")
+	require.NotEmpty(restartedAt())
+
+	// a changed image rolls the sidecar
+	tap = getTap(t, dynamicClient)
+	tap.Spec.Image = "example.com/mitmproxy:custom"
+	_, err = c.update(context.TODO(), tap)
+	require.Nil(err)
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	require.Equal("example.com/mitmproxy:custom", sidecar().Image)
+
+	// a changed port taps the Service again
+	tap = getTap(t, dynamicClient)
+	tap.Spec.Ports = []int32{443}
+	_, err = c.update(context.TODO(), tap)
+	require.Nil(err)
+	_, err = c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	for _, sp := range getService(t, client, "sample-service").Spec.Ports {
+		require.Equal(sp.Port == 443, sp.TargetPort.IntValue() == kubetapProxyListenPort, "port %d", sp.Port)
+	}
+	require.True(ownsService(getTap(t, dynamicClient), getService(t, client, "sample-service")))
+	cond := meta.FindStatusCondition(getTap(t, dynamicClient).Status.Conditions, conditionServiceRedirected)
+	require.NotNil(cond)
+	require.Equal("Tapped", cond.Reason)
+	require.Equal("example.com/mitmproxy:custom", sidecar().Image)
+}
+
+func Test_ControllerRules(t *testing.T) {
+	require := require.New(t)
+	client := fakeClientSelector()
+	service := sampleTap()
+	admin := sampleTap()
+	admin.Name, admin.UID = "sample-admin", "sample-admin-uid"
+	admin.Spec.Service, admin.Spec.Ports = "sample-admin", []int32{9090}
+	var objects []runtime.Object
+	for _, tap := range []*TapResource{service, admin} {
+		u, err := tap.toUnstructured()
+		require.Nil(err)
+		objects = append(objects, u)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	c := newTapController(client, dynamicClient, "", nil, ioutil.Discard)
+
+	// both Services share the proxy of sample-deployment, which is extended and then
+	// shrunk before it is removed
+	for _, name := range []string{"sample-service", "sample-admin", "sample-service", "sample-admin"} {
+		u, err := dynamicClient.Resource(tapGVR).Namespace("default").Get(context.TODO(), name, metav1.GetOptions{})
+		require.Nil(err)
+		tap, err := tapResourceFromUnstructured(u)
+		require.Nil(err)
+		if meta.IsStatusConditionTrue(tap.Status.Conditions, conditionServiceRedirected) {
+			now := metav1.Now()
+			tap.DeletionTimestamp = &now
+			_, err = c.update(context.TODO(), tap)
+			require.Nil(err)
+		}
+		_, err = c.reconcile(context.TODO(), "default", name)
+		require.Nil(err)
+		if name == "sample-admin" && tap.DeletionTimestamp == nil {
+			require.ElementsMatch([]string{"sample-admin", "sample-service"}, tappedServices(client, "default", "sample-deployment"))
+		}
+	}
+	require.False(hasSidecar(getDeployment(t, client)))
+
+	allowed := func(group, resource, verb string) bool {
+		for _, rule := range controllerRules() {
+			if containsString(rule.APIGroups, group) && containsString(rule.Resources, resource) && containsString(rule.Verbs, verb) {
+				return true
+			}
+		}
+		return false
+	}
+	actions := append(client.Actions(), dynamicClient.Actions()...)
+	for _, action := range actions {
+		resource := action.GetResource().Resource
+		if action.GetSubresource() != "" {
+			resource += "/" + action.GetSubresource()
+		}
+		require.True(allowed(action.GetResource().Group, resource, action.GetVerb()), "the controller cannot %s %s", action.GetVerb(), resource)
+	}
+}
+
+func Test_ReconcileTapTTL(t *testing.T) {
+	require := require.New(t)
+	tap := sampleTap()
+	tap.CreationTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	tap.Spec.TTL = &metav1.Duration{Duration: time.Hour}
+	c, dynamicClient := fakeTapController(t, fakeClientUntappedSimple(), tap)
+	_, err := c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	_, err = dynamicClient.Resource(tapGVR).Namespace("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.NotNil(err, "expired Tap was not deleted")
+
+	tap = sampleTap()
+	tap.CreationTimestamp = metav1.Now()
+	tap.Spec.TTL = &metav1.Duration{Duration: time.Second}
+	c, _ = fakeTapController(t, fakeClientUntappedSimple(), tap)
+	requeue, err := c.reconcile(context.TODO(), "default", "sample-service")
+	require.Nil(err)
+	require.True(requeue > 0 && requeue <= time.Second, "expected a requeue before the TTL, got %s", requeue)
+}
+
+func Test_NewCreateTapCommand(t *testing.T) {
+	require := require.New(t)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("proxyImage", defaultImageHTTP)
+	testViper.Set("https", true)
+	testViper.Set("user", "alice")
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Nil(NewCreateTapCommand(fakeClient, dynamicClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Contains(b.String(), "Created Tap \"sample-service\"")
+	require.Contains(b.String(), "kubectl port-forward deploy/sample-deployment -n default 2244:2244")
+	require.Contains(b.String(), "kubectl get secret kubetap-web-sample-deployment -n default")
+
+	tap := getTap(t, dynamicClient)
+	require.Equal("sample-service", tap.Spec.Service)
+	require.Equal([]int32{80}, tap.Spec.Ports)
+	require.True(tap.Spec.HTTPS)
+	require.Empty(tap.Spec.Image)
+	audit, ok := tapAuditFromAnnotations(tap.Annotations)
+	require.True(ok)
+	require.Equal("alice", audit.User)
+
+	err := NewCreateTapCommand(fakeClient, dynamicClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrServiceTapped))
+
+	require.Nil(NewDeleteTapCommand(fakeClient, dynamicClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	_, err = dynamicClient.Resource(tapGVR).Namespace("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.NotNil(err)
+
+	// the password of a proxy that is already running is printed
+	_, err = fakeClient.CoreV1().Secrets("default").Create(context.TODO(), &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: kubetapWebSecretPrefix + "sample-deployment", Namespace: "default"},
+		Data:       map[string][]byte{webPasswordKey: []byte("s3cret")},
+	}, metav1.CreateOptions{})
+	require.Nil(err)
+	b.Reset()
+	require.Nil(NewCreateTapCommand(fakeClient, dynamicClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Contains(b.String(), "The web interface password is s3cret")
+}
+
+func Test_NewDeleteTapCommandFallback(t *testing.T) {
+	require := require.New(t)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Nil(NewDeleteTapCommand(fakeClientTappedSimple(), dynamicClient, &rest.Config{}, viper.New())(cmd, []string{"sample-service"}))
+	require.Contains(b.String(), "Untapped Service \"sample-service\"")
+}
+
+func sampleTap() *TapResource {
+	return &TapResource{
+		TypeMeta: metav1.TypeMeta{APIVersion: tapGVR.GroupVersion().String(), Kind: "Tap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample-service",
+			Namespace: "default",
+			UID:       "sample-tap-uid",
+		},
+		Spec: TapSpec{
+			Service: "sample-service",
+			Ports:   []int32{80},
+			Filters: []string{"~d example.com"},
+		},
+	}
+}
+
+func fakeTapController(t *testing.T, client *fake.Clientset, tap *TapResource) (*tapController, *dynamicfake.FakeDynamicClient) {
+	u, err := tap.toUnstructured()
+	require.Nil(t, err)
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), u)
+	return newTapController(client, dynamicClient, "", nil, ioutil.Discard), dynamicClient
+}
+
+func getTap(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient) *TapResource {
+	u, err := dynamicClient.Resource(tapGVR).Namespace("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+	require.Nil(t, err)
+	tap, err := tapResourceFromUnstructured(u)
+	require.Nil(t, err)
+	return tap
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var ErrFaultRuleInvalid = errors.New("invalid fault rule")
+
+// FaultRule injects a fault into a share of the requests to a tapped Service.
+type FaultRule struct {
+	// Path is a glob matched against the request path with Python's fnmatch.fnmatchcase,
+	// where * also matches /, and all paths match if it is empty
+	Path string `json:"path,omitempty"`
+	// Percent of the matching requests to inject the fault into
+	Percent float64 `json:"percent"`
+	// DelayMS delays the request before it is forwarded, in milliseconds
+	DelayMS int64 `json:"delay_ms,omitempty"`
+	// Status responds with this status code instead of forwarding the request
+	Status int `json:"status,omitempty"`
+	// Reset closes the client connection instead of forwarding the request
+	Reset bool `json:"reset,omitempty"`
+}
+
+// validate ensures that the rule injects a fault the addon can enforce.
+func (r FaultRule) validate() error {
+	if r.DelayMS == 0 && r.Status == 0 && !r.Reset {
+		return fmt.Errorf("%w: one of --delay, --status or --reset-connection must be set", ErrFaultRuleInvalid)
+	}
+	if r.DelayMS < 0 {
+		return fmt.Errorf("%w: the delay cannot be negative", ErrFaultRuleInvalid)
+	}
+	if r.Status != 0 && (r.Status < 100 || r.Status > 599) {
+		return fmt.Errorf("%w: %d is not an HTTP status code", ErrFaultRuleInvalid, r.Status)
+	}
+	if r.Status != 0 && r.Reset {
+		return fmt.Errorf("%w: --status and --reset-connection cannot be combined", ErrFaultRuleInvalid)
+	}
+	if r.Percent <= 0 || r.Percent > 100 {
+		return fmt.Errorf("%w: the percentage must be greater than 0 and at most 100", ErrFaultRuleInvalid)
+	}
+	// the addon matches with fnmatch, which accepts any pattern, so only a pattern that
+	// can never match a request path is rejected
+	if r.Path != "" && !strings.ContainsAny(r.Path[:1], "/*?[") {
+		return fmt.Errorf("%w: path %q never matches, request paths start with /", ErrFaultRuleInvalid, r.Path)
+	}
+	return nil
+}
+
+// String describes the rule for humans.
+func (r FaultRule) String() string {
+	var faults []string
+	if r.DelayMS > 0 {
+		faults = append(faults, "delay "+(time.Duration(r.DelayMS)*time.Millisecond).String())
+	}
+	if r.Status > 0 {
+		faults = append(faults, fmt.Sprintf("respond %d", r.Status))
+	}
+	if r.Reset {
+		faults = append(faults, "reset connection")
+	}
+	return strings.Join(faults, ", ")
+}
+
+// NewFaultCommand adds, lists or clears the fault rules of a tapped Service. The rules
+// are enforced by the bundled mitmproxy addon, which picks up changes without
+// restarting the proxy.
+func NewFaultCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		// the addon sleeps for whole milliseconds, so a shorter delay would be lost
+		delay := viper.GetDuration("faultDelay")
+		if delay > 0 && delay < time.Millisecond {
+			return fmt.Errorf("%w: the delay must be at least 1ms", ErrFaultRuleInvalid)
+		}
+		if delay < 0 {
+			return fmt.Errorf("%w: the delay cannot be negative", ErrFaultRuleInvalid)
+		}
+		rule := FaultRule{
+			Path:    viper.GetString("faultPath"),
+			Percent: viper.GetFloat64("faultPercent"),
+			DelayMS: delay.Milliseconds(),
+			Status:  viper.GetInt("faultStatus"),
+			Reset:   viper.GetBool("faultReset"),
+		}
+		addRule := rule.DelayMS != 0 || rule.Status != 0 || rule.Reset
+		clearRules := viper.GetBool("faultClear")
+		if addRule {
+			if clearRules {
+				return fmt.Errorf("%w: --clear cannot be combined with a new rule", ErrFaultRuleInvalid)
+			}
+			if err := rule.validate(); err != nil {
+				return err
+			}
+		}
+
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if targetService.Annotations[annotationOriginalTargetPort] == "" {
+			return ErrServiceNotTapped
+		}
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+		if proxyOpts.Protocol != "" && proxyOpts.Protocol != protocolHTTP {
+			return fmt.Errorf("fault injection is only supported for %s taps", protocolHTTP)
+		}
+
+		switch {
+		case addRule:
+			proxyOpts.Faults = append(proxyOpts.Faults, rule)
+		case clearRules:
+			proxyOpts.Faults = nil
+		default:
+			printFaultRules(cmd, targetSvcName, proxyOpts.Faults)
+			return nil
+		}
+
+		update, err := NewMitmproxy(client, proxyOpts).UpdateEnv()
+		if err != nil {
+			return err
+		}
+		if err := applyTapUpdate(cmd, client, config, namespace, dpl.Name, update); err != nil {
+			return err
+		}
+		if clearRules {
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed all fault rules from Service %q.\n", targetSvcName)
+			return nil
+		}
+		printFaultRules(cmd, targetSvcName, proxyOpts.Faults)
+		return nil
+	}
+}
+
+// printFaultRules lists fault rules in the order the addon applies them.
+func printFaultRules(cmd *cobra.Command, targetSvcName string, rules []FaultRule) {
+	if len(rules) == 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "Service %q has no fault rules.\n", targetSvcName)
+		return
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Fault rules of Service %q:\n\n", targetSvcName)
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tPERCENT\tFAULT")
+	for _, r := range rules {
+		p := r.Path
+		if p == "" {
+			p = "*"
+		}
+		fmt.Fprintf(w, "%s\t%g%%\t%s\n", p, r.Percent, r)
+	}
+	w.Flush()
+	fmt.Fprintf(cmd.OutOrStdout(), "\nChanges reach the proxy once the ConfigMap update reaches the Pod, usually within a minute.\n")
+}
+
+// mitmproxyFaultsAddonSource enforces the rules in mitmproxyFaultsFile, in order.
+const mitmproxyFaultsAddonSource = `# Managed by kubetap, changes are overwritten.
+import asyncio
+import fnmatch
+import logging
+import random
+
+from mitmproxy import http
+
+from ` + mitmproxyAddonModule + ` import ConfigFile
+
+
+class KubetapFaults:
+    def __init__(self):
+        self.rules = ConfigFile("` + mitmproxyFaultsFile + `", "fault rules", [])
+
+    async def request(self, flow):
+        if self.rules.load():
+            logging.info("kubetap: loaded %d fault rules", len(self.rules.value))
+        path = flow.request.path.split("?", 1)[0]
+        for rule in self.rules.value:
+            if rule.get("path") and not fnmatch.fnmatchcase(path, rule["path"]):
+                continue
+            if random.uniform(0, 100) >= rule.get("percent", 100):
+                continue
+            if rule.get("delay_ms"):
+                await asyncio.sleep(rule["delay_ms"] / 1000)
+            if rule.get("reset"):
+                flow.kill()
+                return
+            if rule.get("status"):
+                flow.response = http.Response.make(
+                    rule["status"],
+                    b"fault injected by kubetap\n",
+                    {"Content-Type": "text/plain"},
+                )
+                return
+
+
+addons = [KubetapFaults()]
+`
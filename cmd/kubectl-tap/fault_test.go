@@ -0,0 +1,137 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func Test_FaultRuleValidate(t *testing.T) {
+	tests := []struct {
+		Name string
+		Rule FaultRule
+		Err  error
+	}{
+		{"delay", FaultRule{DelayMS: 500, Percent: 20}, nil},
+		{"status", FaultRule{Status: 503, Path: "/api/*", Percent: 100}, nil},
+		{"reset", FaultRule{Reset: true, Percent: 100}, nil},
+		{"delayed_status", FaultRule{DelayMS: 500, Status: 503, Percent: 100}, nil},
+		{"no_fault", FaultRule{Path: "/api/*", Percent: 100}, ErrFaultRuleInvalid},
+		{"invalid_status", FaultRule{Status: 1000, Percent: 100}, ErrFaultRuleInvalid},
+		{"status_and_reset", FaultRule{Status: 503, Reset: true, Percent: 100}, ErrFaultRuleInvalid},
+		{"zero_percent", FaultRule{Reset: true}, ErrFaultRuleInvalid},
+		{"over_100_percent", FaultRule{Reset: true, Percent: 150}, ErrFaultRuleInvalid},
+		{"unclosed_bracket", FaultRule{Reset: true, Percent: 100, Path: "/api/["}, nil},
+		{"relative_path", FaultRule{Reset: true, Percent: 100, Path: "api/*"}, ErrFaultRuleInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Rule.validate()
+			if tc.Err != nil {
+				require.True(t, errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(t, err)
+		})
+	}
+}
+
+func Test_NewFaultCommand(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	tapViper := viper.New()
+	tapViper.Set("proxyPort", 80)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, tapViper)(cmd, []string{"sample-service"}))
+	require.Equal([]FaultRule{}, getConfigMapFile(t, fakeClient, mitmproxyFaultsFile, &[]FaultRule{}))
+
+	b := bytes.NewBufferString("")
+	cmd.SetOutput(b)
+	testViper := viper.New()
+	testViper.Set("faultDelay", 500*time.Millisecond)
+	testViper.Set("faultPercent", 20)
+	require.Nil(NewFaultCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.NotContains(b.String(), "restarting Deployment", "fault rules must not restart the proxy")
+
+	testViper = viper.New()
+	testViper.Set("faultStatus", 503)
+	testViper.Set("faultPath", "/api/*")
+	testViper.Set("faultPercent", 100)
+	require.Nil(NewFaultCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal([]FaultRule{
+		{DelayMS: 500, Percent: 20},
+		{Status: 503, Path: "/api/*", Percent: 100},
+	}, getConfigMapFile(t, fakeClient, mitmproxyFaultsFile, &[]FaultRule{}))
+
+	b.Reset()
+	require.Nil(NewFaultCommand(fakeClient, &rest.Config{}, viper.New())(cmd, []string{"sample-service"}))
+	require.Contains(b.String(), "/api/*  100%     respond 503")
+
+	testViper = viper.New()
+	testViper.Set("faultClear", true)
+	require.Nil(NewFaultCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal([]FaultRule{}, getConfigMapFile(t, fakeClient, mitmproxyFaultsFile, &[]FaultRule{}))
+
+	// a delay shorter than the addon can sleep is not silently dropped
+	testViper = viper.New()
+	testViper.Set("faultDelay", 500*time.Microsecond)
+	testViper.Set("faultPercent", 100)
+	err := NewFaultCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrFaultRuleInvalid), "expected (%q), got (%q)", ErrFaultRuleInvalid, err)
+	require.Equal([]FaultRule{}, getConfigMapFile(t, fakeClient, mitmproxyFaultsFile, &[]FaultRule{}))
+
+	err = NewFaultCommand(fakeClientUntappedSimple(), &rest.Config{}, viper.New())(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrServiceNotTapped), "expected (%q), got (%q)", ErrServiceNotTapped, err)
+}
+
+// Test_FaultPathGlob documents how the addon matches --path, which is what the help and
+// the docs describe.
+func Test_FaultPathGlob(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is not installed")
+	}
+	tests := []struct {
+		Glob    string
+		Path    string
+		Matches bool
+	}{
+		{"/api/*", "/api/v1/users", true},
+		{"/api/*", "/apis", false},
+		{"/api/?", "/api/1", true},
+		{"/api/[!0-9]*", "/api/v1", true},
+		{"/api/[", "/api/[", true},
+		{"*/healthz", "/v1/healthz", true},
+		{"/API/*", "/api/v1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Glob+" "+tc.Path, func(t *testing.T) {
+			out, err := exec.Command("python3", "-c", "import fnmatch, sys; print(str(fnmatch.fnmatchcase(sys.argv[2], sys.argv[1])).lower())", tc.Glob, tc.Path).CombinedOutput()
+			require.Nil(t, err, string(out))
+			require.Equal(t, fmt.Sprint(tc.Matches), strings.TrimSpace(string(out)))
+		})
+	}
+}
@@ -20,8 +20,10 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
@@ -34,11 +36,17 @@ var (
 const (
 	annotationOriginalTargetPort = "kubetap.io/original-port"
 	annotationConfigMap          = "kubetap.io/proxy-config"
+	annotationProxyOptions       = "kubetap.io/proxy-options"
 	annotationIsTapped           = "kubetap.io/tapped"
+	annotationRestartedAt        = "kubetap.io/restarted-at"
+	annotationAudit              = "kubetap.io/audit"
+	labelTap                     = "kubetap.io/tap"
 
 	defaultImageHTTP = "gcr.io/soluble-oss/kubetap-mitmproxy:latest"
 	defaultImageRaw  = "gcr.io/soluble-oss/kubetap-raw:latest"
 	defaultImageGRPC = "gcr.io/soluble-oss/kubetap-grpc:latest"
+
+	defaultImageKubetap = "gcr.io/soluble-oss/kubectl-tap:latest"
 )
 
 // die exit the program, printing the error.
@@ -53,39 +61,156 @@ func main() {
 
 	kubernetesConfigFlags := genericclioptions.NewConfigFlags(false)
 	kubernetesConfigFlags.AddFlags(rootCmd.PersistentFlags())
+	clients := &kubeClients{flags: kubernetesConfigFlags}
 
-	config, err := kubernetesConfigFlags.ToRESTConfig()
-	if err != nil {
-		die(err)
-	}
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		die(err)
-	}
 	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
 		die(err)
 	}
+	rootCmd.PersistentPreRun = func(*cobra.Command, []string) {
+		// like kubectl, default to the namespace of the kubeconfig context, which is only
+		// known once the flags are parsed
+		if namespace, _, err := kubernetesConfigFlags.ToRawKubeConfigLoader().Namespace(); err == nil {
+			viper.Set("namespace", namespace)
+		}
+		// the kubeconfig user names token based users in the audit records of taps
+		if rawConfig, err := kubernetesConfigFlags.ToRawKubeConfigLoader().RawConfig(); err == nil {
+			contextName := rawConfig.CurrentContext
+			if *kubernetesConfigFlags.Context != "" {
+				contextName = *kubernetesConfigFlags.Context
+			}
+			if c, ok := rawConfig.Contexts[contextName]; ok {
+				viper.SetDefault("user", c.AuthInfo)
+			}
+		}
+	}
 
 	versionCmd := NewVersionCmd()
-	onCmd := NewOnCmd(client, config)
-	offCmd := NewOffCmd(client)
-	listCmd := NewListCmd(client)
+	onCmd := NewOnCmd(clients)
+	offCmd := NewOffCmd(clients)
+	updateCmd := NewUpdateCmd(clients)
+	faultCmd := NewFaultCmd(clients)
+	replayCmd := NewReplayCmd(clients)
+	listCmd := NewListCmd(clients)
+	doctorCmd := NewDoctorCmd(clients)
+	installWebhookCmd := NewInstallWebhookCmd(clients)
+	uninstallWebhookCmd := NewUninstallWebhookCmd(clients)
+	webhookCmd := NewWebhookCmd(clients)
+	installControllerCmd := NewInstallControllerCmd(clients)
+	uninstallControllerCmd := NewUninstallControllerCmd(clients)
+	controllerCmd := NewControllerCmd(clients)
+	caCmd := NewCACmd()
+	caExportCmd := NewCAExportCmd(clients)
+	completionCmd := NewCompletionCmd()
 
 	onCmd.Flags().StringP("port", "p", "", "target Service port")
+	onCmd.Flags().StringP("selector", "l", "", "tap the Services matching this label selector instead of a named Service")
+	onCmd.Flags().Bool("all-ports", false, "tap all TCP ports of the Services instead of --port")
+	onCmd.Flags().StringArray("target", []string{}, "tap a Service in another kubeconfig context, as CONTEXT=[NAMESPACE/]SERVICE, can be repeated to tap several clusters at once")
 	onCmd.Flags().StringP("image", "i", defaultImageHTTP, "image to run in proxy container")
 	onCmd.Flags().Bool("https", false, "enable if target listener uses HTTPS")
 	onCmd.Flags().String("command-args", "mitmweb", "specify command arguments for the proxy sidecar container")
 	onCmd.Flags().Bool("port-forward", false, "enable to automatically kubctl port-forward to services")
 	onCmd.Flags().Bool("browser", false, "enable to open browser windows to service and proxy. Also enables --port-forward")
 	onCmd.Flags().String("protocol", "http", "specify a protocol. Supported protocols: [ http ]")
+	onCmd.Flags().StringArray("proxy-set", []string{}, "set a mitmproxy option as key=value, can be repeated")
+	onCmd.Flags().String("proxy-config", "", "YAML file of additional mitmproxy options, overridden by --proxy-set")
+	onCmd.Flags().StringArray("script", []string{}, "mitmproxy addon script to load in the proxy, can be repeated")
+	onCmd.Flags().StringArray("set-header", []string{}, "set a request header as NAME=VALUE, or a mitmproxy modify_headers rule, can be repeated")
+	onCmd.Flags().StringArray("replace-body", []string{}, "mitmproxy modify_body rule of the form [/filter]/regex/replacement, can be repeated")
+	onCmd.Flags().StringArray("map-local", []string{}, "serve a local file for URLs matching a regex, as URL_REGEX=FILE, can be repeated")
+	onCmd.Flags().String("mirror-to", "", "duplicate requests to a second backend, as svc.namespace:port, discarding its responses")
+	onCmd.Flags().StringArray("redact", []string{}, "regex to redact from captured flows, in addition to auth headers, cookies and tokens, can be repeated")
+	onCmd.Flags().Bool("redact-defaults", true, "redact auth headers, cookie values, JWTs and tokens from captured flows")
+	onCmd.Flags().Bool("expose-web", false, "also add the proxy web interface port to the Service, by default it is only reachable by port-forwarding to the Pod")
+	onCmd.Flags().Duration("timeout", defaultReadyTimeout, "how long to wait for the tapped Pod to become ready when port-forwarding")
+	onCmd.Flags().String("ca-secret", "", "kubernetes.io/tls Secret holding the proxy CA, defaults to "+defaultCASecretName+" if it exists")
+	onCmd.Flags().String("ca-cert", "", "PEM encoded proxy CA certificate to store in the CA Secret, requires --ca-key")
+	onCmd.Flags().String("ca-key", "", "PEM encoded proxy CA private key to store in the CA Secret, requires --ca-cert")
+	onCmd.Flags().Bool("ca-replace", false, "replace a different CA already stored in the CA Secret with --ca-cert and --ca-key")
+	onCmd.Flags().String("tls-secret", "", "kubernetes.io/tls Secret with the certificate the proxy presents to clients")
+	onCmd.Flags().Bool("upstream-insecure", false, "do not verify the certificate of the target when using --https")
+	onCmd.Flags().String("upstream-client-cert-secret", "", "kubernetes.io/tls Secret with the client certificate the proxy presents to the target")
+	onCmd.Flags().String("upstream-ca-secret", "", "Secret with a ca.crt bundle to verify the certificate of the target against")
+
+	offCmd.Flags().StringP("selector", "l", "", "untap the tapped Services matching this label selector instead of a named Service")
+	offCmd.Flags().Bool("all", false, "untap all tapped Services in the namespace")
+
+	updateCmd.Flags().StringP("image", "i", defaultImageHTTP, "image to run in proxy container")
+	updateCmd.Flags().Bool("https", false, "enable if target listener uses HTTPS")
+	updateCmd.Flags().String("command-args", "mitmweb", "specify command arguments for the proxy sidecar container")
+	updateCmd.Flags().StringArray("proxy-set", []string{}, "set a mitmproxy option as key=value, can be repeated")
+	updateCmd.Flags().String("proxy-config", "", "YAML file of additional mitmproxy options, overridden by --proxy-set")
+	updateCmd.Flags().StringArray("script", []string{}, "mitmproxy addon script to add or replace, can be repeated")
+	updateCmd.Flags().StringArray("set-header", []string{}, "set a request header as NAME=VALUE, or a mitmproxy modify_headers rule, replaces the current rules, can be repeated")
+	updateCmd.Flags().StringArray("replace-body", []string{}, "mitmproxy modify_body rule of the form [/filter]/regex/replacement, replaces the current rules, can be repeated")
+	updateCmd.Flags().StringArray("map-local", []string{}, "serve a local file for URLs matching a regex, as URL_REGEX=FILE, replaces the current rules, can be repeated")
+	updateCmd.Flags().Bool("clear-rewrites", false, "remove all --set-header, --replace-body and --map-local rules")
+	updateCmd.Flags().String("mirror-to", "", "duplicate requests to a second backend, as svc.namespace:port, an empty value stops mirroring")
+	updateCmd.Flags().StringArray("redact", []string{}, "regex to redact from captured flows, replaces the current patterns, an empty value removes them, can be repeated")
+	updateCmd.Flags().Bool("redact-defaults", true, "redact auth headers, cookie values, JWTs and tokens from captured flows")
+
+	faultCmd.Flags().Duration("delay", 0, "delay matching requests by this long before forwarding them")
+	faultCmd.Flags().Int("status", 0, "respond to matching requests with this status code instead of forwarding them")
+	faultCmd.Flags().Bool("reset-connection", false, "close the connection of matching requests instead of forwarding them")
+	faultCmd.Flags().String("path", "", "only inject the fault into requests with a path matching this shell-style glob, where * also matches /")
+	faultCmd.Flags().Float64("percent", 100, "percentage of matching requests to inject the fault into")
+	faultCmd.Flags().Bool("clear", false, "remove all fault rules")
+
+	replayCmd.Flags().String("from", "", "file of flows recorded with mitmproxy, such as those saved from mitmweb")
+	replayCmd.Flags().String("mode", replayModeClient, "client replays the requests against the tapped container, server serves the recorded responses to clients")
+	replayCmd.Flags().Bool("stop", false, "stop serving recorded responses")
+
+	doctorCmd.Flags().StringP("port", "p", "", "target Service port to check")
+
+	installWebhookCmd.Flags().String("image", defaultImageKubetap, "image to run the webhook server")
+	installWebhookCmd.Flags().String("proxy-image", defaultImageHTTP, "image to inject as the proxy sidecar of taps that did not record one")
+	installWebhookCmd.Flags().String("command-args", "mitmweb", "specify command arguments for the proxy sidecar container")
 
-	rootCmd.AddCommand(versionCmd, onCmd, offCmd, listCmd)
+	webhookCmd.Flags().String("listen", fmt.Sprintf(":%d", webhookListenPort), "address to serve the webhook on")
+	webhookCmd.Flags().String("tls-cert-file", "", "file containing the webhook serving certificate")
+	webhookCmd.Flags().String("tls-key-file", "", "file containing the webhook serving key")
+	webhookCmd.Flags().String("proxy-image", defaultImageHTTP, "image to inject as the proxy sidecar of taps that did not record one")
+	webhookCmd.Flags().String("command-args", "mitmweb", "command arguments of the proxy sidecar of taps that did not record them")
+
+	installControllerCmd.Flags().String("image", defaultImageKubetap, "image to run the controller")
+	installControllerCmd.Flags().String("proxy-image", defaultImageHTTP, "default image for the proxy sidecar of Taps")
+	installControllerCmd.Flags().String("command-args", "mitmweb", "specify command arguments for the proxy sidecar container")
+
+	controllerCmd.Flags().String("proxy-image", defaultImageHTTP, "default image for the proxy sidecar of Taps")
+	controllerCmd.Flags().String("command-args", "mitmweb", "specify command arguments for the proxy sidecar container")
+
+	listCmd.Flags().BoolP("all-namespaces", "A", false, "list the tapped Services in all namespaces")
+
+	caExportCmd.Flags().StringP("output", "o", "", "file to write the CA certificate to, defaults to stdout")
+	caCmd.AddCommand(caExportCmd)
+
+	for _, cmd := range []*cobra.Command{onCmd, doctorCmd} {
+		if err := cmd.RegisterFlagCompletionFunc("port", clients.completePorts); err != nil {
+			die(err)
+		}
+	}
+
+	rootCmd.AddCommand(versionCmd, onCmd, offCmd, updateCmd, faultCmd, replayCmd, listCmd, doctorCmd, installWebhookCmd, uninstallWebhookCmd, webhookCmd,
+		installControllerCmd, uninstallControllerCmd, controllerCmd, caCmd, completionCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		exiter.Exit(1)
 	}
 }
 
+// bindUntapFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindUntapFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("selector", cmd.Flags().Lookup("selector")); err != nil {
+		return err
+	}
+	return viper.BindPFlag("all", cmd.Flags().Lookup("all"))
+}
+
+// bindListFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindListFlags(cmd *cobra.Command, _ []string) error {
+	return viper.BindPFlag("allNamespaces", cmd.Flags().Lookup("all-namespaces"))
+}
+
 // bindTapFlags is a workaround for https://github.com/spf13/viper/issues/233
 func bindTapFlags(cmd *cobra.Command, _ []string) error {
 	if err := viper.BindPFlag("proxyPort", cmd.Flags().Lookup("port")); err != nil {
@@ -109,6 +234,213 @@ func bindTapFlags(cmd *cobra.Command, _ []string) error {
 	if err := viper.BindPFlag("protocol", cmd.Flags().Lookup("protocol")); err != nil {
 		return err
 	}
+	if err := viper.BindPFlag("timeout", cmd.Flags().Lookup("timeout")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("selector", cmd.Flags().Lookup("selector")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("allPorts", cmd.Flags().Lookup("all-ports")); err != nil {
+		return err
+	}
+	// viper reads stringArray flags back as a single string, so set the values directly
+	proxySet, err := cmd.Flags().GetStringArray("proxy-set")
+	if err != nil {
+		return err
+	}
+	viper.Set("proxySet", proxySet)
+	scripts, err := cmd.Flags().GetStringArray("script")
+	if err != nil {
+		return err
+	}
+	viper.Set("scripts", scripts)
+	for key, flag := range map[string]string{"setHeaders": "set-header", "replaceBody": "replace-body", "mapLocal": "map-local", "redact": "redact", "targets": "target"} {
+		rules, err := cmd.Flags().GetStringArray(flag)
+		if err != nil {
+			return err
+		}
+		viper.Set(key, rules)
+	}
+	if err := viper.BindPFlag("proxyConfig", cmd.Flags().Lookup("proxy-config")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("caSecret", cmd.Flags().Lookup("ca-secret")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("caCert", cmd.Flags().Lookup("ca-cert")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("caKey", cmd.Flags().Lookup("ca-key")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("caReplace", cmd.Flags().Lookup("ca-replace")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("tlsSecret", cmd.Flags().Lookup("tls-secret")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("upstreamInsecure", cmd.Flags().Lookup("upstream-insecure")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("upstreamClientCertSecret", cmd.Flags().Lookup("upstream-client-cert-secret")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("upstreamCASecret", cmd.Flags().Lookup("upstream-ca-secret")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("mirrorTo", cmd.Flags().Lookup("mirror-to")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("exposeWeb", cmd.Flags().Lookup("expose-web")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("redactDefaults", cmd.Flags().Lookup("redact-defaults")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindUpdateFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindUpdateFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("proxyImage", cmd.Flags().Lookup("image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("https", cmd.Flags().Lookup("https")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
+	// viper reads stringArray flags back as a single string, so set the values directly
+	proxySet, err := cmd.Flags().GetStringArray("proxy-set")
+	if err != nil {
+		return err
+	}
+	viper.Set("proxySet", proxySet)
+	scripts, err := cmd.Flags().GetStringArray("script")
+	if err != nil {
+		return err
+	}
+	viper.Set("scripts", scripts)
+	for key, flag := range map[string]string{"setHeaders": "set-header", "replaceBody": "replace-body", "mapLocal": "map-local", "redact": "redact"} {
+		rules, err := cmd.Flags().GetStringArray(flag)
+		if err != nil {
+			return err
+		}
+		viper.Set(key, rules)
+	}
+	if err := viper.BindPFlag("proxyConfig", cmd.Flags().Lookup("proxy-config")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("clearRewrites", cmd.Flags().Lookup("clear-rewrites")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("mirrorTo", cmd.Flags().Lookup("mirror-to")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("redactDefaults", cmd.Flags().Lookup("redact-defaults")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindFaultFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindFaultFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("faultDelay", cmd.Flags().Lookup("delay")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("faultStatus", cmd.Flags().Lookup("status")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("faultReset", cmd.Flags().Lookup("reset-connection")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("faultPath", cmd.Flags().Lookup("path")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("faultPercent", cmd.Flags().Lookup("percent")); err != nil {
+		return err
+	}
+	return viper.BindPFlag("faultClear", cmd.Flags().Lookup("clear"))
+}
+
+// bindReplayFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindReplayFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("replayFrom", cmd.Flags().Lookup("from")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("replayMode", cmd.Flags().Lookup("mode")); err != nil {
+		return err
+	}
+	return viper.BindPFlag("replayStop", cmd.Flags().Lookup("stop"))
+}
+
+// bindCAExportFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindCAExportFlags(cmd *cobra.Command, _ []string) error {
+	return viper.BindPFlag("caOutput", cmd.Flags().Lookup("output"))
+}
+
+// bindDoctorFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindDoctorFlags(cmd *cobra.Command, _ []string) error {
+	return viper.BindPFlag("proxyPort", cmd.Flags().Lookup("port"))
+}
+
+// bindInstallWebhookFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindInstallWebhookFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("webhookImage", cmd.Flags().Lookup("image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("proxyImage", cmd.Flags().Lookup("proxy-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindWebhookFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindWebhookFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("listenAddress", cmd.Flags().Lookup("listen")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("tlsCertFile", cmd.Flags().Lookup("tls-cert-file")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("tlsKeyFile", cmd.Flags().Lookup("tls-key-file")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("proxyImage", cmd.Flags().Lookup("proxy-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindInstallControllerFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindInstallControllerFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("controllerImage", cmd.Flags().Lookup("image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("proxyImage", cmd.Flags().Lookup("proxy-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bindControllerFlags is a workaround for https://github.com/spf13/viper/issues/233
+func bindControllerFlags(cmd *cobra.Command, _ []string) error {
+	if err := viper.BindPFlag("proxyImage", cmd.Flags().Lookup("proxy-image")); err != nil {
+		return err
+	}
+	if err := viper.BindPFlag("commandArgs", cmd.Flags().Lookup("command-args")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -147,32 +479,232 @@ func NewRootCmd(e Exiter) *cobra.Command {
 	}
 }
 
-func NewOnCmd(client kubernetes.Interface, config *rest.Config) *cobra.Command {
+func NewOnCmd(clients *kubeClients) *cobra.Command {
 	return &cobra.Command{
-		Use:     "on",
-		Short:   "Tap a Service",
-		Example: "kubectl tap on -n my-namespace -p443 --https my-sample-service",
+		Use:   "on",
+		Short: "Tap a Service",
+		Example: `  kubectl tap on -n my-namespace -p443 --https my-sample-service
+  kubectl tap on -n my-namespace -l app=checkout --all-ports
+  kubectl tap on -p80 --port-forward --target edge=api-gateway --target core=payments/checkout`,
 		PreRunE: bindTapFlags,
-		RunE:    NewTapCommand(client, config, viper.GetViper()),
-		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(viper.GetStringSlice("targets")) > 0 {
+				return NewMultiClusterTapCommand(clients.forContext, viper.GetViper())(cmd, args)
+			}
+			return clients.runE(func(client kubernetes.Interface, dynamicClient dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+				if controllerInstalled(client) {
+					return NewCreateTapCommand(client, dynamicClient, config, viper.GetViper())
+				}
+				return NewTapCommand(client, config, viper.GetViper())
+			})(cmd, args)
+		},
+		ValidArgsFunction: clients.completeServices(false),
+		Args:              serviceArgs("selector", "target"),
+	}
+}
+
+func NewOffCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:   "off",
+		Short: "Untap a Service",
+		Example: `  kubectl tap off -n my-namespace my-sample-service
+  kubectl tap off -n my-namespace -l app=checkout
+  kubectl tap off -n my-namespace --all`,
+		PreRunE: bindUntapFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, dynamicClient dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+			return func(cmd *cobra.Command, args []string) error {
+				if viper.GetString("selector") != "" || viper.GetBool("all") {
+					return NewUntapSelectedCommand(client, dynamicClient, config, viper.GetViper())(cmd, args)
+				}
+				if controllerInstalled(client) {
+					return NewDeleteTapCommand(client, dynamicClient, config, viper.GetViper())(cmd, args)
+				}
+				return NewUntapCommand(client, config, viper.GetViper())(cmd, args)
+			}
+		}),
+		ValidArgsFunction: clients.completeServices(true),
+		Args:              serviceArgs("selector", "all"),
+	}
+}
+
+func NewUpdateCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "update",
+		Short:   "Update an active tap",
+		Example: "kubectl tap update -n my-namespace --proxy-set anticache=true --script token_swap.py my-sample-service",
+		PreRunE: bindUpdateFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+			return NewUpdateCommand(client, config, viper.GetViper())
+		}),
+		ValidArgsFunction: clients.completeServices(true),
+		Args:              cobra.ExactArgs(1),
+	}
+}
+
+func NewListCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "list",
+		Short:   "List tapped Services",
+		PreRunE: bindListFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewListCommand(client, viper.GetViper())
+		}),
 	}
 }
 
-func NewOffCmd(client kubernetes.Interface) *cobra.Command {
+func NewFaultCmd(clients *kubeClients) *cobra.Command {
 	return &cobra.Command{
-		Use:     "off",
-		Short:   "Untap a Service",
-		Example: "kubectl tap off -n my-namespace my-sample-service",
-		RunE:    NewUntapCommand(client, viper.GetViper()),
-		Args:    cobra.ExactArgs(1),
+		Use:   "fault",
+		Short: "Inject faults into the traffic of a tapped Service",
+		Long: `Inject faults into the traffic of a tapped Service.
+
+Each invocation with --delay, --status or --reset-connection adds a rule. Rules
+apply in the order they were added, and are removed with --clear or when the
+Service is untapped. Without any of these flags, the current rules are listed.`,
+		Example: `  kubectl tap fault -n my-namespace my-sample-service --delay 500ms --percent 20
+  kubectl tap fault -n my-namespace my-sample-service --status 503 --path '/api/*'
+  kubectl tap fault -n my-namespace my-sample-service --clear`,
+		PreRunE: bindFaultFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+			return NewFaultCommand(client, config, viper.GetViper())
+		}),
+		ValidArgsFunction: clients.completeServices(true),
+		Args:              cobra.ExactArgs(1),
 	}
 }
 
-func NewListCmd(client kubernetes.Interface) *cobra.Command {
+func NewReplayCmd(clients *kubeClients) *cobra.Command {
 	return &cobra.Command{
-		Use:   "list",
-		Short: "List tapped Services",
-		RunE:  NewListCommand(client, viper.GetViper()),
+		Use:   "replay",
+		Short: "Replay recorded traffic through a tapped Service",
+		Long: `Replay recorded traffic through a tapped Service.
+
+In client mode, the default, the recorded requests are sent to the tapped
+container and each response is compared with the recorded one. The command
+fails if any response differs, so it can gate a deployment.
+
+In server mode, clients of the Service are answered with the recorded
+responses, and requests without a recording are forwarded as usual.`,
+		Example: `  kubectl tap replay -n my-namespace my-sample-service --from flows.mitm
+  kubectl tap replay -n my-namespace my-sample-service --from flows.mitm --mode server
+  kubectl tap replay -n my-namespace my-sample-service --mode server --stop`,
+		PreRunE: bindReplayFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+			return NewReplayCommand(client, config, viper.GetViper())
+		}),
+		ValidArgsFunction: clients.completeServices(true),
+		Args:              cobra.ExactArgs(1),
+	}
+}
+
+func NewCACmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ca",
+		Short: "Manage the CA of the proxy",
+	}
+}
+
+func NewCAExportCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "export",
+		Short:   "Print the CA certificate of the proxy tapping a Service",
+		Example: "kubectl tap ca export -n my-namespace my-sample-service -o kubetap-ca.pem",
+		PreRunE: bindCAExportFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, config *rest.Config) func(*cobra.Command, []string) error {
+			return NewCAExportCommand(client, config, viper.GetViper())
+		}),
+		ValidArgsFunction: clients.completeServices(true),
+		Args:              cobra.ExactArgs(1),
+	}
+}
+
+func NewDoctorCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "doctor",
+		Short:   "Check whether a Service can be tapped",
+		Example: "kubectl tap doctor -n my-namespace -p443 my-sample-service",
+		PreRunE: bindDoctorFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewDoctorCommand(client, viper.GetViper())
+		}),
+		ValidArgsFunction: clients.completeServices(false),
+		Args:              cobra.ExactArgs(1),
+	}
+}
+
+func NewInstallWebhookCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "install-webhook",
+		Short:   "Install a mutating webhook that keeps taps across redeploys",
+		Example: "kubectl tap install-webhook",
+		PreRunE: bindInstallWebhookFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewInstallWebhookCommand(client, viper.GetViper())
+		}),
+		Args: cobra.NoArgs,
+	}
+}
+
+func NewUninstallWebhookCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "uninstall-webhook",
+		Short:   "Remove the kubetap mutating webhook",
+		Example: "kubectl tap uninstall-webhook",
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewUninstallWebhookCommand(client)
+		}),
+		Args: cobra.NoArgs,
+	}
+}
+
+func NewWebhookCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "webhook",
+		Short:   "Serve the kubetap mutating webhook (run in-cluster by install-webhook)",
+		Hidden:  true,
+		PreRunE: bindWebhookFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, _ dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewWebhookServeCommand(client, viper.GetViper())
+		}),
+		Args: cobra.NoArgs,
+	}
+}
+
+func NewInstallControllerCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "install-controller",
+		Short:   "Install the Tap resource and the controller that reconciles it",
+		Example: "kubectl tap install-controller",
+		PreRunE: bindInstallControllerFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, dynamicClient dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewInstallControllerCommand(client, dynamicClient, viper.GetViper())
+		}),
+		Args: cobra.NoArgs,
+	}
+}
+
+func NewUninstallControllerCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "uninstall-controller",
+		Short:   "Remove the kubetap controller and the Tap resource",
+		Example: "kubectl tap uninstall-controller",
+		RunE: clients.runE(func(client kubernetes.Interface, dynamicClient dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewUninstallControllerCommand(client, dynamicClient)
+		}),
+		Args: cobra.NoArgs,
+	}
+}
+
+func NewControllerCmd(clients *kubeClients) *cobra.Command {
+	return &cobra.Command{
+		Use:     "controller",
+		Short:   "Run the kubetap controller (run in-cluster by install-controller)",
+		Hidden:  true,
+		PreRunE: bindControllerFlags,
+		RunE: clients.runE(func(client kubernetes.Interface, dynamicClient dynamic.Interface, _ *rest.Config) func(*cobra.Command, []string) error {
+			return NewControllerCommand(client, dynamicClient, viper.GetViper())
+		}),
+		Args: cobra.NoArgs,
 	}
 }
 
@@ -186,6 +718,85 @@ func NewVersionCmd() *cobra.Command {
 	}
 }
 
+// kubeClients builds the Kubernetes clients of a command from the parsed kubeconfig flags
+// when the command runs, so that --context and --kubeconfig are honored, and commands that
+// do not talk to a cluster, like version or help, work without a kubeconfig.
+type kubeClients struct {
+	flags *genericclioptions.ConfigFlags
+}
+
+// build returns the clients for the current kubeconfig flags.
+func (k *kubeClients) build() (kubernetes.Interface, dynamic.Interface, *rest.Config, error) {
+	config, err := k.flags.ToRESTConfig()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return client, dynamicClient, config, nil
+}
+
+// runE returns a RunE that builds the clients, and then runs the RunE newRunE creates with them.
+func (k *kubeClients) runE(newRunE func(kubernetes.Interface, dynamic.Interface, *rest.Config) func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		client, dynamicClient, config, err := k.build()
+		if err != nil {
+			return err
+		}
+		return newRunE(client, dynamicClient, config)(cmd, args)
+	}
+}
+
+// forContext returns the clients of a kubeconfig context, which may differ from the one
+// selected with --context.
+func (k *kubeClients) forContext(name string) (clusterClients, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if k.flags.KubeConfig != nil {
+		loadingRules.ExplicitPath = *k.flags.KubeConfig
+	}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: name})
+	rawConfig, err := clientConfig.RawConfig()
+	if err != nil {
+		return clusterClients{}, err
+	}
+	c, ok := rawConfig.Contexts[name]
+	if !ok {
+		return clusterClients{}, fmt.Errorf("context %q does not exist in the kubeconfig", name)
+	}
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return clusterClients{}, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return clusterClients{}, err
+	}
+	return clusterClients{client: client, config: config, namespace: c.Namespace, user: c.AuthInfo}, nil
+}
+
+func NewCompletionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion",
+		Short: "Print the shell completion script of kubectl-tap",
+		Long: `Print the shell completion script of kubectl-tap for bash, zsh or fish.
+
+Service names and ports are completed from the cluster, only offering the
+untapped Services to tap, and the tapped ones to the other commands.`,
+		Example: `  source <(kubectl tap completion bash)
+  kubectl tap completion zsh > "${fpath[1]}/_kubectl-tap"
+  kubectl tap completion fish > ~/.config/fish/completions/kubectl-tap.fish`,
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		RunE:      NewCompletionCommand(),
+		Args:      cobra.ExactValidArgs(1),
+	}
+}
+
 // Exiter exits the program, calling os.Exit(code), nothing more.
 type Exiter interface {
 	Exit(code int)
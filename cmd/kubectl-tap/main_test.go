@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
 type MockExiter struct {
@@ -60,3 +61,17 @@ func Test_VersionCmd(t *testing.T) {
 	require.Nil(err)
 	require.Contains(string(out), "commit: ", "versionCmd does not produce expected output")
 }
+
+func Test_KubeClientsBuiltAtRunTime(t *testing.T) {
+	require := require.New(t)
+	flags := genericclioptions.NewConfigFlags(false)
+	kubeconfig := "/nonexistent/kubeconfig"
+	flags.KubeConfig = &kubeconfig
+	// constructing the command must not need a cluster, running it does
+	cmd := NewUninstallWebhookCmd(&kubeClients{flags: flags})
+	cmd.SetOutput(ioutil.Discard)
+	cmd.SetArgs([]string{})
+	err := cmd.Execute()
+	require.Error(err)
+	require.Contains(err.Error(), kubeconfig)
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var ErrMirrorTargetInvalid = errors.New("invalid mirror target")
+
+// mirrorConfig is the configuration of the mirror addon. An empty URL disables mirroring.
+type mirrorConfig struct {
+	URL      string `json:"url,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+}
+
+// newMirrorConfig returns the mirror addon configuration of a tap. Requests are mirrored
+// with the scheme and certificate verification used for the upstream.
+func newMirrorConfig(proxyOpts ProxyOptions) mirrorConfig {
+	if proxyOpts.MirrorTo == "" {
+		return mirrorConfig{}
+	}
+	scheme := "http"
+	if proxyOpts.UpstreamHTTPS {
+		scheme = "https"
+	}
+	return mirrorConfig{
+		URL:      scheme + "://" + proxyOpts.MirrorTo,
+		Insecure: proxyOpts.UpstreamInsecure,
+	}
+}
+
+// mirrorConfigData renders the mirror addon configuration for the tap ConfigMap.
+func mirrorConfigData(proxyOpts ProxyOptions) ([]byte, error) {
+	return json.Marshal(newMirrorConfig(proxyOpts))
+}
+
+// validateMirrorTarget checks a --mirror-to value of the form host:port. A host of the
+// form svc or svc.namespace must name an existing Service, other hosts are used as is.
+func validateMirrorTarget(client kubernetes.Interface, namespace, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("%w: %q must be of the form svc.namespace:port: %v", ErrMirrorTargetInvalid, target, err)
+	}
+	if host == "" {
+		return fmt.Errorf("%w: %q has no host", ErrMirrorTargetInvalid, target)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("%w: %q is not a valid port", ErrMirrorTargetInvalid, port)
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 2 || net.ParseIP(host) != nil {
+		return nil
+	}
+	svcName, svcNamespace := parts[0], namespace
+	if len(parts) == 2 {
+		svcNamespace = parts[1]
+	}
+	if _, err := client.CoreV1().Services(svcNamespace).Get(context.TODO(), svcName, metav1.GetOptions{}); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return fmt.Errorf("%w: Service %q does not exist in namespace %q", ErrMirrorTargetInvalid, svcName, svcNamespace)
+		}
+		return fmt.Errorf("error fetching the mirror Service: %w", err)
+	}
+	return nil
+}
+
+// mitmproxyMirrorAddonSource duplicates each request to the target in mitmproxyMirrorFile
+// without delaying the response to the client. Once both the upstream and the mirror
+// have answered, the status codes and latencies are compared in the comment of the flow
+// and in the event log.
+const mitmproxyMirrorAddonSource = `# Managed by kubetap, changes are overwritten.
+import asyncio
+import logging
+import ssl
+import time
+import urllib.error
+import urllib.request
+
+from mitmproxy import ctx
+
+from ` + mitmproxyAddonModule + ` import ConfigFile
+
+TIMEOUT = 30
+# hop-by-hop headers are not forwarded, and urllib sets its own Host and Content-Length
+SKIP_HEADERS = {"connection", "content-length", "host", "keep-alive", "proxy-connection", "te", "trailer", "transfer-encoding", "upgrade"}
+
+
+class NoRedirect(urllib.request.HTTPRedirectHandler):
+    def redirect_request(self, req, fp, code, msg, headers, newurl):
+        return None
+
+
+def send(method, url, headers, body, insecure):
+    handlers = [NoRedirect()]
+    if insecure:
+        handlers.append(urllib.request.HTTPSHandler(context=ssl._create_unverified_context()))
+    opener = urllib.request.build_opener(*handlers)
+    request = urllib.request.Request(url, data=body or None, headers=headers, method=method)
+    start = time.monotonic()
+    try:
+        with opener.open(request, timeout=TIMEOUT) as response:
+            response.read()
+            status = response.status
+    except urllib.error.HTTPError as e:
+        status = e.code
+    except Exception as e:
+        return {"error": str(e), "ms": round((time.monotonic() - start) * 1000)}
+    return {"status": status, "ms": round((time.monotonic() - start) * 1000)}
+
+
+class KubetapMirror:
+    def __init__(self):
+        self.config = ConfigFile("` + mitmproxyMirrorFile + `", "mirror target", {})
+
+    def request(self, flow):
+        if self.config.load() and self.config.value.get("url"):
+            logging.info("kubetap: mirroring requests to %s", self.config.value["url"])
+        target = self.config.value.get("url")
+        if not target or flow.is_replay:
+            return
+        headers = {k: v for k, v in flow.request.headers.items() if k.lower() not in SKIP_HEADERS}
+        future = asyncio.get_event_loop().run_in_executor(
+            None, send, flow.request.method, target + flow.request.path, headers,
+            flow.request.raw_content, self.config.value.get("insecure", False),
+        )
+        future.add_done_callback(lambda f: self.mirrored(flow, f))
+
+    def mirrored(self, flow, future):
+        flow.metadata["kubetap_mirror"] = future.result()
+        self.record(flow)
+
+    def response(self, flow):
+        self.record(flow)
+
+    def error(self, flow):
+        self.record(flow)
+
+    def record(self, flow):
+        mirror = flow.metadata.get("kubetap_mirror")
+        if mirror is None or (flow.response is None and flow.error is None):
+            return
+        if flow.metadata.get("kubetap_mirror_recorded"):
+            return
+        flow.metadata["kubetap_mirror_recorded"] = True
+        if flow.response is not None:
+            end = flow.response.timestamp_end or time.time()
+            primary = "%d in %dms" % (flow.response.status_code, (end - flow.request.timestamp_start) * 1000)
+        else:
+            primary = "error (%s)" % flow.error.msg
+        if "error" in mirror:
+            secondary = "error (%s) after %dms" % (mirror["error"], mirror["ms"])
+        else:
+            secondary = "%d in %dms" % (mirror["status"], mirror["ms"])
+        differs = flow.response is None or mirror.get("status") != flow.response.status_code
+        summary = "mirror: %s, primary: %s%s" % (secondary, primary, " (status differs)" if differs else "")
+        if hasattr(flow, "comment"):
+            flow.comment = summary
+        log = logging.warning if differs else logging.info
+        log("kubetap: %s %s %s", flow.request.method, flow.request.path, summary)
+        try:
+            from mitmproxy import hooks
+
+            ctx.master.addons.trigger(hooks.UpdateHook([flow]))
+        except Exception:
+            pass
+
+
+addons = [KubetapMirror()]
+`
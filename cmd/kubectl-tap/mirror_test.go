@@ -0,0 +1,89 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ValidateMirrorTarget(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Target string
+		Err    error
+	}{
+		{"service", "sample-service:80", nil},
+		{"service_namespace", "sample-service.default:80", nil},
+		{"external_host", "canary.example.com:443", nil},
+		{"ip", "10.0.0.12:8080", nil},
+		{"missing_service", "canary.default:80", ErrMirrorTargetInvalid},
+		{"missing_namespace", "sample-service.staging:80", ErrMirrorTargetInvalid},
+		{"no_port", "sample-service.default", ErrMirrorTargetInvalid},
+		{"invalid_port", "sample-service.default:http", ErrMirrorTargetInvalid},
+		{"no_host", ":80", ErrMirrorTargetInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := validateMirrorTarget(fakeClientUntappedSimple(), "default", tc.Target)
+			if tc.Err != nil {
+				require.True(t, errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(t, err)
+		})
+	}
+}
+
+func Test_NewMirrorConfig(t *testing.T) {
+	require := require.New(t)
+	require.Equal(mirrorConfig{}, newMirrorConfig(ProxyOptions{UpstreamHTTPS: true}))
+	require.Equal(mirrorConfig{URL: "http://canary.staging:80"}, newMirrorConfig(ProxyOptions{MirrorTo: "canary.staging:80"}))
+	require.Equal(mirrorConfig{URL: "https://canary.staging:443", Insecure: true},
+		newMirrorConfig(ProxyOptions{MirrorTo: "canary.staging:443", UpstreamHTTPS: true, UpstreamInsecure: true}))
+}
+
+func Test_NewTapCommandMirror(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("mirrorTo", "sample-service.default:80")
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal(mirrorConfig{URL: "http://sample-service.default:80"}, getConfigMapFile(t, fakeClient, mitmproxyMirrorFile, &mirrorConfig{}))
+
+	// stopping the mirror only changes the addon configuration, so the proxy keeps running
+	b := bytes.NewBufferString("")
+	cmd.SetOutput(b)
+	testViper = viper.New()
+	testViper.Set("mirrorTo", "")
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal(mirrorConfig{}, getConfigMapFile(t, fakeClient, mitmproxyMirrorFile, &mirrorConfig{}))
+	require.NotContains(b.String(), "restarting Deployment")
+
+	testViper = viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("mirrorTo", "canary.default:80")
+	err := NewTapCommand(fakeClientUntappedSimple(), &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrMirrorTargetInvalid), "expected (%q), got (%q)", ErrMirrorTargetInvalid, err)
+}
@@ -15,9 +15,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 
 	k8sappsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -25,6 +32,8 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
 )
 
 var (
@@ -32,14 +41,299 @@ var (
 	// properly removed during untapping.
 	mitmproxyDataVolName = "kubetap-mitmproxy-data"
 	mitmproxyConfigFile  = "config.yaml"
-	mitmproxyBaseConfig  = `listen_port: 7777
-ssl_insecure: true
-web_port: 2244
-web_host: 0.0.0.0
-web_open_browser: false
-`
+	// mitmproxyConfigDir is where the tap ConfigMap is mounted. Addon scripts are
+	// loaded from here so that ConfigMap updates reach the running proxy.
+	mitmproxyConfigDir = "/home/mitmproxy/config/"
+	// mitmproxyScriptName restricts script names to valid ConfigMap keys.
+	mitmproxyScriptName = regexp.MustCompile(`^[-._a-zA-Z0-9]+\.py$`)
+	// mitmproxyTLSVolName holds the certificate presented to clients with --tls-secret,
+	// which the entrypoint combines into mitmproxyTLSCertFile.
+	mitmproxyTLSVolName  = "kubetap-mitmproxy-tls"
+	mitmproxyTLSDir      = "/home/mitmproxy/tls/"
+	mitmproxyTLSCertFile = "/home/mitmproxy/.mitmproxy/kubetap-tls.pem"
+	// mitmproxyUpstreamClientVolName holds the client certificate presented to mTLS
+	// upstreams, which the entrypoint combines into mitmproxyUpstreamClientCertFile.
+	mitmproxyUpstreamClientVolName  = "kubetap-mitmproxy-upstream-client"
+	mitmproxyUpstreamClientDir      = "/home/mitmproxy/upstream-client/"
+	mitmproxyUpstreamClientCertFile = "/home/mitmproxy/.mitmproxy/kubetap-upstream-client.pem"
+	// mitmproxyUpstreamCAVolName holds the CA bundle upstream certificates are verified against.
+	mitmproxyUpstreamCAVolName = "kubetap-mitmproxy-upstream-ca"
+	mitmproxyUpstreamCADir     = "/home/mitmproxy/upstream-ca/"
 )
 
+var (
+	ErrProxyOptionUnknown  = errors.New("unknown mitmproxy option")
+	ErrProxyOptionReserved = errors.New("mitmproxy option is managed by kubetap")
+	ErrProxyOptionInvalid  = errors.New("invalid mitmproxy option")
+	ErrScriptInvalid       = errors.New("invalid mitmproxy addon script")
+	ErrProxyOptionsMissing = errors.New("the tap was created by an older version of kubetap, untap and tap the Service again to update it")
+)
+
+// mitmproxyReservedOptions are set by kubetap and cannot be overridden, as the Service
+// and port-forwards depend on them.
+var mitmproxyReservedOptions = map[string]bool{
+	"listen_port": true,
+	"web_port":    true,
+	"mode":        true,
+	"confdir":     true,
+	"scripts":     true,
+}
+
+// mitmproxyRestartOptions are only read when mitmproxy starts. All other options are
+// applied to a running proxy.
+var mitmproxyRestartOptions = map[string]bool{
+	"confdir":     true,
+	"listen_host": true,
+	"listen_port": true,
+	"mode":        true,
+	"web_host":    true,
+	"web_port":    true,
+}
+
+// mitmproxyOptionNames are the options accepted in mitmproxy's config.yaml, see
+// https://docs.mitmproxy.org/stable/concepts-options/
+var mitmproxyOptionNames = map[string]bool{
+	"add_upstream_certs_to_client_chain":  true,
+	"allow_hosts":                         true,
+	"anticache":                           true,
+	"anticomp":                            true,
+	"block_global":                        true,
+	"block_list":                          true,
+	"block_private":                       true,
+	"body_size_limit":                     true,
+	"cert_passphrase":                     true,
+	"certs":                               true,
+	"ciphers_client":                      true,
+	"ciphers_server":                      true,
+	"client_certs":                        true,
+	"client_replay":                       true,
+	"client_replay_concurrency":           true,
+	"confdir":                             true,
+	"connection_strategy":                 true,
+	"content_view_lines_cutoff":           true,
+	"dumper_default_contentview":          true,
+	"dumper_filter":                       true,
+	"flow_detail":                         true,
+	"hardump":                             true,
+	"http2":                               true,
+	"http2_ping_keepalive":                true,
+	"ignore_hosts":                        true,
+	"intercept":                           true,
+	"intercept_active":                    true,
+	"keep_host_header":                    true,
+	"key_size":                            true,
+	"listen_host":                         true,
+	"listen_port":                         true,
+	"map_local":                           true,
+	"map_remote":                          true,
+	"mode":                                true,
+	"modify_body":                         true,
+	"modify_headers":                      true,
+	"normalize_outbound_headers":          true,
+	"onboarding":                          true,
+	"onboarding_host":                     true,
+	"proxy_debug":                         true,
+	"proxyauth":                           true,
+	"rawtcp":                              true,
+	"readfile_filter":                     true,
+	"request_client_cert":                 true,
+	"rfile":                               true,
+	"save_stream_file":                    true,
+	"save_stream_filter":                  true,
+	"scripts":                             true,
+	"server":                              true,
+	"server_replay":                       true,
+	"server_replay_extra":                 true,
+	"server_replay_ignore_content":        true,
+	"server_replay_ignore_host":           true,
+	"server_replay_ignore_params":         true,
+	"server_replay_ignore_payload_params": true,
+	"server_replay_ignore_port":           true,
+	"server_replay_kill_extra":            true,
+	"server_replay_nopop":                 true,
+	"server_replay_refresh":               true,
+	"server_replay_use_headers":           true,
+	"showhost":                            true,
+	"ssl_insecure":                        true,
+	"ssl_verify_upstream_trusted_ca":      true,
+	"ssl_verify_upstream_trusted_confdir": true,
+	"stickyauth":                          true,
+	"stickycookie":                        true,
+	"stream_large_bodies":                 true,
+	"tcp_hosts":                           true,
+	"termlog_verbosity":                   true,
+	"tls_version_client_max":              true,
+	"tls_version_client_min":              true,
+	"tls_version_server_max":              true,
+	"tls_version_server_min":              true,
+	"upstream_auth":                       true,
+	"upstream_cert":                       true,
+	"validate_inbound_headers":            true,
+	"view_filter":                         true,
+	"view_order":                          true,
+	"view_order_reversed":                 true,
+	"web_columns":                         true,
+	"web_debug":                           true,
+	"web_host":                            true,
+	"web_open_browser":                    true,
+	"web_port":                            true,
+	"web_static_viewer":                   true,
+	"websocket":                           true,
+}
+
+// mitmproxyConfig holds the mitmproxy options that kubetap sets. It is rendered to
+// mitmproxy's config.yaml.
+type mitmproxyConfig struct {
+	ListenPort     int      `json:"listen_port"`
+	SSLInsecure    bool     `json:"ssl_insecure"`
+	WebPort        int      `json:"web_port"`
+	WebHost        string   `json:"web_host"`
+	WebOpenBrowser bool     `json:"web_open_browser"`
+	Mode           []string `json:"mode"`
+	ViewFilter     string   `json:"view_filter,omitempty"`
+	Scripts        []string `json:"scripts,omitempty"`
+	Certs          []string `json:"certs,omitempty"`
+	ClientCerts    string   `json:"client_certs,omitempty"`
+	ModifyHeaders  []string `json:"modify_headers,omitempty"`
+	ModifyBody     []string `json:"modify_body,omitempty"`
+	MapLocal       []string `json:"map_local,omitempty"`
+	// SSLVerifyUpstreamTrustedCA replaces mitmproxy's default trust store
+	SSLVerifyUpstreamTrustedCA string `json:"ssl_verify_upstream_trusted_ca,omitempty"`
+}
+
+// newMitmproxyConfig builds the mitmproxy configuration for the proxy options.
+func newMitmproxyConfig(proxyOpts ProxyOptions) (mitmproxyConfig, error) {
+	config := mitmproxyConfig{
+		ListenPort:     kubetapProxyListenPort,
+		SSLInsecure:    proxyOpts.UpstreamInsecure,
+		WebPort:        kubetapProxyWebInterfacePort,
+		WebHost:        "0.0.0.0",
+		WebOpenBrowser: false,
+	}
+	switch proxyOpts.Mode {
+	case "reverse":
+		config.Mode = []string{"reverse:" + upstreamScheme(proxyOpts.UpstreamHTTPS) + "://127.0.0.1:" + proxyOpts.UpstreamPort}
+		if len(proxyOpts.Upstreams) > 0 {
+			// one reverse proxy for each tapped Service port, listening on its own port
+			config.Mode = nil
+			for _, u := range proxyOpts.Upstreams {
+				config.Mode = append(config.Mode, fmt.Sprintf("reverse:%s://127.0.0.1:%s@%d", upstreamScheme(u.HTTPS), u.UpstreamPort, u.ListenPort))
+			}
+		}
+	case "regular", "socks5":
+		// non-applicable
+		return config, errors.New("mitmproxy container only supports \"reverse\" mode")
+	case "upstream":
+		// non-applicable, unless you really know what you're doing, in which case fork this and connect it to your existing proxy
+		return config, errors.New("mitmproxy container only supports \"reverse\" mode")
+	case "transparent":
+		// Because transparent mode uses iptables, it's not supported as we cannot guarantee that iptables is available and functioning
+		return config, errors.New("mitmproxy container only supports \"reverse\" mode")
+	default:
+		return config, errors.New("invalid proxy mode: \"" + proxyOpts.Mode + "\"")
+	}
+	if len(proxyOpts.Filters) > 0 {
+		// mitmproxy accepts a single filter expression, so show flows matching any of them
+		filters := make([]string, len(proxyOpts.Filters))
+		for i, f := range proxyOpts.Filters {
+			filters[i] = "(" + f + ")"
+		}
+		config.ViewFilter = strings.Join(filters, " | ")
+	}
+	for _, name := range bundledAddons {
+		config.Scripts = append(config.Scripts, mitmproxyConfigDir+name)
+	}
+	for name := range proxyOpts.Scripts {
+		config.Scripts = append(config.Scripts, mitmproxyConfigDir+name)
+	}
+	sort.Strings(config.Scripts)
+	if proxyOpts.TLSSecret != "" {
+		// present the Service's own certificate for every domain
+		config.Certs = []string{"*=" + mitmproxyTLSCertFile}
+	}
+	if proxyOpts.UpstreamClientCertSecret != "" {
+		config.ClientCerts = mitmproxyUpstreamClientCertFile
+	}
+	config.ModifyHeaders = proxyOpts.SetHeaders
+	config.ModifyBody = proxyOpts.ReplaceBody
+	for _, rule := range proxyOpts.MapLocal {
+		spec, err := mitmproxySpec(rule.URLRegex, mitmproxyConfigDir+rule.File)
+		if err != nil {
+			return config, err
+		}
+		config.MapLocal = append(config.MapLocal, spec)
+	}
+	if proxyOpts.UpstreamCASecret != "" {
+		config.SSLVerifyUpstreamTrustedCA = mitmproxyUpstreamCADir + upstreamCAKey
+	}
+	return config, nil
+}
+
+// render marshals the configuration to YAML, with extra options taking precedence over
+// the ones set by kubetap.
+func (c mitmproxyConfig) render(extra map[string]interface{}) ([]byte, error) {
+	if err := validateMitmproxyOptions(extra); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]interface{})
+	if err := json.Unmarshal(b, &options); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		options[k] = v
+	}
+	return yaml.Marshal(options)
+}
+
+// validateMitmproxyOptions ensures that user supplied options are known to mitmproxy and
+// do not change what kubetap relies on.
+func validateMitmproxyOptions(options map[string]interface{}) error {
+	for k := range options {
+		if !mitmproxyOptionNames[k] {
+			return fmt.Errorf("%w: %q", ErrProxyOptionUnknown, k)
+		}
+		if mitmproxyReservedOptions[k] {
+			return fmt.Errorf("%w: %q", ErrProxyOptionReserved, k)
+		}
+	}
+	return nil
+}
+
+// mitmproxyOptionsFromFlags merges the options of a --proxy-config file with --proxy-set
+// key=value pairs, which take precedence. Values are parsed as YAML, so "true" and "5"
+// become a boolean and a number.
+func mitmproxyOptionsFromFlags(sets []string, configFile string) (map[string]interface{}, error) {
+	options := make(map[string]interface{})
+	if configFile != "" {
+		b, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading proxy config: %w", err)
+		}
+		if err := yaml.Unmarshal(b, &options); err != nil {
+			return nil, fmt.Errorf("%w: %s is not a YAML map of options: %v", ErrProxyOptionInvalid, configFile, err)
+		}
+	}
+	for _, set := range sets {
+		kv := strings.SplitN(set, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%w: %q must be in the form key=value", ErrProxyOptionInvalid, set)
+		}
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(kv[1]), &v); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrProxyOptionInvalid, set, err)
+		}
+		options[kv[0]] = v
+	}
+	if err := validateMitmproxyOptions(options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
 // MitmproxySidecarContainer is the default proxy sidecar for HTTP Taps.
 var MitmproxySidecarContainer = v1.Container{
 	Name: kubetapContainerName,
@@ -59,11 +353,10 @@ var MitmproxySidecarContainer = v1.Container{
 		},
 	},
 	ReadinessProbe: &v1.Probe{
+		// the web interface requires a password, so probe the port rather than a page
 		Handler: v1.Handler{
-			HTTPGet: &v1.HTTPGetAction{
-				Path:   "/",
-				Port:   intstr.FromInt(kubetapProxyWebInterfacePort),
-				Scheme: v1.URISchemeHTTP,
+			TCPSocket: &v1.TCPSocketAction{
+				Port: intstr.FromInt(kubetapProxyWebInterfacePort),
 			},
 		},
 		InitialDelaySeconds: 5,
@@ -74,7 +367,7 @@ var MitmproxySidecarContainer = v1.Container{
 	VolumeMounts: []v1.VolumeMount{
 		{
 			// Name:    "", // Name is controlled by main
-			MountPath: "/home/mitmproxy/config/",
+			MountPath: mitmproxyConfigDir,
 			// We store outside main dir to prevent RO problems, see below.
 			// This also means that we need to wrap the official mitmproxy container.
 			/*
@@ -114,11 +407,55 @@ type Mitmproxy struct {
 
 // Sidecar provides a proxy sidecar container.
 func (m *Mitmproxy) Sidecar(deploymentName string) v1.Container {
-	c := MitmproxySidecarContainer
+	c := *MitmproxySidecarContainer.DeepCopy()
 	c.VolumeMounts[0].Name = kubetapConfigMapPrefix + deploymentName
+	c.Env = append(c.Env, webPasswordEnvVar(deploymentName))
+	for _, u := range m.ProxyOpts.Upstreams {
+		if u.ListenPort == kubetapProxyListenPort {
+			continue
+		}
+		c.Ports = append(c.Ports, v1.ContainerPort{
+			Name:          fmt.Sprintf("kubetap-%d", u.ListenPort),
+			ContainerPort: u.ListenPort,
+			Protocol:      v1.ProtocolTCP,
+		})
+	}
+	for _, sm := range m.secretMounts() {
+		c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
+			Name:      sm.Volume,
+			MountPath: sm.Dir,
+			ReadOnly:  true,
+		})
+	}
 	return c
 }
 
+// mitmproxySecretMount is a Secret given in the proxy options, mounted into the sidecar.
+type mitmproxySecretMount struct {
+	Volume string
+	Secret string
+	Dir    string
+}
+
+// secretMounts returns the Secrets to mount into the sidecar. Certificates that
+// mitmproxy expects in a single file with their key are combined by the entrypoint.
+func (m *Mitmproxy) secretMounts() []mitmproxySecretMount {
+	var mounts []mitmproxySecretMount
+	if m.ProxyOpts.CASecret != "" {
+		mounts = append(mounts, mitmproxySecretMount{mitmproxyCAVolName, m.ProxyOpts.CASecret, mitmproxyCADir})
+	}
+	if m.ProxyOpts.TLSSecret != "" {
+		mounts = append(mounts, mitmproxySecretMount{mitmproxyTLSVolName, m.ProxyOpts.TLSSecret, mitmproxyTLSDir})
+	}
+	if m.ProxyOpts.UpstreamClientCertSecret != "" {
+		mounts = append(mounts, mitmproxySecretMount{mitmproxyUpstreamClientVolName, m.ProxyOpts.UpstreamClientCertSecret, mitmproxyUpstreamClientDir})
+	}
+	if m.ProxyOpts.UpstreamCASecret != "" {
+		mounts = append(mounts, mitmproxySecretMount{mitmproxyUpstreamCAVolName, m.ProxyOpts.UpstreamCASecret, mitmproxyUpstreamCADir})
+	}
+	return mounts
+}
+
 // PatchDeployment provides any necessary tweaks to the deployment after the sidecar is added.
 func (m *Mitmproxy) PatchDeployment(deployment *k8sappsv1.Deployment) {
 	deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, v1.Volume{
@@ -138,6 +475,16 @@ func (m *Mitmproxy) PatchDeployment(deployment *k8sappsv1.Deployment) {
 			EmptyDir: &v1.EmptyDirVolumeSource{},
 		},
 	})
+	for _, sm := range m.secretMounts() {
+		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, v1.Volume{
+			Name: sm.Volume,
+			VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{
+					SecretName: sm.Secret,
+				},
+			},
+		})
+	}
 }
 
 // Protocols returns a slice of protocols supported by Mitmproxy, currently only HTTP.
@@ -169,11 +516,51 @@ func (m *Mitmproxy) ReadyEnv() error {
 			return rErr
 		}
 	}
-	return nil
+	return createWebPasswordSecret(m.Client.CoreV1().Secrets(m.ProxyOpts.Namespace), m.ProxyOpts.dplName)
 }
 
-// UnreadyEnv removes tap supporting configmap.
+// UpdateEnv rewrites the mitmproxy ConfigMap from the current options. Changed scripts
+// are reloaded by mitmproxy from the ConfigMap mount, other changed options are returned
+// so that they can be applied through the mitmweb API.
+func (m *Mitmproxy) UpdateEnv() (TapUpdate, error) {
+	configmapsClient := m.Client.CoreV1().ConfigMaps(m.ProxyOpts.Namespace)
+	cmData, err := mitmproxyConfigMapData(m.ProxyOpts)
+	if err != nil {
+		return TapUpdate{}, err
+	}
+	proxyOptsData, err := json.Marshal(m.ProxyOpts)
+	if err != nil {
+		return TapUpdate{}, err
+	}
+	var update TapUpdate
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configmapsClient.Get(context.TODO(), kubetapConfigMapPrefix+m.ProxyOpts.dplName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		update, err = diffMitmproxyConfig(cm.BinaryData[mitmproxyConfigFile], cmData[mitmproxyConfigFile])
+		if err != nil {
+			return err
+		}
+		cm.BinaryData = cmData
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[annotationProxyOptions] = string(proxyOptsData)
+		_, err = configmapsClient.Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+	if retryErr != nil {
+		return TapUpdate{}, fmt.Errorf("failed to update the mitmproxy ConfigMap: %w", retryErr)
+	}
+	return update, nil
+}
+
+// UnreadyEnv removes the tap supporting ConfigMap and web interface password.
 func (m *Mitmproxy) UnreadyEnv() error {
+	if err := destroyWebPasswordSecret(m.Client.CoreV1().Secrets(m.ProxyOpts.Namespace), m.ProxyOpts.dplName); err != nil {
+		return err
+	}
 	configmapsClient := m.Client.CoreV1().ConfigMaps(m.ProxyOpts.Namespace)
 	return destroyMitmproxyConfigMap(configmapsClient, m.ProxyOpts.dplName)
 }
@@ -181,39 +568,21 @@ func (m *Mitmproxy) UnreadyEnv() error {
 // createMitmproxyConfigMap creates a mitmproxy configmap based on the proxy mode, however currently
 // only "reverse" mode is supported.
 func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOpts ProxyOptions) error {
-	// TODO: eventually, we should build a struct and use yaml to marshal this,
-	// but for now we're just doing string concatenation.
-	var mitmproxyConfig []byte
-	switch proxyOpts.Mode {
-	case "reverse":
-		if proxyOpts.UpstreamHTTPS {
-			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode: reverse:https://127.0.0.1:"+proxyOpts.UpstreamPort)...)
-		} else {
-			mitmproxyConfig = append([]byte(mitmproxyBaseConfig), []byte("mode: reverse:http://127.0.0.1:"+proxyOpts.UpstreamPort)...)
-		}
-	case "regular":
-		// non-applicable
-		return errors.New("mitmproxy container only supports \"reverse\" mode")
-	case "socks5":
-		// non-applicable
-		return errors.New("mitmproxy container only supports \"reverse\" mode")
-	case "upstream":
-		// non-applicable, unless you really know what you're doing, in which case fork this and connect it to your existing proxy
-		return errors.New("mitmproxy container only supports \"reverse\" mode")
-	case "transparent":
-		// Because transparent mode uses iptables, it's not supported as we cannot guarantee that iptables is available and functioning
-		return errors.New("mitmproxy container only supports \"reverse\" mode")
-	default:
-		return errors.New("invalid proxy mode: \"" + proxyOpts.Mode + "\"")
+	cmData, err := mitmproxyConfigMapData(proxyOpts)
+	if err != nil {
+		return err
+	}
+	proxyOptsData, err := json.Marshal(proxyOpts)
+	if err != nil {
+		return err
 	}
-	cmData := make(map[string][]byte)
-	cmData[mitmproxyConfigFile] = mitmproxyConfig
 	cm := v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      kubetapConfigMapPrefix + proxyOpts.dplName,
 			Namespace: proxyOpts.Namespace,
 			Annotations: map[string]string{
-				annotationConfigMap: configMapAnnotationPrefix + proxyOpts.dplName,
+				annotationConfigMap:    configMapAnnotationPrefix + proxyOpts.dplName,
+				annotationProxyOptions: string(proxyOptsData),
 			},
 		},
 		BinaryData: cmData,
@@ -236,6 +605,132 @@ func createMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, proxyOp
 	return nil
 }
 
+// mitmproxyConfigMapData returns the files of the mitmproxy ConfigMap: the rendered
+// config.yaml, addon scripts, and the configuration of the bundled addons.
+func mitmproxyConfigMapData(proxyOpts ProxyOptions) (map[string][]byte, error) {
+	config, err := newMitmproxyConfig(proxyOpts)
+	if err != nil {
+		return nil, err
+	}
+	redactData, extraOptions, err := redactConfigData(proxyOpts)
+	if err != nil {
+		return nil, err
+	}
+	configData, err := config.render(extraOptions)
+	if err != nil {
+		return nil, err
+	}
+	faults := proxyOpts.Faults
+	if faults == nil {
+		faults = []FaultRule{}
+	}
+	faultsData, err := json.Marshal(faults)
+	if err != nil {
+		return nil, err
+	}
+	mirrorData, err := mirrorConfigData(proxyOpts)
+	if err != nil {
+		return nil, err
+	}
+	cmData := map[string][]byte{
+		mitmproxyConfigFile: configData,
+		mitmproxyFaultsFile: faultsData,
+		mitmproxyMirrorFile: mirrorData,
+		mitmproxyRedactFile: redactData,
+	}
+	for name, source := range bundledAddonSources {
+		cmData[name] = []byte(source)
+	}
+	for name, script := range proxyOpts.Scripts {
+		cmData[name] = script
+	}
+	for key, file := range proxyOpts.MapLocalFiles {
+		cmData[key] = file
+	}
+	return cmData, nil
+}
+
+// diffMitmproxyConfig compares two rendered configurations. Options that were removed
+// cannot be reset on a running proxy, so they require a restart like the
+// mitmproxyRestartOptions.
+func diffMitmproxyConfig(oldData, newData []byte) (TapUpdate, error) {
+	var oldOptions, newOptions map[string]interface{}
+	if err := yaml.Unmarshal(oldData, &oldOptions); err != nil {
+		return TapUpdate{}, fmt.Errorf("error reading the mitmproxy config: %w", err)
+	}
+	if err := yaml.Unmarshal(newData, &newOptions); err != nil {
+		return TapUpdate{}, err
+	}
+	update := TapUpdate{Options: make(map[string]interface{})}
+	for k := range oldOptions {
+		if _, ok := newOptions[k]; !ok {
+			update.Restart = true
+		}
+	}
+	for k, v := range newOptions {
+		if reflect.DeepEqual(oldOptions[k], v) {
+			continue
+		}
+		if mitmproxyRestartOptions[k] {
+			update.Restart = true
+		}
+		update.Options[k] = v
+	}
+	return update, nil
+}
+
+// loadMitmproxyOptions returns the options a Deployment was tapped with, as recorded on
+// its mitmproxy ConfigMap.
+func loadMitmproxyOptions(configmapClient corev1.ConfigMapInterface, deploymentName string) (ProxyOptions, error) {
+	cm, err := configmapClient.Get(context.TODO(), kubetapConfigMapPrefix+deploymentName, metav1.GetOptions{})
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	data := cm.Annotations[annotationProxyOptions]
+	if data == "" {
+		return ProxyOptions{}, ErrProxyOptionsMissing
+	}
+	var proxyOpts ProxyOptions
+	if err := json.Unmarshal([]byte(data), &proxyOpts); err != nil {
+		return ProxyOptions{}, fmt.Errorf("error reading the tap options: %w", err)
+	}
+	proxyOpts.dplName = deploymentName
+	proxyOpts.Scripts = make(map[string][]byte)
+	for name, script := range cm.BinaryData {
+		if mitmproxyScriptName.MatchString(name) && !isBundledAddon(name) && !strings.HasPrefix(name, mapLocalFilePrefix) {
+			proxyOpts.Scripts[name] = script
+		}
+	}
+	proxyOpts.MapLocalFiles = make(map[string][]byte)
+	for _, rule := range proxyOpts.MapLocal {
+		proxyOpts.MapLocalFiles[rule.File] = cm.BinaryData[rule.File]
+	}
+	return proxyOpts, nil
+}
+
+// mitmproxyScriptsFromFlags reads the addon scripts given with --script, keyed by file name.
+func mitmproxyScriptsFromFlags(paths []string) (map[string][]byte, error) {
+	scripts := make(map[string][]byte)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !mitmproxyScriptName.MatchString(name) {
+			return nil, fmt.Errorf("%w: %q must be a .py file named with letters, digits, '-', '_' or '.'", ErrScriptInvalid, name)
+		}
+		if isBundledAddon(name) {
+			return nil, fmt.Errorf("%w: %q is the name of an addon bundled with kubetap", ErrScriptInvalid, name)
+		}
+		if _, ok := scripts[name]; ok {
+			return nil, fmt.Errorf("%w: more than one script is named %q", ErrScriptInvalid, name)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading script: %w", err)
+		}
+		scripts[name] = b
+	}
+	return scripts, nil
+}
+
 // destroyMitmproxyConfigMap removes a mitmproxy ConfigMap from the environment.
 func destroyMitmproxyConfigMap(configmapClient corev1.ConfigMapInterface, deploymentName string) error {
 	if deploymentName == "" {
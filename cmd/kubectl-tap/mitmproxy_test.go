@@ -15,11 +15,14 @@ package main
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/yaml"
 )
 
 func Test_DestroyMitmproxyConfigMap(t *testing.T) {
@@ -49,3 +52,137 @@ func Test_DestroyMitmproxyConfigMap(t *testing.T) {
 		})
 	}
 }
+
+func Test_MitmproxyConfigRender(t *testing.T) {
+	tests := []struct {
+		Name      string
+		ProxyOpts ProxyOptions
+		Extra     map[string]interface{}
+		Expected  map[string]interface{}
+		Err       error
+	}{
+		{"simple", ProxyOptions{Mode: "reverse", UpstreamPort: "8080"}, nil, map[string]interface{}{
+			"listen_port": float64(kubetapProxyListenPort),
+			"web_port":    float64(kubetapProxyWebInterfacePort),
+			"mode":        []interface{}{"reverse:http://127.0.0.1:8080"},
+		}, nil},
+		{"https", ProxyOptions{Mode: "reverse", UpstreamPort: "443", UpstreamHTTPS: true}, nil, map[string]interface{}{
+			"mode":         []interface{}{"reverse:https://127.0.0.1:443"},
+			"ssl_insecure": false,
+		}, nil},
+		{"https_insecure", ProxyOptions{Mode: "reverse", UpstreamPort: "443", UpstreamHTTPS: true, UpstreamInsecure: true}, nil, map[string]interface{}{
+			"ssl_insecure": true,
+		}, nil},
+		{"upstream_mtls", ProxyOptions{Mode: "reverse", UpstreamPort: "443", UpstreamHTTPS: true, UpstreamClientCertSecret: "client", UpstreamCASecret: "ca"}, nil, map[string]interface{}{
+			"ssl_insecure":                   false,
+			"client_certs":                   mitmproxyUpstreamClientCertFile,
+			"ssl_verify_upstream_trusted_ca": mitmproxyUpstreamCADir + upstreamCAKey,
+		}, nil},
+		{"filters", ProxyOptions{Mode: "reverse", UpstreamPort: "80", Filters: []string{"~d a.com", "~c 500"}}, nil, map[string]interface{}{
+			"view_filter": "(~d a.com) | (~c 500)",
+		}, nil},
+		{"scripts", ProxyOptions{Mode: "reverse", UpstreamPort: "80", Scripts: map[string][]byte{"b.py": nil, "a.py": nil}}, nil, map[string]interface{}{
+			"scripts": []interface{}{mitmproxyConfigDir + "a.py", mitmproxyConfigDir + "b.py", mitmproxyConfigDir + mitmproxyFaultsAddon, mitmproxyConfigDir + mitmproxyMirrorAddon, mitmproxyConfigDir + mitmproxyRedactAddon},
+		}, nil},
+		{"extra_options", ProxyOptions{Mode: "reverse", UpstreamPort: "80"}, map[string]interface{}{
+			"anticache":    true,
+			"ssl_insecure": false,
+		}, map[string]interface{}{
+			"anticache":    true,
+			"ssl_insecure": false,
+		}, nil},
+		{"unknown_option", ProxyOptions{Mode: "reverse", UpstreamPort: "80"}, map[string]interface{}{"no_such_option": true}, nil, ErrProxyOptionUnknown},
+		{"reserved_option", ProxyOptions{Mode: "reverse", UpstreamPort: "80"}, map[string]interface{}{"mode": "regular"}, nil, ErrProxyOptionReserved},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			config, err := newMitmproxyConfig(tc.ProxyOpts)
+			require.Nil(err)
+			b, err := config.render(tc.Extra)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			var rendered map[string]interface{}
+			require.Nil(yaml.Unmarshal(b, &rendered))
+			for k, v := range tc.Expected {
+				require.Equal(v, rendered[k], k)
+			}
+		})
+	}
+}
+
+func Test_MitmproxyOptionsFromFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(configFile, []byte("stream_large_bodies: 1m\nanticache: false\n"), 0600))
+
+	tests := []struct {
+		Name       string
+		Sets       []string
+		ConfigFile string
+		Expected   map[string]interface{}
+		Err        error
+	}{
+		{"none", nil, "", map[string]interface{}{}, nil},
+		{"sets", []string{"anticache=true", "view_filter=~d example.com", "body_size_limit=5"}, "", map[string]interface{}{
+			"anticache":       true,
+			"view_filter":     "~d example.com",
+			"body_size_limit": float64(5),
+		}, nil},
+		{"file", nil, configFile, map[string]interface{}{
+			"stream_large_bodies": "1m",
+			"anticache":           false,
+		}, nil},
+		{"sets_override_file", []string{"anticache=true"}, configFile, map[string]interface{}{
+			"stream_large_bodies": "1m",
+			"anticache":           true,
+		}, nil},
+		{"missing_value", []string{"anticache"}, "", nil, ErrProxyOptionInvalid},
+		{"unknown_option", []string{"anti_cache=true"}, "", nil, ErrProxyOptionUnknown},
+		{"reserved_option", []string{"listen_port=8080"}, "", nil, ErrProxyOptionReserved},
+		{"scripts_option", []string{"scripts=addon.py"}, "", nil, ErrProxyOptionReserved},
+		{"missing_file", nil, filepath.Join(dir, "missing.yaml"), nil, os.ErrNotExist},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			options, err := mitmproxyOptionsFromFlags(tc.Sets, tc.ConfigFile)
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Expected, options)
+		})
+	}
+}
+
+func Test_DiffMitmproxyConfig(t *testing.T) {
+	base := "listen_port: 7777\nmode:\n- reverse:http://127.0.0.1:8080/\nanticache: false\n"
+	tests := []struct {
+		Name     string
+		New      string
+		Restart  bool
+		Expected map[string]interface{}
+	}{
+		{"unchanged", base, false, map[string]interface{}{}},
+		{"hot_option", base + "view_filter: ~d example.com\n", false, map[string]interface{}{"view_filter": "~d example.com"}},
+		{"changed_option", "listen_port: 7777\nmode:\n- reverse:http://127.0.0.1:8080/\nanticache: true\n", false, map[string]interface{}{"anticache": true}},
+		{"restart_option", "listen_port: 7777\nmode:\n- reverse:https://127.0.0.1:8080/\nanticache: false\n", true, map[string]interface{}{"mode": []interface{}{"reverse:https://127.0.0.1:8080/"}}},
+		{"removed_option", "listen_port: 7777\nmode:\n- reverse:http://127.0.0.1:8080/\n", true, map[string]interface{}{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			update, err := diffMitmproxyConfig([]byte(base), []byte(tc.New))
+			require.Nil(err)
+			require.Equal(tc.Restart, update.Restart)
+			require.Equal(tc.Expected, update.Options)
+		})
+	}
+}
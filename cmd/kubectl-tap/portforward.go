@@ -0,0 +1,293 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// portForwardRetryInterval is the pause between reconnection attempts when
+// a port-forward fails while its Pod still appears to be healthy.
+const portForwardRetryInterval = 2 * time.Second
+
+var ErrPortForwardFailed = errors.New("the port-forward could not be established")
+
+// forwardTapPorts port-forwards the given ports to the kubetap Pod of a Deployment
+// until ctx is cancelled. When the Pod is deleted, restarted, or the connection
+// is lost, it waits for a new ready kubetap Pod and re-establishes the
+// port-forwards on the same local ports. readyCh is closed once the first
+// port-forward is ready, and progress is logged to log. A first port-forward that
+// never becomes ready, or local ports that cannot be listened on, are not retried.
+func forwardTapPorts(ctx context.Context, client kubernetes.Interface, config *rest.Config, namespace, deploymentName string, ports []string, readyCh chan struct{}, log io.Writer) error {
+	podsClient := client.CoreV1().Pods(namespace)
+	var reconnecting bool
+	var readyOnce sync.Once
+	for {
+		pod, err := waitForTapPod(ctx, podsClient, deploymentName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		dialer, err := podPortForwardDialer(config, namespace, pod.Name)
+		if err != nil {
+			return err
+		}
+		stopCh := make(chan struct{})
+		fwReadyCh := make(chan struct{})
+		fw, err := portforward.New(dialer, ports, stopCh, fwReadyCh, ioutil.Discard, ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		attemptDone := make(chan struct{})
+		go func(podName string, reconnecting bool) {
+			select {
+			case <-fwReadyCh:
+				if reconnecting {
+					fmt.Fprintf(log, "Port-forwards re-established to Pod %q.\n", podName)
+				}
+				readyOnce.Do(func() { close(readyCh) })
+			case <-attemptDone:
+			}
+		}(pod.Name, reconnecting)
+
+		fwErrCh := make(chan error, 1)
+		go func() {
+			fwErrCh <- fw.ForwardPorts()
+		}()
+		goneCh := watchPodGone(ctx, podsClient, pod.Name, attemptDone)
+
+		select {
+		case <-ctx.Done():
+			close(stopCh)
+			<-fwErrCh
+			close(attemptDone)
+			return nil
+		case fwErr := <-fwErrCh:
+			close(attemptDone)
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ready bool
+			select {
+			case <-fwReadyCh:
+				ready = true
+			default:
+			}
+			if fwErr != nil && ((!ready && !reconnecting) || isListenError(fwErr)) {
+				return fmt.Errorf("%w to Pod %q: %v", ErrPortForwardFailed, pod.Name, fwErr)
+			}
+			if fwErr != nil {
+				fmt.Fprintf(log, "Port-forward to Pod %q failed: %v\n", pod.Name, fwErr)
+			} else {
+				fmt.Fprintf(log, "Lost connection to Pod %q.\n", pod.Name)
+			}
+			// avoid hammering the API server if the Pod is healthy but unreachable
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(portForwardRetryInterval):
+			}
+		case reason := <-goneCh:
+			fmt.Fprintf(log, "Pod %q %s.\n", pod.Name, reason)
+			close(stopCh)
+			<-fwErrCh
+			close(attemptDone)
+		}
+		fmt.Fprintln(log, "Waiting for a ready kubetap Pod to reconnect port-forwards...")
+		reconnecting = true
+	}
+}
+
+// isListenError reports whether a port-forward failed to listen on its local ports, such
+// as when they are used by another process, which retrying does not fix.
+func isListenError(err error) bool {
+	return strings.HasPrefix(err.Error(), "unable to listen on any of the requested ports")
+}
+
+// podPortForwardDialer returns a dialer for the port-forward subresource of a Pod.
+func podPortForwardDialer(config *rest.Config, namespace, podName string) (httpstream.Dialer, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, err
+	}
+	path := "/api/v1/namespaces/" + namespace + "/pods/" + podName + "/portforward"
+	return spdy.NewDialer(upgrader,
+		&http.Client{Transport: transport},
+		http.MethodPost,
+		&url.URL{
+			Scheme: "https",
+			Path:   path,
+			Host:   strings.TrimPrefix(strings.TrimPrefix(config.Host, `http://`), `https://`),
+		},
+	), nil
+}
+
+// waitForTapPod blocks until a ready kubetap Pod for the given Deployment exists,
+// and returns it.
+func waitForTapPod(ctx context.Context, podsClient corev1.PodInterface, deploymentName string) (v1.Pod, error) {
+	for {
+		pods, err := podsClient.List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return v1.Pod{}, err
+		}
+		for _, pod := range pods.Items {
+			if isTapPod(pod, deploymentName) && podReady(pod) {
+				return pod, nil
+			}
+		}
+		w, err := podsClient.Watch(ctx, metav1.ListOptions{
+			ResourceVersion: pods.ResourceVersion,
+		})
+		if err != nil {
+			return v1.Pod{}, err
+		}
+		pod, found := waitForTapPodEvent(ctx, w, deploymentName)
+		w.Stop()
+		if found {
+			return pod, nil
+		}
+		if ctx.Err() != nil {
+			return v1.Pod{}, ctx.Err()
+		}
+		// the watch expired, start over with a fresh list
+	}
+}
+
+// waitForTapPodEvent consumes a Pod watch until a ready kubetap Pod is seen,
+// the watch closes, or ctx is cancelled.
+func waitForTapPodEvent(ctx context.Context, w watch.Interface, deploymentName string) (v1.Pod, bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return v1.Pod{}, false
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return v1.Pod{}, false
+			}
+			if event.Type != watch.Added && event.Type != watch.Modified {
+				continue
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			if isTapPod(*pod, deploymentName) && podReady(*pod) {
+				return *pod, true
+			}
+		}
+	}
+}
+
+// watchPodGone watches a Pod and reports on the returned channel why it can no
+// longer be port-forwarded to: it was deleted, is terminating, or is no longer ready.
+// Watching stops when ctx is cancelled or done is closed.
+func watchPodGone(ctx context.Context, podsClient corev1.PodInterface, podName string, done <-chan struct{}) <-chan string {
+	goneCh := make(chan string, 1)
+	go func() {
+		for {
+			w, err := podsClient.Watch(ctx, metav1.ListOptions{
+				FieldSelector: fields.OneTermEqualSelector("metadata.name", podName).String(),
+			})
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-done:
+					return
+				case <-time.After(portForwardRetryInterval):
+					continue
+				}
+			}
+			reason, closed := podGoneReason(ctx, w, podName, done)
+			w.Stop()
+			if reason != "" {
+				goneCh <- reason
+				return
+			}
+			if !closed {
+				return
+			}
+		}
+	}()
+	return goneCh
+}
+
+// podGoneReason consumes a Pod watch and returns a reason once the Pod goes away.
+// closed is true if the watch itself expired and should be re-established.
+func podGoneReason(ctx context.Context, w watch.Interface, podName string, done <-chan struct{}) (reason string, closed bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-done:
+			return "", false
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return "", true
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok || pod.Name != podName {
+				continue
+			}
+			switch {
+			case event.Type == watch.Deleted:
+				return "was deleted", false
+			case pod.DeletionTimestamp != nil:
+				return "is terminating", false
+			case !podReady(*pod):
+				return "is no longer ready", false
+			}
+		}
+	}
+}
+
+// isTapPod reports whether a Pod carries the tapped annotation for a Deployment.
+func isTapPod(pod v1.Pod, deploymentName string) bool {
+	return pod.GetAnnotations()[annotationIsTapped] == deploymentName
+}
+
+// podReady reports whether all containers of a Pod are ready and the Pod is not terminating.
+func podReady(pod v1.Pod) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.ContainersReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_WaitForTapPod(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Existing []v1.Pod
+		Later    *v1.Pod
+		Expected string
+	}{
+		{"ready", []v1.Pod{tapPod("pod-a", true)}, nil, "pod-a"},
+		{"skip_unready", []v1.Pod{tapPod("pod-a", false), tapPod("pod-b", true)}, nil, "pod-b"},
+		{"skip_other_deployment", []v1.Pod{otherPod("pod-a"), tapPod("pod-b", true)}, nil, "pod-b"},
+		{"replacement", []v1.Pod{tapPod("pod-a", false)}, podPtr(tapPod("pod-b", true)), "pod-b"},
+		{"never_ready", []v1.Pod{tapPod("pod-a", false)}, nil, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fake.NewSimpleClientset()
+			podsClient := fakeClient.CoreV1().Pods("default")
+			for i := range tc.Existing {
+				_, err := podsClient.Create(context.TODO(), &tc.Existing[i], metav1.CreateOptions{})
+				require.Nil(err)
+			}
+			if tc.Later != nil {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					_, _ = podsClient.Create(context.TODO(), tc.Later, metav1.CreateOptions{})
+				}()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			pod, err := waitForTapPod(ctx, podsClient, "sample-deployment")
+			if tc.Expected == "" {
+				require.NotNil(err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Expected, pod.Name)
+		})
+	}
+}
+
+func Test_WatchPodGone(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Mutate   func(*fake.Clientset)
+		Expected string
+	}{
+		{"deleted", func(c *fake.Clientset) {
+			_ = c.CoreV1().Pods("default").Delete(context.TODO(), "pod-a", metav1.DeleteOptions{})
+		}, "was deleted"},
+		{"unready", func(c *fake.Clientset) {
+			pod := tapPod("pod-a", false)
+			_, _ = c.CoreV1().Pods("default").Update(context.TODO(), &pod, metav1.UpdateOptions{})
+		}, "is no longer ready"},
+		{"other_pod_deleted", func(c *fake.Clientset) {
+			_ = c.CoreV1().Pods("default").Delete(context.TODO(), "pod-b", metav1.DeleteOptions{})
+		}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			podA := tapPod("pod-a", true)
+			podB := tapPod("pod-b", true)
+			fakeClient := fake.NewSimpleClientset(&podA, &podB)
+			done := make(chan struct{})
+			defer close(done)
+			goneCh := watchPodGone(context.Background(), fakeClient.CoreV1().Pods("default"), "pod-a", done)
+			time.Sleep(100 * time.Millisecond)
+			tc.Mutate(fakeClient)
+			select {
+			case reason := <-goneCh:
+				require.Equal(tc.Expected, reason)
+			case <-time.After(500 * time.Millisecond):
+				require.Empty(tc.Expected, "Pod was not reported gone")
+			}
+		})
+	}
+}
+
+func Test_ForwardTapPortsFirstAttempt(t *testing.T) {
+	require := require.New(t)
+	// an API server that refuses to upgrade port-forward connections
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	pod := tapPod("pod-a", true)
+	fakeClient := fake.NewSimpleClientset(&pod)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	readyCh := make(chan struct{})
+	err := forwardTapPorts(ctx, fakeClient, &rest.Config{Host: srv.URL}, "default", "sample-deployment", []string{"0:8080"}, readyCh, ioutil.Discard)
+	require.True(errors.Is(err, ErrPortForwardFailed), "expected the first attempt to fail, got %v", err)
+	require.Nil(ctx.Err(), "the port-forward was retried")
+}
+
+func Test_IsListenError(t *testing.T) {
+	require := require.New(t)
+	require.True(isListenError(errors.New("unable to listen on any of the requested ports: [{7777 7777}]")))
+	require.False(isListenError(errors.New("error upgrading connection: 404 Not Found")))
+}
+
+func tapPod(name string, ready bool) v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				annotationIsTapped: "sample-deployment",
+			},
+		},
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{
+				{
+					Type:   v1.ContainersReady,
+					Status: status,
+				},
+			},
+		},
+	}
+}
+
+func otherPod(name string) v1.Pod {
+	pod := tapPod(name, true)
+	pod.Annotations = map[string]string{}
+	return pod
+}
+
+func podPtr(pod v1.Pod) *v1.Pod {
+	return &pod
+}
@@ -0,0 +1,328 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	podSecurityWarnLabel    = "pod-security.kubernetes.io/warn"
+	podSecurityAuditLabel   = "pod-security.kubernetes.io/audit"
+	podSecurityRestricted   = "restricted"
+)
+
+var (
+	ErrPreflightFailed      = errors.New("pre-flight checks failed")
+	ErrAccessDenied         = errors.New("missing RBAC permissions required to tap")
+	ErrServiceExternalName  = errors.New("ExternalName Services cannot be tapped")
+	ErrPortCollision        = errors.New("the target already uses a port reserved by kubetap")
+	ErrDeploymentRollingOut = errors.New("the target Deployment is in the middle of a rollout")
+	ErrPodSecurityViolation = errors.New("the Namespace Pod Security level would reject the kubetap sidecar")
+)
+
+// tapPermissions are the RBAC permissions required to tap a Service.
+var tapPermissions = []authorizationv1.ResourceAttributes{
+	{Verb: "get", Resource: "services"},
+	{Verb: "update", Resource: "services"},
+	{Verb: "list", Group: "apps", Resource: "deployments"},
+	{Verb: "get", Group: "apps", Resource: "deployments"},
+	{Verb: "update", Group: "apps", Resource: "deployments"},
+	{Verb: "create", Resource: "configmaps"},
+	{Verb: "create", Resource: "secrets"},
+	{Verb: "create", Resource: "events"},
+}
+
+// preflightCheck is the outcome of a single pre-flight check. A check with Warn
+// set does not prevent tapping.
+type preflightCheck struct {
+	Name string
+	Err  error
+	Warn bool
+}
+
+// preflightChecks is the outcome of all pre-flight checks for a Service.
+type preflightChecks []preflightCheck
+
+// Err returns the first failed check as an error, or nil if no check failed.
+func (pc preflightChecks) Err() error {
+	for _, c := range pc {
+		if c.Err != nil && !c.Warn {
+			return fmt.Errorf("%s: %w", strings.ToLower(c.Name), c.Err)
+		}
+	}
+	return nil
+}
+
+// Clean is true if every check passed without warnings.
+func (pc preflightChecks) Clean() bool {
+	for _, c := range pc {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Report writes a human readable summary of the checks.
+func (pc preflightChecks) Report(w io.Writer, svcName string) {
+	fmt.Fprintf(w, "Pre-flight checks for Service %q:\n\n", svcName)
+	for _, c := range pc {
+		switch {
+		case c.Err == nil:
+			fmt.Fprintf(w, "  [ok]   %s\n", c.Name)
+		case c.Warn:
+			fmt.Fprintf(w, "  [warn] %s: %v\n", c.Name, c.Err)
+		default:
+			fmt.Fprintf(w, "  [FAIL] %s: %v\n", c.Name, c.Err)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// NewDoctorCommand runs the pre-flight checks for a Service without modifying anything.
+func NewDoctorCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		targetSvcPort := viper.GetInt32("proxyPort")
+		namespace := targetNamespace(viper)
+		exists, err := hasNamespace(client, namespace)
+		if err != nil {
+			return fmt.Errorf("error fetching namespaces: %w", err)
+		}
+		if !exists {
+			return ErrNamespaceNotExist
+		}
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		checks := preflight(client, targetService, targetSvcPort)
+		checks.Report(cmd.OutOrStdout(), targetSvcName)
+		if checks.Err() != nil {
+			return ErrPreflightFailed
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Service %q can be tapped.\n", targetSvcName)
+		return nil
+	}
+}
+
+// preflight checks whether tapping a Service port can succeed, without modifying
+// anything. If port is zero, the port checks are skipped.
+func preflight(client kubernetes.Interface, svc *v1.Service, port int32) preflightChecks {
+	checks := preflightChecks{
+		{Name: "RBAC permissions", Err: checkPermissions(client, svc.Namespace)},
+		{Name: "Service type", Err: checkServiceType(svc)},
+	}
+	if port != 0 {
+		checks = append(checks, preflightCheck{Name: "Service port", Err: checkServicePort(svc, port)})
+	}
+	dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(svc.Namespace), svc.Spec.Selector)
+	checks = append(checks, preflightCheck{Name: "Service selector", Err: err})
+	if err != nil {
+		return checks
+	}
+	checks = append(checks,
+		preflightCheck{Name: "Port collisions", Err: checkPortCollisions(svc, dpl)},
+		preflightCheck{Name: "Deployment rollout", Err: checkRollout(dpl)},
+	)
+	ns, err := client.CoreV1().Namespaces().Get(context.TODO(), svc.Namespace, metav1.GetOptions{})
+	if err != nil {
+		checks = append(checks, preflightCheck{Name: "Pod Security", Err: err, Warn: true})
+		return checks
+	}
+	return append(checks, checkPodSecurity(ns, dpl))
+}
+
+// checkPermissions uses SelfSubjectAccessReviews to verify the current user can tap
+// Services in the Namespace.
+func checkPermissions(client kubernetes.Interface, namespace string) error {
+	var denied []string
+	for _, attrs := range tapPermissions {
+		attrs := attrs
+		attrs.Namespace = namespace
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &attrs,
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("error checking permissions: %w", err)
+		}
+		if !review.Status.Allowed {
+			resource := attrs.Resource
+			if attrs.Group != "" {
+				resource += "." + attrs.Group
+			}
+			denied = append(denied, attrs.Verb+" "+resource)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("%w: cannot %s", ErrAccessDenied, strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// checkServiceType rejects Service types that do not route to Pods.
+func checkServiceType(svc *v1.Service) error {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return ErrServiceExternalName
+	}
+	return nil
+}
+
+// checkServicePort ensures the Service exposes the port to tap.
+func checkServicePort(svc *v1.Service, port int32) error {
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port == port {
+			return nil
+		}
+	}
+	return ErrServiceMissingPort
+}
+
+// checkPortCollisions ensures the ports kubetap adds are not already in use by the
+// Service or the Deployment.
+func checkPortCollisions(svc *v1.Service, dpl k8sappsv1.Deployment) error {
+	reserved := map[int32]bool{
+		kubetapProxyListenPort:       true,
+		kubetapProxyWebInterfacePort: true,
+	}
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port == kubetapProxyWebInterfacePort {
+			return fmt.Errorf("%w: Service port %d", ErrPortCollision, sp.Port)
+		}
+	}
+	for _, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			continue
+		}
+		for _, p := range c.Ports {
+			if reserved[p.ContainerPort] {
+				return fmt.Errorf("%w: container %q port %d", ErrPortCollision, c.Name, p.ContainerPort)
+			}
+		}
+	}
+	return nil
+}
+
+// checkListenPortCollisions ensures no container of the Deployment uses the additional
+// ports the proxy listens on when it taps more than one Service port.
+func checkListenPortCollisions(dpl k8sappsv1.Deployment, upstreams []ProxyUpstream) error {
+	reserved := make(map[int32]bool)
+	for _, u := range upstreams {
+		reserved[u.ListenPort] = true
+	}
+	for _, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			continue
+		}
+		for _, p := range c.Ports {
+			if reserved[p.ContainerPort] {
+				return fmt.Errorf("%w: container %q port %d", ErrPortCollision, c.Name, p.ContainerPort)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRollout ensures the Deployment is not already rolling out, so the tap
+// does not race with another change.
+func checkRollout(dpl k8sappsv1.Deployment) error {
+	if dpl.Generation > dpl.Status.ObservedGeneration || dpl.Status.Replicas > dpl.Status.UpdatedReplicas {
+		return fmt.Errorf("%w: wait for %q to finish rolling out", ErrDeploymentRollingOut, dpl.Name)
+	}
+	return nil
+}
+
+// checkPodSecurity checks the Namespace Pod Security admission labels against the
+// kubetap sidecar. Only the "restricted" level can reject the sidecar.
+func checkPodSecurity(ns *v1.Namespace, dpl k8sappsv1.Deployment) preflightCheck {
+	check := preflightCheck{Name: "Pod Security"}
+	labels := ns.GetLabels()
+	var level string
+	switch {
+	case labels[podSecurityEnforceLabel] == podSecurityRestricted:
+		level = podSecurityEnforceLabel
+	case labels[podSecurityWarnLabel] == podSecurityRestricted:
+		level = podSecurityWarnLabel
+		check.Warn = true
+	case labels[podSecurityAuditLabel] == podSecurityRestricted:
+		level = podSecurityAuditLabel
+		check.Warn = true
+	default:
+		return check
+	}
+	violations := restrictedViolations(dpl.Spec.Template.Spec, MitmproxySidecarContainer)
+	if len(violations) > 0 {
+		check.Err = fmt.Errorf("%w: %s=%s: %s", ErrPodSecurityViolation, level, podSecurityRestricted, strings.Join(violations, ", "))
+	}
+	return check
+}
+
+// restrictedViolations returns the reasons a container would be rejected by the
+// "restricted" Pod Security Standard.
+func restrictedViolations(podSpec v1.PodSpec, c v1.Container) []string {
+	var violations []string
+	psc := podSpec.SecurityContext
+	if psc == nil {
+		psc = &v1.PodSecurityContext{}
+	}
+	sc := c.SecurityContext
+	if sc == nil {
+		sc = &v1.SecurityContext{}
+	}
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		violations = append(violations, "allowPrivilegeEscalation != false")
+	}
+	var dropsAll bool
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Drop {
+			if capability == "ALL" {
+				dropsAll = true
+			}
+		}
+	}
+	if !dropsAll {
+		violations = append(violations, "capabilities not dropped")
+	}
+	runAsNonRoot := psc.RunAsNonRoot != nil && *psc.RunAsNonRoot
+	if sc.RunAsNonRoot != nil {
+		runAsNonRoot = *sc.RunAsNonRoot
+	}
+	if !runAsNonRoot {
+		violations = append(violations, "runAsNonRoot != true")
+	}
+	seccomp := psc.SeccompProfile
+	if sc.SeccompProfile != nil {
+		seccomp = sc.SeccompProfile
+	}
+	if seccomp == nil || (seccomp.Type != v1.SeccompProfileTypeRuntimeDefault && seccomp.Type != v1.SeccompProfileTypeLocalhost) {
+		violations = append(violations, "seccompProfile not set")
+	}
+	return violations
+}
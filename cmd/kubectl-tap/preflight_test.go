@@ -0,0 +1,156 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_Preflight(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Port       int32
+		Clean      bool
+		Err        error
+	}{
+		{"simple", fakeClientUntappedSimple, 80, true, nil},
+		{"no_port", fakeClientUntappedSimple, 0, true, nil},
+		{"missing_port", fakeClientUntappedSimple, 9999, false, ErrServiceMissingPort},
+		{"no_selectors", fakeClientUntappedNoSelectors, 80, false, ErrSelectorsMissing},
+		{"no_deployment", fakeClientUntappedWithoutDeployment, 80, false, ErrServiceSelectorNoMatch},
+		{"rbac_denied", func() *fake.Clientset {
+			namespace := simpleNamespace
+			deployment := simpleDeployment
+			service := simpleService
+			c := fake.NewSimpleClientset(&namespace, &deployment, &service)
+			c.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				review.Status.Allowed = review.Spec.ResourceAttributes.Verb != "update"
+				return true, review, nil
+			})
+			return c
+		}, 80, false, ErrAccessDenied},
+		{"external_name", func() *fake.Clientset {
+			namespace := simpleNamespace
+			deployment := simpleDeployment
+			service := simpleService
+			service.Spec.Type = v1.ServiceTypeExternalName
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, false, ErrServiceExternalName},
+		{"service_port_collision", func() *fake.Clientset {
+			namespace := simpleNamespace
+			deployment := simpleDeployment
+			service := simpleService
+			service.Spec.Ports = append(service.Spec.Ports, v1.ServicePort{Name: "admin", Port: kubetapProxyWebInterfacePort})
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, false, ErrPortCollision},
+		{"container_port_collision", func() *fake.Clientset {
+			namespace := simpleNamespace
+			deployment := simpleDeployment.DeepCopy()
+			deployment.Spec.Template.Spec.Containers[0].Ports = []v1.ContainerPort{{ContainerPort: kubetapProxyListenPort}}
+			service := simpleService
+			return newFakeClientset(&namespace, deployment, &service)
+		}, 80, false, ErrPortCollision},
+		{"mid_rollout", func() *fake.Clientset {
+			namespace := simpleNamespace
+			deployment := simpleDeployment
+			deployment.Generation = 3
+			deployment.Status.ObservedGeneration = 2
+			service := simpleService
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, false, ErrDeploymentRollingOut},
+		{"pod_security_enforce", func() *fake.Clientset {
+			namespace := simpleNamespace
+			namespace.Labels = map[string]string{podSecurityEnforceLabel: podSecurityRestricted}
+			deployment := simpleDeployment
+			service := simpleService
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, false, ErrPodSecurityViolation},
+		{"pod_security_warn", func() *fake.Clientset {
+			namespace := simpleNamespace
+			namespace.Labels = map[string]string{podSecurityWarnLabel: podSecurityRestricted}
+			deployment := simpleDeployment
+			service := simpleService
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, false, nil},
+		{"pod_security_baseline", func() *fake.Clientset {
+			namespace := simpleNamespace
+			namespace.Labels = map[string]string{podSecurityEnforceLabel: "baseline"}
+			deployment := simpleDeployment
+			service := simpleService
+			return newFakeClientset(&namespace, &deployment, &service)
+		}, 80, true, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.ClientFunc()
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			checks := preflight(fakeClient, svc, tc.Port)
+			require.Equal(tc.Clean, checks.Clean())
+			if tc.Err != nil {
+				require.True(errors.Is(checks.Err(), tc.Err), "expected (%q), got (%q)", tc.Err, checks.Err())
+			} else {
+				require.Nil(checks.Err())
+			}
+		})
+	}
+}
+
+func Test_NewDoctorCommand(t *testing.T) {
+	tests := []struct {
+		Name        string
+		ClientFunc  func() *fake.Clientset
+		Port        int32
+		Err         error
+		ExpectedOut string
+	}{
+		{"simple", fakeClientUntappedSimple, 80, nil, "Service \"sample-service\" can be tapped.\n"},
+		{"missing_port", fakeClientUntappedSimple, 9999, ErrPreflightFailed, "[FAIL] Service port"},
+		{"no_namespace_in_cluster", fakeClientUntappedWithoutNamespace, 80, ErrNamespaceNotExist, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.ClientFunc()
+			testViper := viper.New()
+			testViper.Set("proxyPort", tc.Port)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			err := NewDoctorCommand(fakeClient, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+			} else {
+				require.Nil(err)
+			}
+			require.Contains(b.String(), tc.ExpectedOut)
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const defaultReadyTimeout = 90 * time.Second
+
+var (
+	ErrTapNotReady      = errors.New("the kubetap Pod did not become ready in time")
+	ErrRolloutFailed    = errors.New("the Deployment rollout failed")
+	ErrPodUnschedulable = errors.New("the kubetap Pod cannot be scheduled")
+	ErrContainerFailing = errors.New("a container in the kubetap Pod is failing")
+)
+
+// failingContainerReasons are container waiting reasons that will not resolve
+// on their own, so there's no point in waiting out the timeout.
+var failingContainerReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// waitForTapReady watches the rollout of a tapped Deployment and the kubetap Pods
+// it creates, returning the first ready kubetap Pod once the rollout is complete.
+// It fails fast if the Pod cannot be scheduled or a container is failing, and
+// gives up after timeout. Progress messages are passed to progress as the rollout
+// advances.
+func waitForTapReady(ctx context.Context, client kubernetes.Interface, namespace, deploymentName string, timeout time.Duration, progress func(string)) (v1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+	dplInformer := factory.Apps().V1().Deployments()
+	podInformer := factory.Core().V1().Pods()
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+	dplInformer.Informer().AddEventHandler(handler)
+	podInformer.Informer().AddEventHandler(handler)
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), dplInformer.Informer().HasSynced, podInformer.Informer().HasSynced) {
+		return v1.Pod{}, fmt.Errorf("%w: timed out syncing Deployment and Pod state", ErrTapNotReady)
+	}
+
+	var lastStatus string
+	for {
+		dpl, err := dplInformer.Lister().Deployments(namespace).Get(deploymentName)
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				return v1.Pod{}, fmt.Errorf("the Deployment %q was removed while waiting: %w", deploymentName, ErrTapNotReady)
+			}
+			return v1.Pod{}, err
+		}
+		pods, err := podInformer.Lister().Pods(namespace).List(labels.Everything())
+		if err != nil {
+			return v1.Pod{}, err
+		}
+		pod, status, err := tapRolloutStatus(dpl, pods)
+		if err != nil {
+			return v1.Pod{}, err
+		}
+		if pod != nil {
+			return *pod, nil
+		}
+		if status != lastStatus {
+			progress(status)
+			lastStatus = status
+		}
+		select {
+		case <-ctx.Done():
+			return v1.Pod{}, fmt.Errorf("%w after %s (%s)", ErrTapNotReady, timeout, lastStatus)
+		case <-changed:
+		}
+	}
+}
+
+// tapRolloutStatus inspects a tapped Deployment and the Pods in its Namespace. It returns
+// a ready kubetap Pod if the rollout is done, otherwise a description of what is being
+// waited on. An error is returned if the rollout cannot succeed.
+func tapRolloutStatus(dpl *k8sappsv1.Deployment, pods []*v1.Pod) (*v1.Pod, string, error) {
+	var tapPods []*v1.Pod
+	for _, pod := range pods {
+		if isTapPod(*pod, dpl.Name) && pod.DeletionTimestamp == nil {
+			tapPods = append(tapPods, pod)
+		}
+	}
+	for _, pod := range tapPods {
+		if err := podFailure(pod); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, cond := range dpl.Status.Conditions {
+		if cond.Type == k8sappsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+			return nil, "", fmt.Errorf("%w: Deployment %q exceeded its progress deadline", ErrRolloutFailed, dpl.Name)
+		}
+	}
+
+	if dpl.Generation > dpl.Status.ObservedGeneration {
+		return nil, "Waiting for the Deployment update to be observed...", nil
+	}
+	if dpl.Spec.Replicas != nil && dpl.Status.UpdatedReplicas < *dpl.Spec.Replicas {
+		return nil, fmt.Sprintf("Waiting for rollout: %d of %d new replicas updated...", dpl.Status.UpdatedReplicas, *dpl.Spec.Replicas), nil
+	}
+	if dpl.Status.Replicas > dpl.Status.UpdatedReplicas {
+		return nil, fmt.Sprintf("Waiting for rollout: %d old replicas pending termination...", dpl.Status.Replicas-dpl.Status.UpdatedReplicas), nil
+	}
+	if dpl.Status.AvailableReplicas < dpl.Status.UpdatedReplicas {
+		return nil, fmt.Sprintf("Waiting for rollout: %d of %d updated replicas available...", dpl.Status.AvailableReplicas, dpl.Status.UpdatedReplicas), nil
+	}
+
+	for _, pod := range tapPods {
+		if podReady(*pod) && sidecarReady(pod) {
+			return pod, "", nil
+		}
+	}
+	return nil, "Waiting for the kubetap sidecar to become ready...", nil
+}
+
+// podFailure returns an error if a Pod cannot become ready without intervention.
+func podFailure(pod *v1.Pod) error {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse && cond.Reason == v1.PodReasonUnschedulable {
+			return fmt.Errorf("%w: Pod %q: %s", ErrPodUnschedulable, pod.Name, cond.Message)
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Waiting == nil || !failingContainerReasons[cs.State.Waiting.Reason] {
+			continue
+		}
+		return fmt.Errorf("%w: container %q of Pod %q is in %s: %s",
+			ErrContainerFailing, cs.Name, pod.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message)
+	}
+	return nil
+}
+
+// sidecarReady reports whether the kubetap container of a Pod is ready.
+func sidecarReady(pod *v1.Pod) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == kubetapContainerName {
+			return cs.Ready
+		}
+	}
+	return false
+}
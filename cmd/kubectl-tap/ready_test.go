@@ -0,0 +1,161 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_TapRolloutStatus(t *testing.T) {
+	tests := []struct {
+		Name       string
+		Deployment func() *k8sappsv1.Deployment
+		Pods       func() []*v1.Pod
+		Ready      bool
+		Waiting    string
+		Err        error
+	}{
+		{"ready", rolledOutDeployment, readyTapPods, true, "", nil},
+		{"generation_not_observed", func() *k8sappsv1.Deployment {
+			dpl := rolledOutDeployment()
+			dpl.Generation = 2
+			return dpl
+		}, readyTapPods, false, "Waiting for the Deployment update to be observed...", nil},
+		{"replicas_not_updated", func() *k8sappsv1.Deployment {
+			dpl := rolledOutDeployment()
+			dpl.Status.UpdatedReplicas = 0
+			return dpl
+		}, readyTapPods, false, "Waiting for rollout: 0 of 1 new replicas updated...", nil},
+		{"old_replicas", func() *k8sappsv1.Deployment {
+			dpl := rolledOutDeployment()
+			dpl.Status.Replicas = 2
+			return dpl
+		}, readyTapPods, false, "Waiting for rollout: 1 old replicas pending termination...", nil},
+		{"sidecar_not_ready", rolledOutDeployment, func() []*v1.Pod {
+			pods := readyTapPods()
+			pods[0].Status.ContainerStatuses[0].Ready = false
+			return pods
+		}, false, "Waiting for the kubetap sidecar to become ready...", nil},
+		{"no_tap_pods", rolledOutDeployment, func() []*v1.Pod { return nil }, false, "Waiting for the kubetap sidecar to become ready...", nil},
+		{"image_pull_backoff", rolledOutDeployment, func() []*v1.Pod {
+			pods := readyTapPods()
+			pods[0].Status.ContainerStatuses[0].State.Waiting = &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}
+			return pods
+		}, false, "", ErrContainerFailing},
+		{"crash_loop", rolledOutDeployment, func() []*v1.Pod {
+			pods := readyTapPods()
+			pods[0].Status.ContainerStatuses[0].State.Waiting = &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+			return pods
+		}, false, "", ErrContainerFailing},
+		{"unschedulable", rolledOutDeployment, func() []*v1.Pod {
+			pods := readyTapPods()
+			pods[0].Status.Conditions = append(pods[0].Status.Conditions, v1.PodCondition{
+				Type:    v1.PodScheduled,
+				Status:  v1.ConditionFalse,
+				Reason:  v1.PodReasonUnschedulable,
+				Message: "0/3 nodes are available",
+			})
+			return pods
+		}, false, "", ErrPodUnschedulable},
+		{"progress_deadline", func() *k8sappsv1.Deployment {
+			dpl := rolledOutDeployment()
+			dpl.Status.Conditions = []k8sappsv1.DeploymentCondition{
+				{Type: k8sappsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"},
+			}
+			return dpl
+		}, readyTapPods, false, "", ErrRolloutFailed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			pod, waiting, err := tapRolloutStatus(tc.Deployment(), tc.Pods())
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			require.Equal(tc.Ready, pod != nil)
+			require.Equal(tc.Waiting, waiting)
+		})
+	}
+}
+
+func Test_WaitForTapReady(t *testing.T) {
+	tests := []struct {
+		Name string
+		Pods func() []*v1.Pod
+		Err  error
+	}{
+		{"ready", readyTapPods, nil},
+		{"failing", func() []*v1.Pod {
+			pods := readyTapPods()
+			pods[0].Status.ContainerStatuses[0].State.Waiting = &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}
+			return pods
+		}, ErrContainerFailing},
+		{"timeout", func() []*v1.Pod { return nil }, ErrTapNotReady},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fake.NewSimpleClientset(rolledOutDeployment())
+			for _, pod := range tc.Pods() {
+				require.Nil(fakeClient.Tracker().Add(pod))
+			}
+			var messages []string
+			pod, err := waitForTapReady(context.Background(), fakeClient, "default", "sample-deployment", time.Second, func(msg string) {
+				messages = append(messages, msg)
+			})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				require.NotEmpty(err.Error())
+				return
+			}
+			require.Nil(err)
+			require.Equal("pod-a", pod.Name)
+		})
+	}
+}
+
+func rolledOutDeployment() *k8sappsv1.Deployment {
+	dpl := simpleDeploymentTapped.DeepCopy()
+	replicas := int32(1)
+	dpl.Generation = 1
+	dpl.Spec.Replicas = &replicas
+	dpl.Status = k8sappsv1.DeploymentStatus{
+		ObservedGeneration: 1,
+		Replicas:           1,
+		UpdatedReplicas:    1,
+		AvailableReplicas:  1,
+	}
+	return dpl
+}
+
+func readyTapPods() []*v1.Pod {
+	pod := tapPod("pod-a", true)
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{
+		{
+			Name:  kubetapContainerName,
+			Ready: true,
+		},
+	}
+	return []*v1.Pod{&pod}
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var ErrRedactPatternInvalid = errors.New("invalid redaction pattern")
+
+// redactStreamOptions are the mitmproxy options for streaming flows to a file. While
+// redaction is enabled the addon streams the redacted flows instead of mitmproxy.
+var redactStreamOptions = map[string]bool{
+	"save_stream_file":   true,
+	"save_stream_filter": true,
+}
+
+// redactConfig is the configuration of the redact addon.
+type redactConfig struct {
+	// Defaults enables the built-in rules for auth headers, cookies, JWTs and tokens
+	Defaults bool `json:"defaults"`
+	// Patterns are regular expressions whose matches, or groups if they have any, are redacted
+	Patterns     []string `json:"patterns,omitempty"`
+	StreamFile   string   `json:"stream_file,omitempty"`
+	StreamFilter string   `json:"stream_filter,omitempty"`
+}
+
+// enabled reports whether the addon redacts anything.
+func (c redactConfig) enabled() bool {
+	return c.Defaults || len(c.Patterns) > 0
+}
+
+// newRedactConfig returns the redact addon configuration of a tap.
+func newRedactConfig(proxyOpts ProxyOptions) redactConfig {
+	config := redactConfig{
+		Defaults: !proxyOpts.NoDefaultRedaction,
+		Patterns: proxyOpts.Redact,
+	}
+	if !config.enabled() {
+		return config
+	}
+	if v, ok := proxyOpts.ExtraOptions["save_stream_file"].(string); ok {
+		config.StreamFile = v
+	}
+	if v, ok := proxyOpts.ExtraOptions["save_stream_filter"].(string); ok {
+		config.StreamFilter = v
+	}
+	return config
+}
+
+// redactConfigData renders the redact addon configuration for the tap ConfigMap, and
+// returns the extra mitmproxy options without those handled by the addon.
+func redactConfigData(proxyOpts ProxyOptions) ([]byte, map[string]interface{}, error) {
+	config := newRedactConfig(proxyOpts)
+	extra := proxyOpts.ExtraOptions
+	if config.enabled() {
+		extra = make(map[string]interface{}, len(proxyOpts.ExtraOptions))
+		for k, v := range proxyOpts.ExtraOptions {
+			if !redactStreamOptions[k] {
+				extra[k] = v
+			}
+		}
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, extra, nil
+}
+
+// redactPatternsFromFlags validates --redact regular expressions. Empty values are
+// dropped, so that an empty --redact value given to kubectl tap update removes the
+// current patterns. The addon uses Python's re module, which accepts the RE2 syntax
+// checked here.
+func redactPatternsFromFlags(patterns []string) ([]string, error) {
+	var valid []string
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrRedactPatternInvalid, p, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("%w: %q matches the empty string", ErrRedactPatternInvalid, p)
+		}
+		valid = append(valid, p)
+	}
+	return valid, nil
+}
+
+// mitmproxyRedactAddonSource redacts copies of flows once the proxy is done with them, and
+// never the flows themselves, so that the upstream, the client and other addons see the
+// real values. The copies are streamed to the stream file and replace the flows in the web
+// interface. Flows in flight are shown unredacted until they complete.
+const mitmproxyRedactAddonSource = `# Managed by kubetap, changes are overwritten.
+import asyncio
+import logging
+import os
+import re
+
+from mitmproxy import ctx, flowfilter, io
+
+from ` + mitmproxyAddonModule + ` import ConfigFile
+
+REDACTED = "[REDACTED]"
+# seconds between checks whether a flow was sent to the client
+COMPLETE_INTERVAL = 0.1
+SECRET_HEADERS = {
+    "api-key", "authorization", "proxy-authorization", "x-amz-security-token", "x-api-key",
+    "x-auth-token", "x-access-token", "x-csrf-token", "x-xsrf-token",
+}
+DEFAULT_PATTERNS = [
+    # JSON Web Tokens
+    re.compile(r"eyJ[A-Za-z0-9_-]{4,}\.eyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*"),
+    # credentials in query strings and form bodies
+    re.compile(r"(?i)(?:^|[?&\s])(?:access_token|api_?key|client_secret|id_token|password|refresh_token|token)=([^&\s]+)"),
+    # credentials in JSON bodies
+    re.compile(r'(?i)"(?:access_token|api_?key|client_secret|id_token|password|refresh_token|secret|token)"\s*:\s*"([^"]*)"'),
+]
+
+
+def substitute(pattern, text):
+    def replace(m):
+        if not m.re.groups:
+            return REDACTED
+        out, last = [], m.start()
+        for i in range(1, m.re.groups + 1):
+            if m.start(i) < 0:
+                continue
+            out.append(text[last:m.start(i)])
+            out.append(REDACTED)
+            last = m.end(i)
+        out.append(text[last:m.end()])
+        return "".join(out)
+
+    return pattern.sub(replace, text)
+
+
+def parse_config(config):
+    try:
+        return config, [re.compile(p) for p in config.get("patterns") or []]
+    except re.error as e:
+        raise ValueError("invalid pattern: %s" % e)
+
+
+def redact_cookies(value, set_cookie):
+    parts = value.split(";")
+    if set_cookie:
+        # only the first pair is the cookie, the others are its attributes
+        return ";".join([parts[0].split("=", 1)[0] + "=" + REDACTED] + parts[1:])
+    return ";".join(p.split("=", 1)[0] + "=" + REDACTED if "=" in p else p for p in parts)
+
+
+class KubetapRedact:
+    def __init__(self):
+        self.file = ConfigFile("` + mitmproxyRedactFile + `", "redaction rules", {}, parse_config)
+        self.config = {}
+        self.patterns = []
+        self.stream = None
+        self.stream_file = None
+        self.stream_filter = None
+
+    def load_config(self):
+        if not self.file.load():
+            return
+        self.config, patterns = self.file.value
+        self.patterns = (DEFAULT_PATTERNS if self.config.get("defaults") else []) + patterns
+        self.open_stream(self.config.get("stream_file"), self.config.get("stream_filter"))
+
+    def open_stream(self, path, filt):
+        try:
+            self.stream_filter = flowfilter.parse(filt) if filt else None
+        except Exception as e:
+            logging.error("kubetap: invalid stream filter %r: %s", filt, e)
+            return
+        if path == self.stream_file and self.stream is not None:
+            return
+        self.close_stream()
+        self.stream_file = path
+        if not path:
+            return
+        mode = "ab" if path.startswith("+") else "wb"
+        path = os.path.expanduser(path.lstrip("+"))
+        try:
+            self.stream = io.FlowWriter(open(path, mode))
+            logging.info("kubetap: streaming redacted flows to %s", path)
+        except Exception as e:
+            logging.error("kubetap: cannot stream flows to %s: %s", path, e)
+
+    def close_stream(self):
+        if self.stream is not None:
+            self.stream.fo.close()
+        self.stream = None
+
+    def enabled(self):
+        self.load_config()
+        return self.config.get("defaults") or self.patterns
+
+    def redact_text(self, text):
+        for p in self.patterns:
+            text = substitute(p, text)
+        return text
+
+    def redact_headers(self, headers):
+        for name in list(headers.keys()):
+            values = headers.get_all(name)
+            lower = name.lower()
+            if self.config.get("defaults") and lower in SECRET_HEADERS:
+                # keep the scheme of Authorization headers for debugging
+                values = [v.split(" ", 1)[0] + " " + REDACTED if " " in v else REDACTED for v in values]
+            elif self.config.get("defaults") and lower in ("cookie", "set-cookie"):
+                values = [redact_cookies(v, lower == "set-cookie") for v in values]
+            else:
+                values = [self.redact_text(v) for v in values]
+            headers.set_all(name, values)
+
+    def redact_message(self, message):
+        self.redact_headers(message.headers)
+        try:
+            text = message.get_text(strict=True)
+        except ValueError:
+            # binary or undecodable bodies are left as is
+            return
+        if text:
+            redacted = self.redact_text(text)
+            if redacted != text:
+                message.text = redacted
+
+    def redacted(self, flow):
+        # later addons and the client must see the real values, so only a copy is redacted
+        flow = flow.copy()
+        request = flow.request
+        redacted = self.redact_text(request.path)
+        if redacted != request.path:
+            request.path = redacted
+        self.redact_message(request)
+        if flow.response is not None:
+            self.redact_message(flow.response)
+        return flow
+
+    def complete(self, flow):
+        if getattr(flow, "live", False):
+            # the client has yet to receive the flow, check again once it has
+            asyncio.get_event_loop().call_later(COMPLETE_INTERVAL, self.complete, flow)
+            return
+        if flow.metadata.get("kubetap_redacted") or not self.enabled():
+            return
+        flow.metadata["kubetap_redacted"] = True
+        redacted = self.redacted(flow)
+        self.save(redacted)
+        self.show(flow, redacted)
+
+    def show(self, flow, redacted):
+        # the web interface shows the redacted copy in place of the flow
+        view = ctx.master.addons.get("view")
+        if view is None or view.get_by_id(flow.id) is None:
+            return
+        view.remove([flow])
+        view.add([redacted])
+
+    def save(self, flow):
+        if self.stream is None:
+            return
+        if self.stream_filter is None or self.stream_filter(flow):
+            self.stream.add(flow)
+
+    def response(self, flow):
+        self.complete(flow)
+
+    def error(self, flow):
+        self.complete(flow)
+
+    def done(self):
+        self.close_stream()
+
+
+addons = [KubetapRedact()]
+`
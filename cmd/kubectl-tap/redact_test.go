@@ -0,0 +1,188 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func Test_RedactPatternsFromFlags(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Patterns []string
+		Expected []string
+		Err      error
+	}{
+		{"none", []string{}, nil, nil},
+		{"patterns", []string{`ssn=(\d+)`, `X-Tenant: \w+`}, []string{`ssn=(\d+)`, `X-Tenant: \w+`}, nil},
+		{"clear", []string{""}, nil, nil},
+		{"invalid", []string{`ssn=(\d+`}, nil, ErrRedactPatternInvalid},
+		{"empty_match", []string{`\d*`}, nil, ErrRedactPatternInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			patterns, err := redactPatternsFromFlags(tc.Patterns)
+			if tc.Err != nil {
+				require.True(t, errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tc.Expected, patterns)
+		})
+	}
+}
+
+func Test_NewRedactConfig(t *testing.T) {
+	require := require.New(t)
+	stream := map[string]interface{}{"save_stream_file": "+/tmp/flows", "save_stream_filter": "~u /api", "anticache": true}
+	require.Equal(redactConfig{Defaults: true}, newRedactConfig(ProxyOptions{}))
+	require.Equal(redactConfig{Defaults: true, StreamFile: "+/tmp/flows", StreamFilter: "~u /api"}, newRedactConfig(ProxyOptions{ExtraOptions: stream}))
+	require.Equal(redactConfig{Patterns: []string{"a+"}, StreamFile: "+/tmp/flows", StreamFilter: "~u /api"},
+		newRedactConfig(ProxyOptions{ExtraOptions: stream, Redact: []string{"a+"}, NoDefaultRedaction: true}))
+	// without redaction mitmproxy streams the flows itself
+	require.Equal(redactConfig{}, newRedactConfig(ProxyOptions{ExtraOptions: stream, NoDefaultRedaction: true}))
+
+	_, extra, err := redactConfigData(ProxyOptions{ExtraOptions: stream})
+	require.Nil(err)
+	require.Equal(map[string]interface{}{"anticache": true}, extra)
+	_, extra, err = redactConfigData(ProxyOptions{ExtraOptions: stream, NoDefaultRedaction: true})
+	require.Nil(err)
+	require.Equal(stream, extra)
+}
+
+func Test_NewTapCommandRedact(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("redact", []string{`ssn=(\d+)`})
+	testViper.Set("proxySet", []string{"save_stream_file=/tmp/flows"})
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal(redactConfig{Defaults: true, Patterns: []string{`ssn=(\d+)`}, StreamFile: "/tmp/flows"}, getConfigMapFile(t, fakeClient, mitmproxyRedactFile, &redactConfig{}))
+	require.NotContains(getMitmproxyConfig(t, fakeClient), "save_stream_file")
+
+	// turning redaction off hands streaming back to mitmproxy
+	testViper = viper.New()
+	testViper.Set("redact", []string{""})
+	testViper.Set("redactDefaults", false)
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	require.Equal(redactConfig{}, getConfigMapFile(t, fakeClient, mitmproxyRedactFile, &redactConfig{}))
+	require.Equal("/tmp/flows", getMitmproxyConfig(t, fakeClient)["save_stream_file"])
+
+	testViper = viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("redact", []string{"("})
+	err := NewTapCommand(fakeClientUntappedSimple(), &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+	require.True(errors.Is(err, ErrRedactPatternInvalid), "expected (%q), got (%q)", ErrRedactPatternInvalid, err)
+}
+
+// redactAddonHarness runs the redact addon against mitmproxy test flows, with a proxy
+// whose later addon yields to the event loop before the response is sent to the client.
+const redactAddonHarness = `import asyncio
+import sys
+
+sys.path.insert(0, sys.argv[1])
+
+from mitmproxy import io
+from mitmproxy.addons import view
+from mitmproxy.test import taddons, tflow
+
+import kubetap_redact
+
+AUTHORIZATION = "Bearer s3cr3t-t0k3n"
+SET_COOKIE = "session=abc123; Path=/"
+
+
+async def main():
+    v = view.View()
+    addon = kubetap_redact.addons[0]
+    with taddons.context(v, addon):
+        f = tflow.tflow(resp=True)
+        f.request.path = "/login?token=abc123"
+        f.request.headers["Authorization"] = AUTHORIZATION
+        f.response.headers["Set-Cookie"] = SET_COOKIE
+        f.response.text = '{"password": "hunter2"}'
+        f.live = True
+        v.add([f])
+
+        addon.response(f)
+        await asyncio.sleep(0.3)
+        # the client has yet to receive the flow, which must be left alone
+        assert f.request.headers["Authorization"] == AUTHORIZATION, f.request.headers
+        assert f.response.headers["Set-Cookie"] == SET_COOKIE, f.response.headers
+        assert list(v) == [f], list(v)
+
+        f.live = False
+        await asyncio.sleep(0.3)
+        assert f.request.headers["Authorization"] == AUTHORIZATION, f.request.headers
+        assert f.request.path == "/login?token=abc123", f.request.path
+        assert f.response.headers["Set-Cookie"] == SET_COOKIE, f.response.headers
+        assert "hunter2" in f.response.text
+        shown = list(v)
+        assert len(shown) == 1 and shown[0] is not f, shown
+        for flow in shown + [addon_stream(addon)]:
+            assert flow.request.headers["Authorization"] == "Bearer [REDACTED]", flow.request.headers
+            assert flow.request.path == "/login?token=[REDACTED]", flow.request.path
+            assert flow.response.headers["Set-Cookie"] == "session=[REDACTED]; Path=/", flow.response.headers
+            assert "hunter2" not in flow.response.text, flow.response.text
+
+        # an error after the response is not redacted twice
+        addon.error(f)
+        await asyncio.sleep(0.3)
+        assert len(list(v)) == 1, list(v)
+        addon.done()
+
+
+def addon_stream(addon):
+    with open(addon.stream.fo.name, "rb") as fo:
+        flows = list(io.FlowReader(fo).stream())
+    assert len(flows) == 1, flows
+    return flows[0]
+
+
+asyncio.run(main())
+print("ok")
+`
+
+func Test_RedactAddon(t *testing.T) {
+	if err := exec.Command("python3", "-c", "import mitmproxy.test.taddons").Run(); err != nil {
+		t.Skip("mitmproxy is not installed")
+	}
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap-redact")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	config, err := json.Marshal(redactConfig{Defaults: true, StreamFile: filepath.Join(dir, "flows.mitm")})
+	require.Nil(err)
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, mitmproxyRedactFile), config, 0600))
+	writeBundledAddons(t, dir)
+	harness := filepath.Join(dir, "harness.py")
+	require.Nil(ioutil.WriteFile(harness, []byte(redactAddonHarness), 0600))
+	out, err := exec.Command("python3", harness, dir).CombinedOutput()
+	require.Nil(err, string(out))
+	require.Contains(string(out), "ok")
+}
@@ -0,0 +1,392 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	replayModeClient = "client"
+	replayModeServer = "server"
+
+	// mitmproxyReplayFile is where recorded flows are pushed to in the kubetap container.
+	// The confdir is the only directory of the image that any user can write to.
+	mitmproxyReplayFile = "/home/mitmproxy/.mitmproxy/kubetap-replay.flows"
+	// mitmproxyReplayAddonFile compares the responses of a client replay with the recording.
+	mitmproxyReplayAddonFile = "/home/mitmproxy/.mitmproxy/kubetap_replay.py"
+	// mitmproxyReplayConfDir keeps the replaying mitmdump from loading the tap's config.yaml,
+	// which would apply the tap's scripts and rewrite rules to the replayed requests.
+	mitmproxyReplayConfDir = "/tmp/kubetap-replay"
+
+	// replayResultPrefix marks the lines of the replay addon output holding results.
+	replayResultPrefix = "kubetap-replay: "
+	// replayDiffValueLength truncates the values shown in body differences.
+	replayDiffValueLength = 40
+)
+
+var (
+	ErrReplayModeInvalid = errors.New("--mode must be one of " + replayModeClient + " or " + replayModeServer)
+	ErrReplayMismatch    = errors.New("replayed responses differ from the recording")
+)
+
+// replayResponse is a response as reported by the replay addon.
+type replayResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        string `json:"body"`
+}
+
+// replayResult pairs the response to a replayed request with the recorded one.
+type replayResult struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Recorded is nil if the recording has no response for the request
+	Recorded *replayResponse `json:"recorded"`
+	// Replayed is nil if the request failed, see Error
+	Replayed *replayResponse `json:"replayed"`
+	Error    string          `json:"error"`
+}
+
+// diff describes how the replayed response differs from the recorded one. Requests
+// without a recorded response cannot differ.
+func (r replayResult) diff() []string {
+	if r.Error != "" {
+		return []string{"error: " + r.Error}
+	}
+	if r.Recorded == nil || r.Replayed == nil {
+		return nil
+	}
+	var diffs []string
+	if r.Recorded.Status != r.Replayed.Status {
+		diffs = append(diffs, fmt.Sprintf("status %d -> %d", r.Recorded.Status, r.Replayed.Status))
+	}
+	if r.Recorded.ContentType != r.Replayed.ContentType {
+		diffs = append(diffs, fmt.Sprintf("content type %q -> %q", r.Recorded.ContentType, r.Replayed.ContentType))
+	}
+	if d := bodyDiff(r.Replayed.ContentType, r.Recorded.Body, r.Replayed.Body); d != "" {
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// bodyDiff describes the first difference between two bodies. JSON bodies are compared
+// by value, so that key order and whitespace do not count as differences.
+func bodyDiff(contentType, recorded, replayed string) string {
+	if recorded == replayed {
+		return ""
+	}
+	if strings.Contains(contentType, "json") {
+		var a, b interface{}
+		if json.Unmarshal([]byte(recorded), &a) == nil && json.Unmarshal([]byte(replayed), &b) == nil && reflect.DeepEqual(a, b) {
+			return ""
+		}
+	}
+	recordedLines, replayedLines := strings.Split(recorded, "\n"), strings.Split(replayed, "\n")
+	for i := 0; ; i++ {
+		var a, b string
+		if i < len(recordedLines) {
+			a = recordedLines[i]
+		}
+		if i < len(replayedLines) {
+			b = replayedLines[i]
+		}
+		if a != b {
+			return fmt.Sprintf("body line %d %q -> %q", i+1, truncate(a, replayDiffValueLength), truncate(b, replayDiffValueLength))
+		}
+	}
+}
+
+// truncate shortens s to n characters, marking where it was cut.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
+// parseReplayResults reads the results from the output of the replay addon, skipping
+// anything else mitmdump prints.
+func parseReplayResults(output []byte) ([]replayResult, error) {
+	var results []replayResult
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), len(output)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, replayResultPrefix) {
+			continue
+		}
+		var result replayResult
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, replayResultPrefix)), &result); err != nil {
+			return nil, fmt.Errorf("error reading replay result: %w", err)
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
+
+// replayCommand is the mitmdump invocation replaying the pushed flows against the
+// tapped container, with the upstream TLS settings of the tap.
+func replayCommand(proxyOpts ProxyOptions) ([]string, error) {
+	config, err := newMitmproxyConfig(proxyOpts)
+	if err != nil {
+		return nil, err
+	}
+	command := []string{"mitmdump", "--quiet",
+		"--client-replay", mitmproxyReplayFile,
+		"--scripts", mitmproxyReplayAddonFile,
+		"--set", "server=false",
+		"--set", "confdir=" + mitmproxyReplayConfDir,
+		"--set", "kubetap_recording=" + mitmproxyReplayFile,
+	}
+	if config.SSLInsecure {
+		command = append(command, "--set", "ssl_insecure=true")
+	}
+	if config.ClientCerts != "" {
+		command = append(command, "--set", "client_certs="+config.ClientCerts)
+	}
+	if config.SSLVerifyUpstreamTrustedCA != "" {
+		command = append(command, "--set", "ssl_verify_upstream_trusted_ca="+config.SSLVerifyUpstreamTrustedCA)
+	}
+	return command, nil
+}
+
+// NewReplayCommand replays recorded flows through the proxy tapping a Service. In client
+// mode the recorded requests are sent to the tapped container and the responses are
+// compared with the recording. In server mode the proxy answers clients with the
+// recorded responses until stopped or restarted.
+func NewReplayCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		mode := viper.GetString("replayMode")
+		if mode == "" {
+			mode = replayModeClient
+		}
+		if mode != replayModeClient && mode != replayModeServer {
+			return ErrReplayModeInvalid
+		}
+		stop := viper.GetBool("replayStop")
+		if stop && mode != replayModeServer {
+			return errors.New("--stop only applies to --mode " + replayModeServer)
+		}
+		var flows []byte
+		if !stop {
+			from := viper.GetString("replayFrom")
+			if from == "" {
+				return errors.New("--from must be set to a file of recorded flows")
+			}
+			var err error
+			flows, err = ioutil.ReadFile(from)
+			if err != nil {
+				return fmt.Errorf("error reading recorded flows: %w", err)
+			}
+		}
+
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if targetService.Annotations[annotationOriginalTargetPort] == "" {
+			return ErrServiceNotTapped
+		}
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+		proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+		if proxyOpts.Protocol != "" && proxyOpts.Protocol != protocolHTTP {
+			return fmt.Errorf("replay is only supported for %s taps", protocolHTTP)
+		}
+		pods, err := listReadyTapPods(client.CoreV1().Pods(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+		password, err := webPassword(client.CoreV1().Secrets(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case stop:
+			for _, pod := range pods {
+				if err := setPodMitmwebOptions(config, namespace, pod.Name, password, map[string]interface{}{"server_replay": []string{}}); err != nil {
+					return fmt.Errorf("Pod %q: %w", pod.Name, err)
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Service %q is no longer served recorded responses.\n", targetSvcName)
+			return nil
+		case mode == replayModeServer:
+			options := map[string]interface{}{
+				"server_replay":       []string{mitmproxyReplayFile},
+				"server_replay_nopop": true,
+			}
+			for _, pod := range pods {
+				if err := writeTapPodFile(config, namespace, pod.Name, mitmproxyReplayFile, flows); err != nil {
+					return fmt.Errorf("error pushing recorded flows to Pod %q: %w", pod.Name, err)
+				}
+				if err := setPodMitmwebOptions(config, namespace, pod.Name, password, options); err != nil {
+					return fmt.Errorf("Pod %q: %w", pod.Name, err)
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Clients of Service %q are now served the recorded responses, requests without a recording are forwarded.\n", targetSvcName)
+			fmt.Fprintf(cmd.OutOrStdout(), "Stop with \"kubectl tap replay %s --mode %s --stop\", restarting the proxy also stops it.\n", targetSvcName, replayModeServer)
+			return nil
+		}
+
+		command, err := replayCommand(proxyOpts)
+		if err != nil {
+			return err
+		}
+		pod := pods[0]
+		if err := writeTapPodFile(config, namespace, pod.Name, mitmproxyReplayFile, flows); err != nil {
+			return fmt.Errorf("error pushing recorded flows to Pod %q: %w", pod.Name, err)
+		}
+		if err := writeTapPodFile(config, namespace, pod.Name, mitmproxyReplayAddonFile, []byte(mitmproxyReplayAddonSource)); err != nil {
+			return fmt.Errorf("error pushing the replay addon to Pod %q: %w", pod.Name, err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Replaying recorded requests against Pod %q...\n", pod.Name)
+		output, err := execTapPod(config, namespace, pod.Name, command, nil)
+		if err != nil {
+			return fmt.Errorf("error replaying flows: %w", err)
+		}
+		results, err := parseReplayResults(output)
+		if err != nil {
+			return err
+		}
+		if differing := printReplayResults(cmd, targetSvcName, results); differing > 0 {
+			return fmt.Errorf("%w: %d of %d responses", ErrReplayMismatch, differing, len(results))
+		}
+		return nil
+	}
+}
+
+// writeTapPodFile writes data to a file in the kubetap container of a Pod.
+func writeTapPodFile(config *rest.Config, namespace, podName, path string, data []byte) error {
+	_, err := execTapPod(config, namespace, podName, []string{"sh", "-c", "cat > '" + path + "'"}, bytes.NewReader(data))
+	return err
+}
+
+// printReplayResults lists the replayed requests and returns how many responses differ
+// from the recording.
+func printReplayResults(cmd *cobra.Command, targetSvcName string, results []replayResult) int {
+	if len(results) == 0 {
+		fmt.Fprintf(cmd.OutOrStdout(), "The recording holds no HTTP requests to replay.\n")
+		return 0
+	}
+	var differing int
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tURL\tRECORDED\tREPLAYED\tRESULT")
+	for _, r := range results {
+		recorded, replayed, result := "-", "-", "ok"
+		if r.Recorded != nil {
+			recorded = fmt.Sprint(r.Recorded.Status)
+		} else {
+			result = "not recorded"
+		}
+		if r.Replayed != nil {
+			replayed = fmt.Sprint(r.Replayed.Status)
+		}
+		if diffs := r.diff(); len(diffs) > 0 {
+			differing++
+			result = strings.Join(diffs, "; ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Method, r.URL, recorded, replayed, result)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+	fmt.Fprintf(cmd.OutOrStdout(), "Replayed %d requests to Service %q, %d responses differ from the recording.\n", len(results), targetSvcName, differing)
+	return differing
+}
+
+// mitmproxyReplayAddonSource reports each response of a client replay next to the
+// response recorded for the same request, matched in recording order.
+const mitmproxyReplayAddonSource = `# Managed by kubetap, changes are overwritten.
+import collections
+import json
+
+from mitmproxy import ctx, io
+
+PREFIX = "` + replayResultPrefix + `"
+
+
+def key(request):
+    return (request.method, request.url, request.get_content(strict=False))
+
+
+def message(response):
+    if response is None:
+        return None
+    return {
+        "status": response.status_code,
+        "content_type": response.headers.get("content-type", ""),
+        "body": (response.get_content(strict=False) or b"").decode("utf-8", "replace"),
+    }
+
+
+class KubetapReplay:
+    def __init__(self):
+        self.recorded = collections.defaultdict(collections.deque)
+
+    def load(self, loader):
+        loader.add_option("kubetap_recording", str, "", "Flows to compare replayed responses with.")
+
+    def configure(self, updated):
+        if "kubetap_recording" not in updated or not ctx.options.kubetap_recording:
+            return
+        with open(ctx.options.kubetap_recording, "rb") as f:
+            for flow in io.FlowReader(f).stream():
+                if hasattr(flow, "request"):
+                    self.recorded[key(flow.request)].append(flow.response)
+
+    def report(self, flow, error=""):
+        recorded = self.recorded.get(key(flow.request))
+        print(PREFIX + json.dumps({
+            "method": flow.request.method,
+            "url": flow.request.url,
+            "recorded": message(recorded.popleft() if recorded else None),
+            "replayed": message(flow.response),
+            "error": error,
+        }), flush=True)
+
+    def response(self, flow):
+        if flow.is_replay == "request":
+            self.report(flow)
+
+    def error(self, flow):
+        if flow.is_replay == "request":
+            self.report(flow, flow.error.msg)
+
+
+addons = [KubetapReplay()]
+`
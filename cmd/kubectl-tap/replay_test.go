@@ -0,0 +1,140 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ReplayResultDiff(t *testing.T) {
+	ok := &replayResponse{Status: 200, ContentType: "application/json", Body: `{"id": 1, "name": "a"}`}
+	tests := []struct {
+		Name     string
+		Result   replayResult
+		Expected []string
+	}{
+		{"equal", replayResult{Recorded: ok, Replayed: ok}, nil},
+		{"json_reordered", replayResult{Recorded: ok, Replayed: &replayResponse{Status: 200, ContentType: "application/json", Body: `{"name":"a","id":1}`}}, nil},
+		{"not_recorded", replayResult{Replayed: ok}, nil},
+		{"status", replayResult{Recorded: ok, Replayed: &replayResponse{Status: 500, ContentType: "application/json", Body: ok.Body}}, []string{"status 200 -> 500"}},
+		{"content_type", replayResult{Recorded: ok, Replayed: &replayResponse{Status: 200, ContentType: "text/plain", Body: ok.Body}}, []string{`content type "application/json" -> "text/plain"`}},
+		{"json_value", replayResult{Recorded: ok, Replayed: &replayResponse{Status: 200, ContentType: "application/json", Body: `{"id": 1, "name": "b"}`}}, []string{`body line 1 "{\"id\": 1, \"name\": \"a\"}" -> "{\"id\": 1, \"name\": \"b\"}"`}},
+		{"text_line", replayResult{
+			Recorded: &replayResponse{Status: 200, Body: "a\nb\nc"},
+			Replayed: &replayResponse{Status: 200, Body: "a\nb"},
+		}, []string{`body line 3 "c" -> ""`}},
+		{"error", replayResult{Recorded: ok, Error: "connection refused"}, []string{"error: connection refused"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, tc.Result.diff())
+		})
+	}
+}
+
+func Test_ParseReplayResults(t *testing.T) {
+	require := require.New(t)
+	output := []byte(`kubetap-replay: {"method":"GET","url":"http://127.0.0.1:8080/","recorded":{"status":200,"content_type":"text/plain","body":"ok"},"replayed":{"status":200,"content_type":"text/plain","body":"ok"},"error":""}
+[12:00:00.000] client replay finished
+kubetap-replay: {"method":"POST","url":"http://127.0.0.1:8080/api","recorded":null,"replayed":null,"error":"connection refused"}
+`)
+	results, err := parseReplayResults(output)
+	require.Nil(err)
+	require.Equal([]replayResult{
+		{
+			Method:   "GET",
+			URL:      "http://127.0.0.1:8080/",
+			Recorded: &replayResponse{Status: 200, ContentType: "text/plain", Body: "ok"},
+			Replayed: &replayResponse{Status: 200, ContentType: "text/plain", Body: "ok"},
+		},
+		{Method: "POST", URL: "http://127.0.0.1:8080/api", Error: "connection refused"},
+	}, results)
+
+	_, err = parseReplayResults([]byte("kubetap-replay: {"))
+	require.NotNil(err)
+
+	b := bytes.NewBufferString("")
+	cmd := &cobra.Command{}
+	cmd.SetOutput(b)
+	require.Equal(1, printReplayResults(cmd, "sample-service", results))
+	require.Contains(b.String(), "POST    http://127.0.0.1:8080/api  -         -         error: connection refused")
+	require.Contains(b.String(), "Replayed 2 requests to Service \"sample-service\", 1 responses differ from the recording.")
+}
+
+func Test_ReplayCommand(t *testing.T) {
+	require := require.New(t)
+	command, err := replayCommand(ProxyOptions{Mode: "reverse", UpstreamPort: "8443", UpstreamHTTPS: true, UpstreamInsecure: true})
+	require.Nil(err)
+	require.Equal("mitmdump", command[0])
+	require.Contains(command, "ssl_insecure=true")
+	require.Contains(command, "confdir="+mitmproxyReplayConfDir)
+
+	command, err = replayCommand(ProxyOptions{Mode: "reverse", UpstreamPort: "8443", UpstreamHTTPS: true, UpstreamClientCertSecret: "client-tls", UpstreamCASecret: "internal-ca"})
+	require.Nil(err)
+	require.NotContains(command, "ssl_insecure=true")
+	require.Contains(command, "client_certs="+mitmproxyUpstreamClientCertFile)
+	require.Contains(command, "ssl_verify_upstream_trusted_ca="+mitmproxyUpstreamCADir+upstreamCAKey)
+}
+
+func Test_NewReplayCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	flows := filepath.Join(dir, "flows.mitm")
+	require.Nil(t, ioutil.WriteFile(flows, []byte("recorded"), 0600))
+
+	tests := []struct {
+		Name    string
+		Tapped  bool
+		Options map[string]interface{}
+		Err     error
+	}{
+		{"invalid_mode", true, map[string]interface{}{"replayFrom": flows, "replayMode": "proxy"}, ErrReplayModeInvalid},
+		{"not_tapped", false, map[string]interface{}{"replayFrom": flows}, ErrServiceNotTapped},
+		{"no_tap_pod", true, map[string]interface{}{"replayFrom": flows}, ErrKubetapPodNoMatch},
+		{"stop_no_tap_pod", true, map[string]interface{}{"replayMode": replayModeServer, "replayStop": true}, ErrKubetapPodNoMatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			cmd := &cobra.Command{}
+			cmd.SetOutput(ioutil.Discard)
+			if tc.Tapped {
+				tapViper := viper.New()
+				tapViper.Set("proxyPort", 80)
+				require.Nil(NewTapCommand(fakeClient, &rest.Config{}, tapViper)(cmd, []string{"sample-service"}))
+			}
+			testViper := viper.New()
+			for k, v := range tc.Options {
+				testViper.Set(k, v)
+			}
+			err := NewReplayCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+		})
+	}
+
+	err = NewReplayCommand(fakeClientUntappedSimple(), &rest.Config{}, viper.New())(&cobra.Command{}, []string{"sample-service"})
+	require.EqualError(t, err, "--from must be set to a file of recorded flows")
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// mapLocalFilePrefix prefixes the ConfigMap keys of files served with --map-local.
+const mapLocalFilePrefix = "map-local-"
+
+// mitmproxySpecSeparators are tried in order as the separator of generated mitmproxy
+// rule specs, which must not appear in any of the parts.
+const mitmproxySpecSeparators = "|#!@%^&;,"
+
+var ErrRewriteRuleInvalid = errors.New("invalid rewrite rule")
+
+// invalidConfigMapKeyChars are replaced when deriving a ConfigMap key from a file name.
+var invalidConfigMapKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// MapLocalRule serves a file from the tap ConfigMap for requests to matching URLs.
+type MapLocalRule struct {
+	// URLRegex is matched against the request URL
+	URLRegex string `json:"url_regex"`
+	// File is the ConfigMap key of the served file
+	File string `json:"file"`
+}
+
+// headerRulesFromFlags converts --set-header values to mitmproxy modify_headers specs.
+// Values are either NAME=VALUE, where an empty value removes the header, or a
+// mitmproxy spec of the form [/filter]/name/value.
+func headerRulesFromFlags(values []string) ([]string, error) {
+	var specs []string
+	for _, value := range values {
+		if isMitmproxySpec(value) {
+			if err := validateMitmproxySpec(value); err != nil {
+				return nil, err
+			}
+			specs = append(specs, value)
+			continue
+		}
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%w: %q must be NAME=VALUE or [/filter]/name/value", ErrRewriteRuleInvalid, value)
+		}
+		spec, err := mitmproxySpec(strings.TrimSpace(kv[0]), kv[1])
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// bodyRulesFromFlags validates --replace-body values, mitmproxy modify_body specs of
+// the form [/filter]/regex/replacement.
+func bodyRulesFromFlags(values []string) ([]string, error) {
+	for _, value := range values {
+		if err := validateMitmproxySpec(value); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// mapLocalRulesFromFlags reads the files of --map-local values, given as
+// URL_REGEX=FILE, and returns the rules with the files keyed by ConfigMap key.
+func mapLocalRulesFromFlags(values []string) ([]MapLocalRule, map[string][]byte, error) {
+	var rules []MapLocalRule
+	files := make(map[string][]byte)
+	for i, value := range values {
+		sep := strings.LastIndex(value, "=")
+		if sep <= 0 || sep == len(value)-1 {
+			return nil, nil, fmt.Errorf("%w: %q must be URL_REGEX=FILE", ErrRewriteRuleInvalid, value)
+		}
+		urlRegex, path := value[:sep], value[sep+1:]
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading --map-local file: %w", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, nil, fmt.Errorf("%w: %q is not a regular file", ErrRewriteRuleInvalid, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading --map-local file: %w", err)
+		}
+		key := fmt.Sprintf("%s%d-%s", mapLocalFilePrefix, i, invalidConfigMapKeyChars.ReplaceAllString(filepath.Base(path), "_"))
+		files[key] = b
+		rules = append(rules, MapLocalRule{URLRegex: urlRegex, File: key})
+	}
+	return rules, files, nil
+}
+
+// isMitmproxySpec reports whether a value looks like a mitmproxy rule spec, which
+// starts with its separator rather than a header name.
+func isMitmproxySpec(value string) bool {
+	return value != "" && strings.ContainsAny(value[:1], "/"+mitmproxySpecSeparators)
+}
+
+// validateMitmproxySpec checks the structure of a [/filter]/subject/replacement spec.
+func validateMitmproxySpec(spec string) error {
+	if len(spec) < 2 {
+		return fmt.Errorf("%w: %q must be of the form [/filter]/pattern/replacement", ErrRewriteRuleInvalid, spec)
+	}
+	parts := strings.Split(spec[1:], spec[:1])
+	if len(parts) != 2 && len(parts) != 3 {
+		return fmt.Errorf("%w: %q must be of the form [/filter]/pattern/replacement", ErrRewriteRuleInvalid, spec)
+	}
+	if parts[len(parts)-2] == "" {
+		return fmt.Errorf("%w: %q has an empty pattern", ErrRewriteRuleInvalid, spec)
+	}
+	return nil
+}
+
+// mitmproxySpec joins parts into a mitmproxy rule spec, picking a separator that does
+// not appear in any of them.
+func mitmproxySpec(parts ...string) (string, error) {
+	for _, sep := range mitmproxySpecSeparators {
+		s := string(sep)
+		var found bool
+		for _, p := range parts {
+			if strings.Contains(p, s) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return s + strings.Join(parts, s), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no separator is available for %q", ErrRewriteRuleInvalid, parts)
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_HeaderRulesFromFlags(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Values   []string
+		Expected []string
+		Err      error
+	}{
+		{"none", nil, nil, nil},
+		{"set", []string{"X-Debug=1"}, []string{"|X-Debug|1"}, nil},
+		{"remove", []string{"Authorization="}, []string{"|Authorization|"}, nil},
+		{"separator_in_value", []string{"X-Route=a|b"}, []string{"#X-Route#a|b"}, nil},
+		{"spec", []string{"/~q/Host/example.org"}, []string{"/~q/Host/example.org"}, nil},
+		{"missing_value", []string{"X-Debug"}, nil, ErrRewriteRuleInvalid},
+		{"invalid_spec", []string{"/Host"}, nil, ErrRewriteRuleInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			specs, err := headerRulesFromFlags(tc.Values)
+			if tc.Err != nil {
+				require.True(t, errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tc.Expected, specs)
+		})
+	}
+}
+
+func Test_BodyRulesFromFlags(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Values []string
+		Err    error
+	}{
+		{"simple", []string{"/foo/bar"}, nil},
+		{"filter", []string{"/~s/foo/bar", ":~q ~d example.com:secret:redacted"}, nil},
+		{"too_many_parts", []string{"/a/b/c/d"}, ErrRewriteRuleInvalid},
+		{"empty_pattern", []string{"//bar"}, ErrRewriteRuleInvalid},
+		{"too_short", []string{"/"}, ErrRewriteRuleInvalid},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := bodyRulesFromFlags(tc.Values)
+			if tc.Err != nil {
+				require.True(t, errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(t, err)
+		})
+	}
+}
+
+func Test_NewTapCommandRewrites(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users list.json")
+	require.Nil(ioutil.WriteFile(users, []byte(`[{"name":"test"}]`), 0600))
+
+	fakeClient := fakeClientUntappedSimple()
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("setHeaders", []string{"X-Debug=1"})
+	testViper.Set("replaceBody", []string{"/~s/secret/redacted"})
+	testViper.Set("mapLocal", []string{`example\.com/api/users=` + users})
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	options := getMitmproxyConfig(t, fakeClient)
+	require.Equal([]interface{}{"|X-Debug|1"}, options["modify_headers"])
+	require.Equal([]interface{}{"/~s/secret/redacted"}, options["modify_body"])
+	require.Equal([]interface{}{`|example\.com/api/users|` + mitmproxyConfigDir + "map-local-0-users_list.json"}, options["map_local"])
+	cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(`[{"name":"test"}]`, string(cm.BinaryData["map-local-0-users_list.json"]))
+
+	// rules given to update replace the current rules of their kind, and keep the others
+	testViper = viper.New()
+	testViper.Set("setHeaders", []string{"X-Debug=2"})
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	options = getMitmproxyConfig(t, fakeClient)
+	require.Equal([]interface{}{"|X-Debug|2"}, options["modify_headers"])
+	require.NotEmpty(options["map_local"])
+	cm, err = fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Contains(cm.BinaryData, "map-local-0-users_list.json")
+
+	testViper = viper.New()
+	testViper.Set("clearRewrites", true)
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	options = getMitmproxyConfig(t, fakeClient)
+	require.NotContains(options, "modify_headers")
+	require.NotContains(options, "modify_body")
+	require.NotContains(options, "map_local")
+	cm, err = fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.NotContains(cm.BinaryData, "map-local-0-users_list.json")
+}
+
+func getMitmproxyConfig(t *testing.T, client *fake.Clientset) map[string]interface{} {
+	cm, err := client.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+	require.Nil(t, err)
+	var options map[string]interface{}
+	require.Nil(t, yaml.Unmarshal(cm.BinaryData[mitmproxyConfigFile], &options))
+	return options
+}
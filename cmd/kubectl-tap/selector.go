@@ -0,0 +1,242 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// serviceArgs requires the name of a single Service, unless Services are selected with
+// one of the given flags instead.
+func serviceArgs(selectFlags ...string) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		var changed []string
+		for _, name := range selectFlags {
+			if f := cmd.Flags().Lookup(name); f != nil && f.Changed {
+				changed = append(changed, "--"+name)
+			}
+		}
+		switch {
+		case len(changed) > 1:
+			return fmt.Errorf("%s cannot be used together", strings.Join(changed, " and "))
+		case len(changed) == 1 && len(args) > 0:
+			return fmt.Errorf("a Service name cannot be given with %s", changed[0])
+		case len(changed) == 1:
+			return nil
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	}
+}
+
+// tapSelected taps the Services matching a label selector. The Services are grouped by
+// the Deployment they select, and each group is tapped through a single proxy so that
+// every Deployment only rolls out once. Without a port, all TCP ports of the Services are
+// tapped. The result of each Service is printed as a table.
+func tapSelected(client kubernetes.Interface, proxyOpts ProxyOptions, selector string, port int32, commandArgs []string, out io.Writer) error {
+	namespace := proxyOpts.Namespace
+	services, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+	if len(services.Items) == 0 {
+		return fmt.Errorf("%w: %q", ErrSelectorNoServices, selector)
+	}
+	sort.Slice(services.Items, func(i, j int) bool {
+		return services.Items[i].Name < services.Items[j].Name
+	})
+
+	results := make(map[string]string)
+	var failed int
+	var dplNames []string
+	groups := make(map[string][]tapTarget)
+	for i := range services.Items {
+		svc := &services.Items[i]
+		ports := []int32{port}
+		if port == 0 {
+			ports = tcpServicePorts(svc)
+		}
+		switch {
+		case svc.Annotations[annotationOriginalTargetPort] != "":
+			results[svc.Name] = "skipped, already tapped"
+			continue
+		case len(ports) == 0:
+			results[svc.Name] = "skipped, no TCP ports"
+			continue
+		case checkServicePort(svc, ports[0]) != nil:
+			results[svc.Name] = fmt.Sprintf("skipped, no port %d", port)
+			continue
+		}
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), svc.Spec.Selector)
+		if err != nil {
+			results[svc.Name] = "failed: " + err.Error()
+			failed++
+			continue
+		}
+		if _, ok := groups[dpl.Name]; !ok {
+			dplNames = append(dplNames, dpl.Name)
+		}
+		groups[dpl.Name] = append(groups[dpl.Name], tapTarget{svc.Name, ports})
+	}
+
+	var tappedDpls []string
+	for _, dplName := range dplNames {
+		targets := groups[dplName]
+		if _, _, err := tapServices(client, proxyOpts, targets, commandArgs, out); err != nil {
+			for _, t := range targets {
+				results[t.Service] = "failed: " + err.Error()
+				failed++
+			}
+			continue
+		}
+		tappedDpls = append(tappedDpls, dplName)
+		for _, t := range targets {
+			results[t.Service] = fmt.Sprintf("tapped %s through Deployment %q", strings.ToLower(describePorts(t.Ports)), dplName)
+		}
+	}
+
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tRESULT")
+	for _, svc := range services.Items {
+		fmt.Fprintf(w, "%s\t%s\n", svc.Name, results[svc.Name])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(tappedDpls) > 0 {
+		fmt.Fprintf(out, "\nYou can access the proxy web interface of each Deployment at http://127.0.0.1:2244\n")
+		fmt.Fprintf(out, "after running the following command:\n\n")
+		fmt.Fprintf(out, "  kubectl port-forward deploy/<deployment> -n %s 2244:2244\n\n", namespace)
+		fmt.Fprintf(out, "The web interface passwords are kept in the Secrets %s<deployment>.\n", kubetapWebSecretPrefix)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d Services could not be tapped", ErrSelectedServicesFailed, failed, len(services.Items))
+	}
+	return nil
+}
+
+// NewUntapSelectedCommand untaps the tapped Services matching --selector, or all tapped
+// Services of the Namespace with --all. While the controller is installed, their Tap
+// resources are deleted instead.
+func NewUntapSelectedCommand(client kubernetes.Interface, dynamicClient dynamic.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, _ []string) error {
+		namespace := targetNamespace(viper)
+		exists, err := hasNamespace(client, namespace)
+		if err != nil {
+			return fmt.Errorf("error fetching namespaces: %w", err)
+		}
+		if !exists {
+			return ErrNamespaceNotExist
+		}
+		// an empty selector, as used by --all, matches every Service
+		selector := viper.GetString("selector")
+		services, err := client.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		var tapped []v1.Service
+		for _, svc := range services.Items {
+			if svc.Annotations[annotationOriginalTargetPort] != "" {
+				tapped = append(tapped, svc)
+			}
+		}
+		sort.Slice(tapped, func(i, j int) bool {
+			return tapped[i].Name < tapped[j].Name
+		})
+		if len(tapped) == 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "No matching Services in the %s namespace are tapped.\n", namespace)
+			return nil
+		}
+
+		var failed int
+		if controllerInstalled(client) {
+			deleteTap := NewDeleteTapCommand(client, dynamicClient, config, viper)
+			for _, svc := range tapped {
+				if err := deleteTap(cmd, []string{svc.Name}); err != nil {
+					fmt.Fprintf(cmd.OutOrStdout(), "Failed to untap Service %q: %v\n", svc.Name, err)
+					failed++
+				}
+			}
+		} else {
+			audit := newTapAudit(currentUser(config, viper.GetString("user")))
+			failed = untapSelected(client, tapped, audit, cmd.OutOrStdout())
+		}
+		if failed > 0 {
+			return fmt.Errorf("%w: %d of %d Services could not be untapped", ErrSelectedServicesFailed, failed, len(tapped))
+		}
+		return nil
+	}
+}
+
+// untapSelected untaps Services, grouped by the Deployment they select like tapSelected
+// does, so that every Deployment only rolls out once. It returns the number of Services
+// that could not be untapped.
+func untapSelected(client kubernetes.Interface, services []v1.Service, audit tapAudit, out io.Writer) int {
+	var failed int
+	var dplNames []string
+	dpls := make(map[string]k8sappsv1.Deployment)
+	groups := make(map[string][]*v1.Service)
+	for i := range services {
+		svc := &services[i]
+		dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(svc.Namespace), svc.Spec.Selector)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to untap Service %q: %v\n", svc.Name, err)
+			failed++
+			continue
+		}
+		if _, ok := groups[dpl.Name]; !ok {
+			dplNames = append(dplNames, dpl.Name)
+			dpls[dpl.Name] = dpl
+		}
+		groups[dpl.Name] = append(groups[dpl.Name], svc)
+	}
+
+	for _, dplName := range dplNames {
+		dpl := dpls[dplName]
+		group := groups[dplName]
+		names := make([]string, len(group))
+		for i, svc := range group {
+			names[i] = svc.Name
+		}
+		if err := untapServices(client, dpl, names); err != nil {
+			for _, name := range names {
+				fmt.Fprintf(out, "Failed to untap Service %q: %v\n", name, err)
+			}
+			failed += len(names)
+			continue
+		}
+		for _, svc := range group {
+			fmt.Fprintf(out, "Untapped Service %q\n", svc.Name)
+			recordTapEvents(client, out, svc, &dpl, eventReasonUntapped, untapMessage(svc, audit), audit)
+		}
+		if others := tappedServices(client, dpl.Namespace, dpl.Name); len(others) > 0 {
+			fmt.Fprintf(out, "The proxy of Deployment %q keeps tapping %s.\n", dpl.Name, quoteNames(others))
+		}
+	}
+	return failed
+}
@@ -14,17 +14,18 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/browser"
@@ -33,14 +34,14 @@ import (
 	"github.com/spf13/viper"
 	k8sappsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 	"k8s.io/client-go/util/retry"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
@@ -54,8 +55,11 @@ const (
 	kubetapProxyListenPort       = 7777
 	kubetapProxyWebInterfacePort = 2244
 	kubetapConfigMapPrefix       = "kubetap-target-"
+	// defaultNamespace is used when neither --namespace nor the kubeconfig context set one
+	defaultNamespace = "default"
+	// localForwardPort is the first local port the tapped Service ports are forwarded to
+	localForwardPort = 4000
 
-	interactiveTimeoutSeconds = 90
 	configMapAnnotationPrefix = "target-"
 
 	protocolHTTP Protocol = "http"
@@ -76,6 +80,10 @@ var (
 	ErrKubetapPodNoMatch          = errors.New("a Kubetap Pod was not found")
 	ErrCreateResourceMismatch     = errors.New("the created resource did not match the desired state")
 	ErrDeploymentMissingPorts     = errors.New("error resolving Service port number by name from Deployment")
+	ErrDeploymentMismatch         = errors.New("the Services do not select the same Deployment")
+	ErrSelectorNoServices         = errors.New("the label selector did not match any Services")
+	ErrSelectedServicesFailed     = errors.New("some of the selected Services failed")
+	ErrUpstreamSchemeConflict     = errors.New("conflicting upstream scheme")
 )
 
 // Protocol is a supported tap method, and ultimately determines what container
@@ -100,6 +108,12 @@ type Tap interface {
 	ReadyEnv() error
 	UnreadyEnv() error
 
+	// UpdateEnv rewrites the resources prepared by ReadyEnv to match
+	// the current options of an active tap, without touching the
+	// Deployment. The result tells how the change can reach the proxy.
+	// Example: mitmproxy calls this function to rewrite its ConfigMap.
+	UpdateEnv() (TapUpdate, error)
+
 	// String prints the tap method, be it mitmproxy, tcpdump, etc.
 	String() string
 
@@ -107,6 +121,15 @@ type Tap interface {
 	Protocols() []Protocol
 }
 
+// TapUpdate describes how an updated environment reaches a running proxy.
+type TapUpdate struct {
+	// Restart is set if the proxy must be restarted to apply the update.
+	Restart bool
+	// Options are the changed proxy options, which can be applied to a
+	// running proxy unless Restart is set.
+	Options map[string]interface{}
+}
+
 // ProxyOptions are options used to configure the Tap implementation.
 type ProxyOptions struct {
 	// Target is the target Service
@@ -123,15 +146,82 @@ type ProxyOptions struct {
 	Namespace string `json:"namespace"`
 	// Image is the proxy image to deploy as a sidecar
 	Image string `json:"image"`
+	// CommandArgs are the arguments of the proxy sidecar, set with --command-args
+	CommandArgs []string `json:"command_args,omitempty"`
+	// Filters are mitmproxy filter expressions limiting the flows shown in the web interface
+	Filters []string `json:"filters"`
+	// ExtraOptions are additional mitmproxy options, set with --proxy-set and --proxy-config
+	ExtraOptions map[string]interface{} `json:"extra_options"`
+	// Scripts are mitmproxy addon scripts keyed by file name, set with --script
+	Scripts map[string][]byte `json:"-"`
+	// CASecret is a kubernetes.io/tls Secret holding the CA the proxy signs certificates with
+	CASecret string `json:"ca_secret,omitempty"`
+	// TLSSecret is a kubernetes.io/tls Secret holding the certificate the proxy presents to clients
+	TLSSecret string `json:"tls_secret,omitempty"`
+	// UpstreamInsecure disables verification of the upstream certificate
+	UpstreamInsecure bool `json:"upstream_insecure,omitempty"`
+	// UpstreamClientCertSecret is a kubernetes.io/tls Secret holding the client certificate presented to the upstream
+	UpstreamClientCertSecret string `json:"upstream_client_cert_secret,omitempty"`
+	// UpstreamCASecret is a Secret holding the CA bundle the upstream certificate is verified against
+	UpstreamCASecret string `json:"upstream_ca_secret,omitempty"`
+	// Faults are fault injection rules, set with kubectl tap fault
+	Faults []FaultRule `json:"faults,omitempty"`
+	// SetHeaders are mitmproxy modify_headers specs, set with --set-header
+	SetHeaders []string `json:"set_headers,omitempty"`
+	// ReplaceBody are mitmproxy modify_body specs, set with --replace-body
+	ReplaceBody []string `json:"replace_body,omitempty"`
+	// MapLocal serves files from the tap ConfigMap for matching URLs, set with --map-local
+	MapLocal []MapLocalRule `json:"map_local,omitempty"`
+	// MapLocalFiles are the files served by MapLocal, keyed by ConfigMap key
+	MapLocalFiles map[string][]byte `json:"-"`
+	// MirrorTo is the host:port requests are duplicated to, set with --mirror-to
+	MirrorTo string `json:"mirror_to,omitempty"`
+	// ExposeWeb adds the proxy web interface to the ports of the tapped Service
+	ExposeWeb bool `json:"expose_web,omitempty"`
+	// Redact are regular expressions redacted from captured flows, set with --redact
+	Redact []string `json:"redact,omitempty"`
+	// NoDefaultRedaction disables the built-in redaction rules, set with --redact-defaults=false
+	NoDefaultRedaction bool `json:"no_default_redaction,omitempty"`
+	// Audit records who created the tap
+	Audit *tapAudit `json:"audit,omitempty"`
+	// Upstreams are the tapped Service ports when the proxy listens on more than one
+	// port, set with --all-ports or --selector. The first one is also described by
+	// Target and UpstreamPort.
+	Upstreams []ProxyUpstream `json:"upstreams,omitempty"`
 
 	// dplName tracks the current deployment target
 	dplName string
+	// ca is the CA given as local files, stored in CASecret once the pre-flight checks pass
+	ca *proxyCA
+}
+
+// ProxyUpstream is a Service port redirected to one of the listen ports of the proxy.
+type ProxyUpstream struct {
+	// Service is the tapped Service
+	Service string `json:"service"`
+	// Port is the tapped Service port
+	Port int32 `json:"port"`
+	// UpstreamPort is the container port the proxy forwards the traffic to
+	UpstreamPort string `json:"upstream_port"`
+	// ListenPort is the proxy port the Service port is redirected to
+	ListenPort int32 `json:"listen_port"`
+	// HTTPS is set if the proxy reaches UpstreamPort over HTTPS
+	HTTPS bool `json:"https,omitempty"`
+}
+
+// tapTarget is a Service and the ports of it to tap.
+type tapTarget struct {
+	Service string
+	Ports   []int32
 }
 
 // NewListCommand lists Services that are already tapped.
 func NewListCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		namespace := viper.GetString("namespace")
+		namespace := targetNamespace(viper)
+		if viper.GetBool("allNamespaces") {
+			namespace = ""
+		}
 		exists, err := hasNamespace(client, namespace)
 		if err != nil {
 			// this is the one case where we allow an empty namespace string
@@ -147,33 +237,44 @@ func NewListCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra
 		if err != nil {
 			return err
 		}
-		tappedServices := make(map[string]string)
+		var tappedServices []v1.Service
 		for _, svc := range services.Items {
 			if svc.Annotations[annotationOriginalTargetPort] != "" {
-				tappedServices[svc.Name] = svc.Namespace
+				tappedServices = append(tappedServices, svc)
 			}
 		}
+		sort.Slice(tappedServices, func(i, j int) bool {
+			if tappedServices[i].Namespace != tappedServices[j].Namespace {
+				return tappedServices[i].Namespace < tappedServices[j].Namespace
+			}
+			return tappedServices[i].Name < tappedServices[j].Name
+		})
 
-		if namespace != "" {
-			if len(tappedServices) == 0 {
+		if len(tappedServices) == 0 {
+			if namespace != "" {
 				fmt.Fprintf(cmd.OutOrStdout(), "No Services in the %s namespace are tapped.\n", namespace)
-				return nil
-			}
-			fmt.Fprintf(cmd.OutOrStdout(), "Tapped Services in the %s namespace:\n\n", namespace)
-			for k := range tappedServices {
-				fmt.Fprintf(cmd.OutOrStdout(), "%s\n", k)
+			} else {
+				fmt.Fprintln(cmd.OutOrStdout(), "No Services are tapped.")
 			}
 			return nil
 		}
-		if len(tappedServices) == 0 {
-			fmt.Fprintln(cmd.OutOrStdout(), "No Services are tapped.")
-			return nil
+		if namespace != "" {
+			fmt.Fprintf(cmd.OutOrStdout(), "Tapped Services in the %s namespace:\n\n", namespace)
 		}
-		fmt.Fprintln(cmd.OutOrStdout(), "Tapped Namespace/Service:")
-		for k, v := range tappedServices {
-			fmt.Fprintf(cmd.OutOrStdout(), "%s/%s\n", v, k)
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tTAPPED BY\tAGE")
+		for _, svc := range tappedServices {
+			name := svc.Name
+			if namespace == "" {
+				name = svc.Namespace + "/" + svc.Name
+			}
+			tappedBy, age := unknownUser, "<unknown>"
+			if audit, ok := tapAuditFromAnnotations(svc.Annotations); ok {
+				tappedBy, age = audit.String(), audit.age()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, tappedBy, age)
 		}
-		return nil
+		return w.Flush()
 	}
 }
 
@@ -181,30 +282,35 @@ func NewListCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra
 // deployment to add a proxy sidecar.
 func NewTapCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
 	return func(cmd *cobra.Command, args []string) error {
-		targetSvcName := args[0]
+		var targetSvcName string
+		if len(args) > 0 {
+			targetSvcName = args[0]
+		}
+		selector := viper.GetString("selector")
+		allPorts := viper.GetBool("allPorts")
 
-		protocol := viper.GetString("protocol")
 		targetSvcPort := viper.GetInt32("proxyPort")
-		namespace := viper.GetString("namespace")
-		image := viper.GetString("proxyImage")
+		namespace := targetNamespace(viper)
 		https := viper.GetBool("https")
 		portForward := viper.GetBool("portForward")
 		openBrowser := viper.GetBool("browser")
+		readyTimeout := viper.GetDuration("timeout")
 
 		if openBrowser {
 			portForward = true
 		}
+		if readyTimeout <= 0 {
+			readyTimeout = defaultReadyTimeout
+		}
 		commandArgs := strings.Fields(viper.GetString("commandArgs"))
-		if targetSvcPort == 0 {
+		if targetSvcPort == 0 && !allPorts {
 			return fmt.Errorf("--port flag not provided")
 		}
-		if namespace == "" {
-			// TODO: There is probably a way to get the default namespace from the
-			// client context, but I'm not sure what that API is. Will dig
-			// for that at some point.
-			// BUG: "default" is not always the "correct default".
-			viper.Set("namespace", "default")
-			namespace = "default"
+		if targetSvcPort != 0 && allPorts {
+			return fmt.Errorf("--port and --all-ports cannot be used together")
+		}
+		if selector != "" && portForward {
+			return fmt.Errorf("--port-forward and --browser can only be used to tap a single Service")
 		}
 		exists, err := hasNamespace(client, namespace)
 		if err != nil {
@@ -214,176 +320,77 @@ func NewTapCommand(client kubernetes.Interface, config *rest.Config, viper *vipe
 			return ErrNamespaceNotExist
 		}
 
-		proxyOpts := ProxyOptions{
-			Target:        targetSvcName,
-			UpstreamHTTPS: https,
-			Mode:          "reverse", // eventually this may be configurable
-			Namespace:     namespace,
-		}
-		// Adjust default image by protocol if not manually set
-		if image == defaultImageHTTP {
-			switch Protocol(protocol) { // nolint: exhaustive
-			case protocolTCP, protocolUDP:
-				// TODO: make this container and remove error
-				image = defaultImageRaw
-				return fmt.Errorf("mode %q is currently not supported", image)
-			case protocolGRPC:
-				// TODO: make this container and remove error
-				image = defaultImageGRPC
-				return fmt.Errorf("mode %q is currently not supported", image)
-			}
-			viper.Set("proxyImage", image)
-		}
-
-		deploymentsClient := client.AppsV1().Deployments(namespace)
-		servicesClient := client.CoreV1().Services(namespace)
-
-		// get the service to ensure it exists before we go around monkeying with deployments
-		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		proxyOpts, err := tapProxyOptions(client, config, viper, targetSvcName, cmd.OutOrStdout())
 		if err != nil {
 			return err
 		}
-
-		// ensure that we haven't tapped this service already
-		anns := targetService.GetAnnotations()
-		if anns[annotationOriginalTargetPort] != "" {
-			return ErrServiceTapped
+		if selector != "" {
+			return tapSelected(client, proxyOpts, selector, targetSvcPort, commandArgs, cmd.OutOrStdout())
 		}
-
-		// set the upstream port so the proxy knows where to forward traffic
-		for _, ports := range targetService.Spec.Ports {
-			if ports.Port != targetSvcPort {
-				continue
-			}
-			if ports.TargetPort.Type == intstr.Int {
-				proxyOpts.UpstreamPort = ports.TargetPort.String()
-			}
-			// if named, must determine port from deployment spec
-			if ports.TargetPort.Type == intstr.String {
-				var err error
-				targetDpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-				if err != nil {
-					return fmt.Errorf("error resolving Deployment from Service selectors while setting proxy ports: %w", err)
-				}
-				for _, c := range targetDpl.Spec.Template.Spec.Containers {
-					for _, p := range c.Ports {
-						if p.Name == ports.TargetPort.String() {
-							// Set the upstream (target) Service port
-							proxyOpts.UpstreamPort = strconv.Itoa(int(p.ContainerPort))
-						}
-					}
-				}
-				if proxyOpts.UpstreamPort == "" {
-					return ErrDeploymentMissingPorts
-				}
+		targetSvcPorts := []int32{targetSvcPort}
+		if allPorts {
+			svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+			if err != nil {
+				return err
 			}
+			targetSvcPorts = tcpServicePorts(svc)
 		}
-
-		targetDpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
+		proxy, dpl, err := tapServices(client, proxyOpts, []tapTarget{{targetSvcName, targetSvcPorts}}, commandArgs, cmd.OutOrStdout())
 		if err != nil {
-			return fmt.Errorf("error resolving Deployment from Service selectors: %w", err)
-		}
-		proxyOpts.dplName = targetDpl.Name
-		// Save the target Deployment name to anchor the ConfigMap
-		// to the Deployment.
-
-		// Get a proxy based on the protocol type
-		var proxy Tap
-		switch Protocol(protocol) { // nolint: exhaustive
-		case protocolTCP, protocolUDP:
-		case protocolGRPC:
-		default:
-			// AKA, case protocolHTTP:
-			proxy = NewMitmproxy(client, proxyOpts)
-		}
-
-		// Prepare the environment (configmaps, secrets, volumes, etc).
-		// Nothing in ReadyEnv should modify manifests that result in
-		// code running in the cluster. No Pods, no Contaniers, no ReplicaSets,
-		// etc.
-		if err := proxy.ReadyEnv(); err != nil {
 			return err
 		}
-
-		// Setup the sidcar
-		dpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
+		listenPorts, err := serviceListenPorts(client.CoreV1().Services(namespace), targetSvcName, targetSvcPorts)
 		if err != nil {
 			return err
 		}
-		// set the Deployment name so the configmap tracks a specific Deployment
-
-		sidecar := proxy.Sidecar(dpl.Name)
-		sidecar.Image = image
-		sidecar.Args = commandArgs
-
-		// Apply the Deployment configuration
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			dpl.Spec.Template.Spec.Containers = append(dpl.Spec.Template.Spec.Containers, sidecar)
-			proxy.PatchDeployment(&dpl)
-			// set annotation on pod to know what pods are tapped
-			anns := dpl.Spec.Template.GetAnnotations()
-			if anns == nil {
-				anns = map[string]string{}
-			}
-			anns[annotationIsTapped] = dpl.Name
-			dpl.Spec.Template.SetAnnotations(anns)
-			_, updateErr := deploymentsClient.Update(context.TODO(), &dpl, metav1.UpdateOptions{})
-			return updateErr
-		})
-		if retryErr != nil {
-			fmt.Fprintln(cmd.OutOrStdout(), "Error modifying Deployment, reverting tap...")
-			_ = NewUntapCommand(client, viper)(cmd, args)
-			return fmt.Errorf("failed to add sidecars to Deployment: %w", retryErr)
-		}
-
-		// Tap the Service to redirect the incoming traffic to our proxy, which is configured to redirect
-		// to the original port.
-		if err := tapSvc(servicesClient, targetSvcName, targetSvcPort); err != nil {
-			fmt.Fprintln(cmd.OutOrStdout(), "Error modifying Service, reverting tap...")
-			_ = NewUntapCommand(client, viper)(cmd, args)
+		password, err := webPassword(client.CoreV1().Secrets(namespace), dpl.Name)
+		if err != nil {
 			return err
 		}
 
 		if !portForward {
+			webTarget := "deploy/" + dpl.Name
+			if proxyOpts.ExposeWeb {
+				webTarget = "svc/" + targetSvcName
+			}
 			fmt.Fprintln(cmd.OutOrStdout())
-			fmt.Fprintf(cmd.OutOrStdout(), "Port %d of Service %q has been tapped!\n\n", targetSvcPort, targetSvcName)
+			if len(targetSvcPorts) == 1 {
+				fmt.Fprintf(cmd.OutOrStdout(), "Port %d of Service %q has been tapped!\n\n", targetSvcPorts[0], targetSvcName)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s of Service %q have been tapped!\n\n", describePorts(targetSvcPorts), targetSvcName)
+			}
 			fmt.Fprintf(cmd.OutOrStdout(), "You can access the proxy web interface at http://127.0.0.1:2244\n")
 			fmt.Fprintf(cmd.OutOrStdout(), "after running the following command:\n\n")
-			fmt.Fprintf(cmd.OutOrStdout(), "  kubectl port-forward svc/%s -n %s 2244:2244\n\n", targetSvcName, namespace)
+			fmt.Fprintf(cmd.OutOrStdout(), "  kubectl port-forward %s -n %s 2244:2244\n\n", webTarget, namespace)
+			fmt.Fprintf(cmd.OutOrStdout(), "The web interface password is %s\n", password)
+			fmt.Fprintf(cmd.OutOrStdout(), "It is kept in Secret %q until the Service is untapped.\n\n", kubetapWebSecretPrefix+dpl.Name)
 			fmt.Fprintf(cmd.OutOrStdout(), "If the Service is not publicly exposed through an Ingress,\n")
 			fmt.Fprintf(cmd.OutOrStdout(), "you can access it with the following command:\n\n")
-			fmt.Fprintf(cmd.OutOrStdout(), "  kubectl port-forward svc/%s -n %s 4000:%d\n\n", targetSvcName, namespace, targetSvcPort)
+			var forwards []string
+			for i, p := range targetSvcPorts {
+				forwards = append(forwards, fmt.Sprintf("%d:%d", localForwardPort+i, p))
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "  kubectl port-forward svc/%s -n %s %s\n\n", targetSvcName, namespace, strings.Join(forwards, " "))
 			fmt.Fprintf(cmd.OutOrStdout(), "In the future, you can run with --port-forward or --browser to automate this process.\n")
 			return nil
 		}
 
 		// We're now in an interactive state
 		fmt.Fprintf(cmd.OutOrStdout(), "Establishing port-forward tunnels to Service...\n")
-		berr := bytes.NewBufferString("")
-		bout := bytes.NewBufferString("")
-		stopCh := make(chan struct{})
-		readyCh := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		ic := make(chan os.Signal, 1)
 		signal.Notify(ic, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(ic)
 		go func() {
-			<-ic
-			close(stopCh)
-			fmt.Fprintln(cmd.OutOrStdout(), "")
-			fmt.Fprintln(cmd.OutOrStdout(), "Stopping kubetap...")
-			_ = NewUntapCommand(client, viper)(cmd, args)
-			die()
+			select {
+			case <-ic:
+				cancel()
+			case <-ctx.Done():
+			}
 		}()
 
-		podsClient := client.CoreV1().Pods(namespace)
-		s := make(chan struct{})
-		defer close(s)
-		go func() {
-			// Skip the first few checks to give pods time to come up.
-			// Race: If the first few cycles are not skipped, the condition status may be "Ready".
-			time.Sleep(5 * time.Second)
-			s <- struct{}{}
-		}()
-		bar := progressbar.NewOptions(interactiveTimeoutSeconds,
+		bar := progressbar.NewOptions(int(readyTimeout.Seconds()),
 			progressbar.OptionThrottle(100*time.Millisecond),
 			progressbar.OptionClearOnFinish(),
 			progressbar.OptionSetPredictTime(false),
@@ -394,111 +401,192 @@ func NewTapCommand(client kubernetes.Interface, config *rest.Config, viper *vipe
 				fmt.Fprintf(cmd.OutOrStderr(), "\n")
 			}),
 		)
-		var ready bool
-		for i := 0; i < interactiveTimeoutSeconds; i++ {
-			_ = bar.Add(1)
-			if ready {
-				_ = bar.Finish()
-				break
-			}
-			time.Sleep(1 * time.Second)
-			select {
-			case <-time.After(1 * time.Nanosecond):
-				// if not ready this cycle, abort
-				continue
-			case <-s:
-				dp, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-				if err != nil {
-					return err
-				}
-				pod, err := kubetapPod(podsClient, dp.Name)
-				if err != nil {
-					return err
-				}
-				for _, cond := range pod.Status.Conditions {
-					if cond.Type == "ContainersReady" {
-						if cond.Status == "True" {
-							ready = true
-						}
-					}
-				}
-				go func() {
-					s <- struct{}{}
-				}()
-			}
-		}
-		if !ready {
-			fmt.Fprintf(cmd.OutOrStdout(), ".\n\n")
-			die("Pod not running after 90 seconds. Cancelling port-forward, tap still active.")
-		}
-		dp, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-		if err != nil {
-			return err
-		}
-		pod, err := kubetapPod(podsClient, dp.Name)
-		if err != nil {
-			return err
-		}
-		transport, upgrader, err := spdy.RoundTripperFor(config)
-		if err != nil {
-			return err
-		}
-		path := "/api/v1/namespaces/" + namespace + "/pods/" + pod.Name + "/portforward"
-		dialer := spdy.NewDialer(upgrader,
-			&http.Client{Transport: transport},
-			http.MethodPost,
-			&url.URL{
-				Scheme: "https",
-				Path:   path,
-				Host:   strings.TrimPrefix(strings.TrimPrefix(config.Host, `http://`), `https://`),
-			},
-		)
-		fw, err := portforward.New(dialer,
-			[]string{
-				fmt.Sprintf("%s:%s", strconv.Itoa(kubetapProxyWebInterfacePort), strconv.Itoa(kubetapProxyWebInterfacePort)),
-				fmt.Sprintf("%s:%s", "4000", strconv.Itoa(int(kubetapProxyListenPort))),
-			}, stopCh, readyCh, bout, berr)
+		stopProgress := advanceProgress(bar, time.Second)
+		_, err = waitForTapReady(ctx, client, namespace, dpl.Name, readyTimeout, bar.Describe)
+		stopProgress()
+		_ = bar.Finish()
 		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Fprintln(cmd.OutOrStdout(), "")
+				fmt.Fprintln(cmd.OutOrStdout(), "Stopping kubetap...")
+				return NewUntapCommand(client, config, viper)(cmd, args)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "Cancelling port-forward, tap still active.")
 			return err
 		}
 		fmt.Fprintf(cmd.OutOrStdout(), "\nPort-Forwards:\n\n")
-		fmt.Fprintf(cmd.OutOrStdout(), "  %s - http://127.0.0.1:%s\n", proxy.String(), strconv.Itoa(int(kubetapProxyWebInterfacePort)))
+		fmt.Fprintf(cmd.OutOrStdout(), "  %s - http://127.0.0.1:%s (password %s)\n", proxy.String(), strconv.Itoa(int(kubetapProxyWebInterfacePort)), password)
+		scheme := "http"
 		if https {
-			fmt.Fprintf(cmd.OutOrStdout(), "  %s - https://127.0.0.1:%s\n\n", targetSvcName, "4000")
-		} else {
-			fmt.Fprintf(cmd.OutOrStdout(), "  %s - http://127.0.0.1:%s\n\n", targetSvcName, "4000")
+			scheme = "https"
+		}
+		forwards := []string{fmt.Sprintf("%s:%s", strconv.Itoa(kubetapProxyWebInterfacePort), strconv.Itoa(kubetapProxyWebInterfacePort))}
+		for i, p := range targetSvcPorts {
+			forwards = append(forwards, fmt.Sprintf("%d:%d", localForwardPort+i, listenPorts[i]))
+			if len(targetSvcPorts) == 1 {
+				fmt.Fprintf(cmd.OutOrStdout(), "  %s - %s://127.0.0.1:%d\n", targetSvcName, scheme, localForwardPort+i)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "  %s:%d - %s://127.0.0.1:%d\n", targetSvcName, p, scheme, localForwardPort+i)
+			}
 		}
+		fmt.Fprintln(cmd.OutOrStdout())
+		readyCh := make(chan struct{})
 		if openBrowser {
 			go func() {
-				time.Sleep(2 * time.Second)
-				_ = browser.OpenURL("http://127.0.0.1:" + strconv.Itoa(int(kubetapProxyWebInterfacePort)))
-				if https {
-					_ = browser.OpenURL("https://127.0.0.1:" + "4000")
-				} else {
-					_ = browser.OpenURL("http://127.0.0.1:" + "4000")
+				select {
+				case <-readyCh:
+				case <-ctx.Done():
+					return
 				}
+				_ = browser.OpenURL("http://127.0.0.1:" + strconv.Itoa(int(kubetapProxyWebInterfacePort)) + "/?token=" + url.QueryEscape(password))
+				_ = browser.OpenURL(scheme + "://127.0.0.1:" + strconv.Itoa(localForwardPort))
 			}()
 		}
-		if err := fw.ForwardPorts(); err != nil {
+		// forwardTapPorts keeps the tunnels up across Pod restarts until interrupted.
+		if err := forwardTapPorts(ctx, client, config, namespace, dpl.Name, forwards, readyCh, cmd.OutOrStdout()); err != nil {
+			fmt.Fprintln(cmd.OutOrStdout(), "Cancelling port-forward, tap still active.")
 			return err
 		}
-		<-readyCh
-		halt := make(chan os.Signal, 1)
-		signal.Notify(halt, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-		<-halt
-		return nil
+		fmt.Fprintln(cmd.OutOrStdout(), "")
+		fmt.Fprintln(cmd.OutOrStdout(), "Stopping kubetap...")
+		return NewUntapCommand(client, config, viper)(cmd, args)
 	}
 }
 
+// advanceProgress adds one to a progress bar every interval. The returned function stops
+// it, and returns once the bar is no longer advanced.
+func advanceProgress(bar *progressbar.ProgressBar, interval time.Duration) func() {
+	tick := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-tick.C:
+				_ = bar.Add(1)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		tick.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// tapProxyOptions validates the proxy flags of a tap, and returns the options of the proxy
+// tapping the Service targetSvcName in the Namespace of the tap.
+func tapProxyOptions(client kubernetes.Interface, config *rest.Config, viper *viper.Viper, targetSvcName string, out io.Writer) (ProxyOptions, error) {
+	protocol := viper.GetString("protocol")
+	namespace := targetNamespace(viper)
+	image := viper.GetString("proxyImage")
+	https := viper.GetBool("https")
+
+	// validate user supplied mitmproxy options before anything is modified
+	extraOptions, err := mitmproxyOptionsFromFlags(viper.GetStringSlice("proxySet"), viper.GetString("proxyConfig"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	scripts, err := mitmproxyScriptsFromFlags(viper.GetStringSlice("scripts"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	setHeaders, err := headerRulesFromFlags(viper.GetStringSlice("setHeaders"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	replaceBody, err := bodyRulesFromFlags(viper.GetStringSlice("replaceBody"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	mapLocal, mapLocalFiles, err := mapLocalRulesFromFlags(viper.GetStringSlice("mapLocal"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	redact, err := redactPatternsFromFlags(viper.GetStringSlice("redact"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	caSecret, ca, err := caSecretFromFlags(client.CoreV1().Secrets(namespace), viper.GetString("caSecret"), viper.GetString("caCert"), viper.GetString("caKey"), viper.GetBool("caReplace"))
+	if err != nil {
+		return ProxyOptions{}, err
+	}
+	if caSecret != "" {
+		fmt.Fprintf(out, "Using the proxy CA stored in Secret %q\n", caSecret)
+	}
+	tlsSecret := viper.GetString("tlsSecret")
+	upstreamClientCertSecret := viper.GetString("upstreamClientCertSecret")
+	upstreamCASecret := viper.GetString("upstreamCASecret")
+	if err := validateProxySecrets(client.CoreV1().Secrets(namespace), tlsSecret, upstreamClientCertSecret, upstreamCASecret); err != nil {
+		return ProxyOptions{}, err
+	}
+	mirrorTo := viper.GetString("mirrorTo")
+	if mirrorTo != "" {
+		if err := validateMirrorTarget(client, namespace, mirrorTo); err != nil {
+			return ProxyOptions{}, err
+		}
+	}
+	upstreamInsecure := viper.GetBool("upstreamInsecure")
+	if https && !upstreamInsecure && upstreamCASecret == "" {
+		fmt.Fprintf(out, "The upstream certificate is verified against the public CAs trusted by mitmproxy.\n")
+		fmt.Fprintf(out, "Use --upstream-ca-secret to trust a private CA, or --upstream-insecure to skip verification.\n")
+	}
+	proxyOpts := ProxyOptions{
+		Target:        targetSvcName,
+		UpstreamHTTPS: https,
+		Mode:          "reverse", // eventually this may be configurable
+		Namespace:     namespace,
+		ExtraOptions:  extraOptions,
+		Scripts:       scripts,
+		CASecret:      caSecret,
+		ca:            ca,
+		TLSSecret:     tlsSecret,
+
+		UpstreamInsecure:         upstreamInsecure,
+		UpstreamClientCertSecret: upstreamClientCertSecret,
+		UpstreamCASecret:         upstreamCASecret,
+
+		SetHeaders:    setHeaders,
+		ReplaceBody:   replaceBody,
+		MapLocal:      mapLocal,
+		MapLocalFiles: mapLocalFiles,
+		MirrorTo:      mirrorTo,
+		ExposeWeb:     viper.GetBool("exposeWeb"),
+
+		Redact:             redact,
+		NoDefaultRedaction: viper.IsSet("redactDefaults") && !viper.GetBool("redactDefaults"),
+	}
+	audit := newTapAudit(currentUser(config, viper.GetString("user")))
+	proxyOpts.Audit = &audit
+	// Adjust default image by protocol if not manually set
+	if image == defaultImageHTTP {
+		switch Protocol(protocol) { // nolint: exhaustive
+		case protocolTCP, protocolUDP:
+			// TODO: make this container and remove error
+			image = defaultImageRaw
+			return ProxyOptions{}, fmt.Errorf("mode %q is currently not supported", image)
+		case protocolGRPC:
+			// TODO: make this container and remove error
+			image = defaultImageGRPC
+			return ProxyOptions{}, fmt.Errorf("mode %q is currently not supported", image)
+		}
+		viper.Set("proxyImage", image)
+	}
+
+	proxyOpts.Protocol = Protocol(protocol)
+	proxyOpts.Image = image
+	return proxyOpts, nil
+}
+
 // NewUntapCommand unconditionally removes all proxies, taps, and artifacts. This is
 // the inverse of NewTapCommand.
-func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+func NewUntapCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		targetSvcName := args[0]
-		namespace := viper.GetString("namespace")
-		if namespace == "" {
-			namespace = "default"
-		}
+		namespace := targetNamespace(viper)
 		exists, err := hasNamespace(client, namespace)
 		if err != nil {
 			return fmt.Errorf("error fetching namespaces: %w", err)
@@ -507,71 +595,638 @@ func NewUntapCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobr
 			return ErrNamespaceNotExist
 		}
 
-		deploymentsClient := client.AppsV1().Deployments(namespace)
-		servicesClient := client.CoreV1().Services(namespace)
-
-		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		// fetched before untapping, so the Events can say who created the tap
+		svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
 		if err != nil {
 			return err
 		}
-		dpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
-		if err != nil {
+		var dpl *k8sappsv1.Deployment
+		if d, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), svc.Spec.Selector); err == nil {
+			dpl = &d
+		}
+
+		if err := untapService(client, namespace, targetSvcName); err != nil {
 			return err
 		}
-		if dpl.Namespace != namespace {
-			panic(ErrDeploymentOutsideNamespace)
+		fmt.Fprintf(cmd.OutOrStdout(), "Untapped Service %q\n", targetSvcName)
+		if dpl != nil {
+			if others := tappedServices(client, namespace, dpl.Name); len(others) > 0 {
+				fmt.Fprintf(cmd.OutOrStdout(), "The proxy of Deployment %q keeps tapping %s.\n", dpl.Name, quoteNames(others))
+			}
 		}
+		audit := newTapAudit(currentUser(config, viper.GetString("user")))
+		recordTapEvents(client, cmd.OutOrStdout(), svc, dpl, eventReasonUntapped, untapMessage(svc, audit), audit)
+		return nil
+	}
+}
 
-		proxy := NewMitmproxy(client, ProxyOptions{
-			Namespace: namespace,
-			Target:    targetSvcName,
-			dplName:   dpl.Name,
-		})
+// untapMessage describes the untapping of a Service, and who tapped it if that was recorded.
+func untapMessage(svc *v1.Service, audit tapAudit) string {
+	msg := fmt.Sprintf("Service %q untapped by %s with kubetap %s", svc.Name, audit, audit.Version)
+	if tapped, ok := tapAuditFromAnnotations(svc.Annotations); ok {
+		msg += fmt.Sprintf(", it was tapped by %s %s ago", tapped, tapped.age())
+	}
+	return msg
+}
 
-		if err := proxy.UnreadyEnv(); err != nil {
-			// both error types below can be thrown
-			if !errors.Is(ErrConfigMapNoMatch, err) {
-				return err
+// tapService identifies the Deployment behind a Service, adds a proxy sidecar to it, and
+// redirects the Service port to the proxy. The tap is reverted if any step after the
+// pre-flight checks fails. It returns the proxy and the tapped Deployment.
+func tapService(client kubernetes.Interface, proxyOpts ProxyOptions, targetSvcPort int32, commandArgs []string, out io.Writer) (Tap, k8sappsv1.Deployment, error) {
+	return tapServices(client, proxyOpts, []tapTarget{{proxyOpts.Target, []int32{targetSvcPort}}}, commandArgs, out)
+}
+
+// tapServices taps the ports of Services that select the same Deployment through a single
+// proxy sidecar, so that the Deployment only rolls out once. The proxy listens on one port
+// for each tapped Service port, starting at kubetapProxyListenPort. If the Deployment is
+// already tapped, the Services are added to its proxy, keeping the proxy options.
+func tapServices(client kubernetes.Interface, proxyOpts ProxyOptions, targets []tapTarget, commandArgs []string, out io.Writer) (Tap, k8sappsv1.Deployment, error) { //nolint: gocyclo
+	namespace := proxyOpts.Namespace
+	deploymentsClient := client.AppsV1().Deployments(namespace)
+	servicesClient := client.CoreV1().Services(namespace)
+
+	targetServices := make([]*v1.Service, len(targets))
+	for i, target := range targets {
+		// get the service to ensure it exists before we go around monkeying with deployments
+		targetService, err := servicesClient.Get(context.TODO(), target.Service, metav1.GetOptions{})
+		if err != nil {
+			return nil, k8sappsv1.Deployment{}, err
+		}
+
+		// ensure that we haven't tapped this service already
+		anns := targetService.GetAnnotations()
+		if anns[annotationOriginalTargetPort] != "" {
+			return nil, k8sappsv1.Deployment{}, ErrServiceTapped
+		}
+		if len(target.Ports) == 0 {
+			return nil, k8sappsv1.Deployment{}, fmt.Errorf("%w: Service %q has no TCP ports", ErrServiceMissingPort, target.Service)
+		}
+		if proxyOpts.ExposeWeb && isExternalService(targetService) {
+			fmt.Fprintf(out, "Warning: Service %q is of type %s, the proxy web interface port will be reachable from outside the cluster.\n", target.Service, targetService.Spec.Type)
+		}
+
+		// check everything that would make the tap fail partway through
+		checks := preflight(client, targetService, target.Ports[0])
+		for _, port := range target.Ports[1:] {
+			checks = append(checks, preflightCheck{Name: fmt.Sprintf("Service port %d", port), Err: checkServicePort(targetService, port)})
+		}
+		if !checks.Clean() {
+			checks.Report(out, target.Service)
+		}
+		if err := checks.Err(); err != nil {
+			return nil, k8sappsv1.Deployment{}, fmt.Errorf("pre-flight checks failed, nothing was modified: %w", err)
+		}
+		targetServices[i] = targetService
+	}
+
+	// Save the target Deployment name to anchor the ConfigMap
+	// to the Deployment.
+	dpl, err := deploymentFromSelectors(deploymentsClient, targetServices[0].Spec.Selector)
+	if err != nil {
+		return nil, k8sappsv1.Deployment{}, fmt.Errorf("error resolving Deployment from Service selectors: %w", err)
+	}
+	proxyOpts.dplName = dpl.Name
+
+	// a Deployment that is already tapped gets the Services added to its proxy
+	var current *ProxyOptions
+	var upstreams []ProxyUpstream
+	if hasSidecar(dpl) {
+		opts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		if err != nil {
+			return nil, k8sappsv1.Deployment{}, fmt.Errorf("error reading the options of the proxy of Deployment %q: %w", dpl.Name, err)
+		}
+		current = &opts
+		upstreams = tapUpstreams(servicesClient, opts)
+	}
+
+	// set the upstream ports so the proxy knows where to forward traffic, each on a listen
+	// port not used by the proxy yet
+	usedListenPorts := make(map[int32]bool)
+	for _, u := range upstreams {
+		usedListenPorts[u.ListenPort] = true
+	}
+	listenPort := int32(kubetapProxyListenPort)
+	var added []ProxyUpstream
+	svcNames := make([]string, len(targetServices))
+	for i, targetService := range targetServices {
+		svcNames[i] = targetService.Name
+		if i > 0 {
+			other, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
+			if err != nil {
+				return nil, k8sappsv1.Deployment{}, fmt.Errorf("error resolving Deployment from Service selectors: %w", err)
+			}
+			if other.Name != dpl.Name {
+				return nil, k8sappsv1.Deployment{}, fmt.Errorf("%w: %q selects %q, %q selects %q", ErrDeploymentMismatch,
+					targetServices[0].Name, dpl.Name, targetService.Name, other.Name)
+			}
+		}
+		for _, port := range targets[i].Ports {
+			upstreamPort, err := upstreamPort(targetService, port, dpl)
+			if err != nil {
+				return nil, k8sappsv1.Deployment{}, err
+			}
+			https, err := upstreamHTTPS(targetService, port, proxyOpts.UpstreamHTTPS, len(targets[i].Ports) > 1)
+			if err != nil {
+				return nil, k8sappsv1.Deployment{}, fmt.Errorf("pre-flight checks failed, nothing was modified: %w", err)
+			}
+			for _, u := range append(upstreams, added...) {
+				if u.UpstreamPort == upstreamPort && u.HTTPS != https {
+					return nil, k8sappsv1.Deployment{}, fmt.Errorf("pre-flight checks failed, nothing was modified: %w: container port %s is already proxied over %s for Service %q",
+						ErrUpstreamSchemeConflict, upstreamPort, upstreamScheme(u.HTTPS), u.Service)
+				}
+			}
+			for usedListenPorts[listenPort] {
+				listenPort++
+			}
+			usedListenPorts[listenPort] = true
+			added = append(added, ProxyUpstream{
+				Service:      targetService.Name,
+				Port:         port,
+				UpstreamPort: upstreamPort,
+				ListenPort:   listenPort,
+				HTTPS:        https,
+			})
+		}
+	}
+	if err := checkListenPortCollisions(dpl, added); err != nil {
+		return nil, k8sappsv1.Deployment{}, fmt.Errorf("pre-flight checks failed, nothing was modified: %w", err)
+	}
+	upstreams = append(upstreams, added...)
+
+	// everything that could fail the tap was checked, so the CA can be stored for the proxy
+	if current == nil && proxyOpts.ca != nil {
+		if err := proxyOpts.ca.store(client.CoreV1().Secrets(namespace)); err != nil {
+			return nil, k8sappsv1.Deployment{}, err
+		}
+	}
+
+	var proxy Tap
+	if current != nil {
+		fmt.Fprintf(out, "Deployment %q is already tapped, adding to its proxy, whose options other than --https are kept.\n", dpl.Name)
+		current.setUpstreams(upstreams)
+		proxy, err = extendSidecar(client, *current, dpl)
+	} else {
+		proxyOpts.setUpstreams(upstreams)
+		proxy, err = addSidecar(client, proxyOpts, dpl, commandArgs)
+	}
+	if err != nil {
+		fmt.Fprintln(out, "Error modifying Deployment, reverting tap...")
+		if current == nil {
+			// the proxy was new, and its options may not have been stored
+			_ = removeSidecar(client, dpl)
+		} else {
+			_ = untapServices(client, dpl, svcNames)
+		}
+		return nil, k8sappsv1.Deployment{}, err
+	}
+
+	// Tap the Services to redirect the incoming traffic to our proxy, which is configured to redirect
+	// to the original ports.
+	for _, targetService := range targetServices {
+		listenPorts := make(map[int32]int32)
+		for _, u := range added {
+			if u.Service == targetService.Name {
+				listenPorts[u.Port] = u.ListenPort
+			}
+		}
+		if err := tapSvc(servicesClient, targetService.Name, listenPorts, proxyOpts.ExposeWeb, proxyOpts.Audit); err != nil {
+			fmt.Fprintln(out, "Error modifying Service, reverting tap...")
+			_ = untapServices(client, dpl, svcNames)
+			return nil, k8sappsv1.Deployment{}, err
+		}
+	}
+	if proxyOpts.Audit != nil {
+		audit := *proxyOpts.Audit
+		for i, targetService := range targetServices {
+			recordDpl := &dpl
+			if i > 0 {
+				// one Event on the Deployment is enough, it rolled out once
+				recordDpl = nil
+			}
+			recordTapEvents(client, out, targetService, recordDpl, eventReasonTapped,
+				fmt.Sprintf("%s of Service %q tapped by %s with kubetap %s", describePorts(targets[i].Ports), targetService.Name, audit, audit.Version), audit)
+		}
+	}
+	return proxy, dpl, nil
+}
+
+// addSidecar prepares the environment of a new proxy and adds it as a sidecar to the
+// Deployment.
+func addSidecar(client kubernetes.Interface, proxyOpts ProxyOptions, dpl k8sappsv1.Deployment, commandArgs []string) (Tap, error) {
+	deploymentsClient := client.AppsV1().Deployments(dpl.Namespace)
+	// recorded with the options, so that the webhook injects the same sidecar
+	proxyOpts.CommandArgs = commandArgs
+
+	// Get a proxy based on the protocol type
+	var proxy Tap
+	switch proxyOpts.Protocol { // nolint: exhaustive
+	case protocolHTTP, "":
+		proxy = NewMitmproxy(client, proxyOpts)
+	default:
+		return nil, fmt.Errorf("protocol %q is currently not supported", proxyOpts.Protocol)
+	}
+
+	// Prepare the environment (configmaps, secrets, volumes, etc).
+	// Nothing in ReadyEnv should modify manifests that result in
+	// code running in the cluster. No Pods, no Contaniers, no ReplicaSets,
+	// etc.
+	if err := proxy.ReadyEnv(); err != nil {
+		return nil, err
+	}
+
+	// Setup the sidcar
+	sidecar := proxy.Sidecar(dpl.Name)
+	sidecar.Image = proxyOpts.Image
+	sidecar.Args = commandArgs
+
+	// Apply the Deployment configuration
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Explicitly re-fetch the deployment to reduce the chance of having a race
+		deployment, getErr := deploymentsClient.Get(context.TODO(), dpl.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, sidecar)
+		proxy.PatchDeployment(deployment)
+		// set annotation on pod to know what pods are tapped
+		anns := deployment.Spec.Template.GetAnnotations()
+		if anns == nil {
+			anns = map[string]string{}
+		}
+		anns[annotationIsTapped] = deployment.Name
+		deployment.Spec.Template.SetAnnotations(anns)
+		_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if retryErr != nil {
+		return nil, fmt.Errorf("failed to add sidecars to Deployment: %w", retryErr)
+	}
+	return proxy, nil
+}
+
+// extendSidecar rewrites the configuration of the proxy of an already tapped Deployment
+// for the Service ports it taps, and updates the ports of its sidecar, which rolls the
+// Deployment so that the proxy listens on the new ports.
+func extendSidecar(client kubernetes.Interface, proxyOpts ProxyOptions, dpl k8sappsv1.Deployment) (Tap, error) {
+	proxy := NewMitmproxy(client, proxyOpts)
+	if _, err := proxy.UpdateEnv(); err != nil {
+		return nil, err
+	}
+	var sidecar v1.Container
+	for _, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			sidecar = *c.DeepCopy()
+		}
+	}
+	sidecar.Ports = proxy.Sidecar(dpl.Name).Ports
+	if err := updateSidecar(client.AppsV1().Deployments(dpl.Namespace), dpl.Name, sidecar); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// hasSidecar reports whether a Deployment has a kubetap proxy sidecar.
+func hasSidecar(dpl k8sappsv1.Deployment) bool {
+	for _, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			return true
+		}
+	}
+	return false
+}
+
+// tapUpstreams returns the Service ports tapped through a proxy. A proxy tapping a single
+// port on kubetapProxyListenPort only records its target, so the tapped Service port is
+// looked up on the Service.
+func tapUpstreams(servicesClient corev1.ServiceInterface, proxyOpts ProxyOptions) []ProxyUpstream {
+	if len(proxyOpts.Upstreams) > 0 {
+		return proxyOpts.Upstreams
+	}
+	u := ProxyUpstream{
+		Service:      proxyOpts.Target,
+		UpstreamPort: proxyOpts.UpstreamPort,
+		ListenPort:   kubetapProxyListenPort,
+		HTTPS:        proxyOpts.UpstreamHTTPS,
+	}
+	if svc, err := servicesClient.Get(context.TODO(), proxyOpts.Target, metav1.GetOptions{}); err == nil {
+		for _, sp := range svc.Spec.Ports {
+			if sp.TargetPort.IntValue() == kubetapProxyListenPort {
+				u.Port = sp.Port
+			}
+		}
+	}
+	return []ProxyUpstream{u}
+}
+
+// setUpstreams sets the Service ports tapped through the proxy. A single port on
+// kubetapProxyListenPort is described by Target and UpstreamPort alone, like the taps of
+// earlier versions of kubetap.
+func (p *ProxyOptions) setUpstreams(upstreams []ProxyUpstream) {
+	p.Target = upstreams[0].Service
+	p.UpstreamPort = upstreams[0].UpstreamPort
+	p.Upstreams = nil
+	if len(upstreams) > 1 || upstreams[0].ListenPort != kubetapProxyListenPort {
+		p.Upstreams = upstreams
+		return
+	}
+	p.UpstreamHTTPS = upstreams[0].HTTPS
+}
+
+// upstreamHTTPS tells whether the proxy reaches a Service port over HTTPS. With --https it
+// does, unless the port is plain HTTP. When several ports of a Service are tapped, those
+// that declare no scheme are taken to be HTTPS on 443 and plain HTTP on 80, and without
+// --https each port uses its scheme.
+func upstreamHTTPS(svc *v1.Service, port int32, https, detect bool) (bool, error) {
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port != port {
+			continue
+		}
+		scheme := declaredScheme(sp)
+		if scheme == "" && detect {
+			switch sp.Port {
+			case 443:
+				scheme = "https"
+			case 80:
+				scheme = "http"
 			}
 		}
+		switch {
+		case https && scheme == "http":
+			return false, fmt.Errorf("%w: --https was given, but port %d of Service %q is plain HTTP, leave out --https and tap all ports to use the scheme of each port",
+				ErrUpstreamSchemeConflict, port, svc.Name)
+		case https:
+			return true, nil
+		}
+		return detect && scheme == "https", nil
+	}
+	return https, nil
+}
 
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			// Explicitly re-fetch the deployment to reduce the chance of having a race
-			deployment, getErr := deploymentsClient.Get(context.TODO(), dpl.Name, metav1.GetOptions{})
-			if getErr != nil {
-				return getErr
+// declaredScheme returns the scheme the appProtocol or the name of a Service port declares,
+// such as "https" or "https-web", or "" if it declares none.
+func declaredScheme(sp v1.ServicePort) string {
+	names := []string{sp.Name}
+	if sp.AppProtocol != nil {
+		names = append([]string{*sp.AppProtocol}, names...)
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		for _, scheme := range []string{"https", "http"} {
+			if name == scheme || strings.HasPrefix(name, scheme+"-") {
+				return scheme
 			}
-			var containersNoProxy []v1.Container
-			for _, c := range deployment.Spec.Template.Spec.Containers {
-				if c.Name != kubetapContainerName {
-					containersNoProxy = append(containersNoProxy, c)
+		}
+	}
+	return ""
+}
+
+// upstreamScheme returns the scheme the proxy reaches an upstream with.
+func upstreamScheme(https bool) string {
+	if https {
+		return "https"
+	}
+	return "http"
+}
+
+// upstreamPort resolves the container port a Service port forwards to. Named target
+// ports are looked up in the containers of the Deployment.
+func upstreamPort(svc *v1.Service, port int32, dpl k8sappsv1.Deployment) (string, error) {
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port != port {
+			continue
+		}
+		if sp.TargetPort.Type == intstr.Int {
+			return sp.TargetPort.String(), nil
+		}
+		for _, c := range dpl.Spec.Template.Spec.Containers {
+			for _, p := range c.Ports {
+				if p.Name == sp.TargetPort.String() {
+					return strconv.Itoa(int(p.ContainerPort)), nil
 				}
 			}
-			deployment.Spec.Template.Spec.Containers = containersNoProxy
-			var volumes []v1.Volume
-			for _, v := range deployment.Spec.Template.Spec.Volumes {
-				if !strings.HasPrefix(v.Name, "kubetap") {
-					volumes = append(volumes, v)
+		}
+		return "", ErrDeploymentMissingPorts
+	}
+	return "", ErrServiceMissingPort
+}
+
+// tcpServicePorts returns the TCP ports of a Service, which are the ones the proxy can tap.
+func tcpServicePorts(svc *v1.Service) []int32 {
+	var ports []int32
+	for _, sp := range svc.Spec.Ports {
+		if sp.Protocol == v1.ProtocolTCP || sp.Protocol == "" {
+			ports = append(ports, sp.Port)
+		}
+	}
+	return ports
+}
+
+// serviceListenPorts returns the proxy ports that the given ports of a tapped Service
+// are redirected to.
+func serviceListenPorts(svcClient corev1.ServiceInterface, svcName string, ports []int32) ([]int, error) {
+	svc, err := svcClient.Get(context.TODO(), svcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	listenPorts := make([]int, len(ports))
+	for i, port := range ports {
+		for _, sp := range svc.Spec.Ports {
+			if sp.Port == port {
+				listenPorts[i] = sp.TargetPort.IntValue()
+			}
+		}
+	}
+	return listenPorts, nil
+}
+
+// quoteNames lists names for messages, as "a" or "a", "b".
+func quoteNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = strconv.Quote(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// describePorts names Service ports for messages, as "Port 80" or "Ports 80, 443".
+func describePorts(ports []int32) string {
+	if len(ports) == 1 {
+		return fmt.Sprintf("Port %d", ports[0])
+	}
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = strconv.Itoa(int(p))
+	}
+	return "Ports " + strings.Join(s, ", ")
+}
+
+// untapService restores the Service ports redirected to the proxy of the Deployment
+// behind a Service. This is the inverse of tapService. The proxy sidecar and its
+// artifacts are removed once no other Service is tapped through it.
+func untapService(client kubernetes.Interface, namespace, targetSvcName string) error {
+	servicesClient := client.CoreV1().Services(namespace)
+
+	targetService, err := servicesClient.Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	dpl, err := deploymentFromSelectors(client.AppsV1().Deployments(namespace), targetService.Spec.Selector)
+	if err != nil {
+		return err
+	}
+	if dpl.Namespace != namespace {
+		return ErrDeploymentOutsideNamespace
+	}
+	return untapServices(client, dpl, []string{targetSvcName})
+}
+
+// untapServices removes Services from the proxy of a Deployment and restores their ports.
+// The proxy keeps tapping the other Services, which are counted from its options, and is
+// removed with the last one.
+func untapServices(client kubernetes.Interface, dpl k8sappsv1.Deployment, svcNames []string) error {
+	namespace := dpl.Namespace
+	servicesClient := client.CoreV1().Services(namespace)
+
+	untapped := make(map[string]bool)
+	for _, name := range svcNames {
+		untapped[name] = true
+	}
+	// the proxy is only removed once it is known to tap no other Services, which would
+	// lose their traffic otherwise
+	var remaining []ProxyUpstream
+	var proxyOpts ProxyOptions
+	if hasSidecar(dpl) {
+		var err error
+		proxyOpts, err = loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		switch {
+		case err == nil:
+			for _, u := range tapUpstreams(servicesClient, proxyOpts) {
+				if !untapped[u.Service] {
+					remaining = append(remaining, u)
 				}
 			}
-			deployment.Spec.Template.Spec.Volumes = volumes
-			anns := deployment.Spec.Template.GetAnnotations()
-			if anns != nil {
-				delete(anns, annotationIsTapped)
-				deployment.Spec.Template.SetAnnotations(anns)
+		case errors.Is(err, ErrProxyOptionsMissing), k8serrors.IsNotFound(err):
+			// taps of earlier versions of kubetap, or proxies whose ConfigMap is gone, only
+			// tell the Services they tap by the annotations of the Services
+			others, err := annotatedServices(servicesClient, dpl)
+			if err != nil {
+				return err
 			}
-			_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
-			return updateErr
-		})
-		if retryErr != nil {
-			return fmt.Errorf("failed to remove sidecars from Deployment: %w", retryErr)
+			var kept []string
+			for _, name := range others {
+				if !untapped[name] {
+					kept = append(kept, name)
+				}
+			}
+			if len(kept) > 0 {
+				return fmt.Errorf("the proxy options of Deployment %q are missing, and its proxy also taps %s, which must be untapped together", dpl.Name, quoteNames(kept))
+			}
+		default:
+			return fmt.Errorf("error reading the options of the proxy of Deployment %q: %w", dpl.Name, err)
+		}
+	}
+
+	if len(remaining) > 0 {
+		proxyOpts.setUpstreams(remaining)
+		if _, err := extendSidecar(client, proxyOpts, dpl); err != nil {
+			return err
 		}
-		if err := untapSvc(servicesClient, targetSvcName); err != nil {
+	} else if err := removeSidecar(client, dpl); err != nil {
+		return err
+	}
+	for _, name := range svcNames {
+		if err := untapSvc(servicesClient, name); err != nil {
 			return err
 		}
-		fmt.Fprintf(cmd.OutOrStdout(), "Untapped Service %q\n", targetSvcName)
+	}
+	return nil
+}
+
+// removeSidecar removes the proxy sidecar and its artifacts from a Deployment.
+func removeSidecar(client kubernetes.Interface, dpl k8sappsv1.Deployment) error {
+	deploymentsClient := client.AppsV1().Deployments(dpl.Namespace)
+	proxy := NewMitmproxy(client, ProxyOptions{
+		Namespace: dpl.Namespace,
+		dplName:   dpl.Name,
+	})
+
+	if err := proxy.UnreadyEnv(); err != nil {
+		// both error types below can be thrown
+		if !errors.Is(ErrConfigMapNoMatch, err) {
+			return err
+		}
+	}
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// Explicitly re-fetch the deployment to reduce the chance of having a race
+		deployment, getErr := deploymentsClient.Get(context.TODO(), dpl.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		var containersNoProxy []v1.Container
+		for _, c := range deployment.Spec.Template.Spec.Containers {
+			if c.Name != kubetapContainerName {
+				containersNoProxy = append(containersNoProxy, c)
+			}
+		}
+		deployment.Spec.Template.Spec.Containers = containersNoProxy
+		var volumes []v1.Volume
+		for _, v := range deployment.Spec.Template.Spec.Volumes {
+			if !strings.HasPrefix(v.Name, "kubetap") {
+				volumes = append(volumes, v)
+			}
+		}
+		deployment.Spec.Template.Spec.Volumes = volumes
+		anns := deployment.Spec.Template.GetAnnotations()
+		if anns != nil {
+			delete(anns, annotationIsTapped)
+			delete(anns, annotationRestartedAt)
+			deployment.Spec.Template.SetAnnotations(anns)
+		}
+		_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if retryErr != nil {
+		return fmt.Errorf("failed to remove sidecars from Deployment: %w", retryErr)
+	}
+	return nil
+}
+
+// tappedServices returns the names of the Services tapped through the proxy of a
+// Deployment.
+func tappedServices(client kubernetes.Interface, namespace, dplName string) []string {
+	proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dplName)
+	if err != nil {
 		return nil
 	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, u := range tapUpstreams(client.CoreV1().Services(namespace), proxyOpts) {
+		if !seen[u.Service] {
+			seen[u.Service] = true
+			names = append(names, u.Service)
+		}
+	}
+	return names
+}
+
+// annotatedServices returns the names of the tapped Services selecting a Deployment,
+// as told by their annotations.
+func annotatedServices(servicesClient corev1.ServiceInterface, dpl k8sappsv1.Deployment) ([]string, error) {
+	services, err := servicesClient.List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, svc := range services.Items {
+		if svc.Annotations[annotationOriginalTargetPort] == "" || len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(dpl.Labels)) {
+			names = append(names, svc.Name)
+		}
+	}
+	return names, nil
 }
 
 // deploymentFromSelectors returns a deployment given selector labels.
@@ -606,29 +1261,10 @@ func deploymentFromSelectors(deploymentsClient appsv1.DeploymentInterface, selec
 	}
 }
 
-// kubetapPod returns a kubetap pod matching a given Deployment name and Namespace.
-func kubetapPod(podClient corev1.PodInterface, deploymentName string) (v1.Pod, error) {
-	pods, err := podClient.List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return v1.Pod{}, err
-	}
-	var p v1.Pod
-	for _, pod := range pods.Items {
-		anns := pod.GetAnnotations()
-		if anns == nil {
-			continue
-		}
-		for k, v := range anns {
-			if k == annotationIsTapped && v == deploymentName {
-				return pod, nil
-			}
-		}
-	}
-	return p, ErrKubetapPodNoMatch
-}
-
-// tapSvc modifies a target port to point to a new proxy service.
-func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32) error {
+// tapSvc points the given Service ports to the listen ports of the proxy. If exposeWeb is
+// set, the proxy web interface is added to the Service ports as well. The audit record,
+// if any, is stored on the Service.
+func tapSvc(svcClient corev1.ServiceInterface, svcName string, listenPorts map[int32]int32, exposeWeb bool, audit *tapAudit) error {
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		svc, getErr := svcClient.Get(context.TODO(), svcName, metav1.GetOptions{})
 		if getErr != nil {
@@ -646,36 +1282,39 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 		if anns[annotationOriginalTargetPort] != "" {
 			return ErrServiceTapped
 		}
-		var targetSvcPort v1.ServicePort
-		var hasPort bool
+		originalPorts := make(map[int32]intstr.IntOrString)
 		for _, sp := range svc.Spec.Ports {
-			if sp.Port == targetPort {
-				hasPort = true
-				targetSvcPort = sp
+			if _, ok := listenPorts[sp.Port]; ok {
+				originalPorts[sp.Port] = sp.TargetPort
 			}
 		}
-		if !hasPort {
+		if len(originalPorts) != len(listenPorts) {
 			return ErrServiceMissingPort
 		}
 
-		anns[annotationOriginalTargetPort] = targetSvcPort.TargetPort.String()
+		anns[annotationOriginalTargetPort] = originalTargetPortsAnnotation(originalPorts, listenPorts)
+		if audit != nil {
+			anns[annotationAudit] = audit.annotation()
+		}
 		svc.SetAnnotations(anns)
 
-		proxySvcPort := v1.ServicePort{
-			Name:       kubetapServicePortName,
-			Port:       kubetapProxyWebInterfacePort,
-			TargetPort: intstr.FromInt(int(kubetapProxyWebInterfacePort)),
+		if exposeWeb {
+			proxySvcPort := v1.ServicePort{
+				Name:       kubetapServicePortName,
+				Port:       kubetapProxyWebInterfacePort,
+				TargetPort: intstr.FromInt(int(kubetapProxyWebInterfacePort)),
+			}
+			svc.Spec.Ports = append(svc.Spec.Ports, proxySvcPort)
 		}
-		svc.Spec.Ports = append(svc.Spec.Ports, proxySvcPort)
 
 		// then do the swap and build a new ports list
 		var servicePorts []v1.ServicePort
 		for _, sp := range svc.Spec.Ports {
-			if sp.Port == targetSvcPort.Port {
+			if listenPort, ok := listenPorts[sp.Port]; ok {
 				if sp.Name == "" {
 					sp.Name = kubetapPortName
 				}
-				sp.TargetPort = intstr.FromInt(kubetapProxyListenPort)
+				sp.TargetPort = intstr.FromInt(int(listenPort))
 			}
 			servicePorts = append(servicePorts, sp)
 		}
@@ -690,6 +1329,56 @@ func tapSvc(svcClient corev1.ServiceInterface, svcName string, targetPort int32)
 	return nil
 }
 
+// originalTargetPortsAnnotation renders the original target ports of a tapped Service.
+// A single port redirected to kubetapProxyListenPort is stored as its target port alone,
+// as done by earlier versions of kubetap. Otherwise each tapped port is listed as
+// port=targetPort, separated by commas.
+func originalTargetPortsAnnotation(originalPorts map[int32]intstr.IntOrString, listenPorts map[int32]int32) string {
+	if len(originalPorts) == 1 {
+		for port, target := range originalPorts {
+			if listenPorts[port] == kubetapProxyListenPort {
+				return target.String()
+			}
+		}
+	}
+	ports := make([]int, 0, len(originalPorts))
+	for port := range originalPorts {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	pairs := make([]string, len(ports))
+	for i, port := range ports {
+		target := originalPorts[int32(port)]
+		pairs[i] = fmt.Sprintf("%d=%s", port, target.String())
+	}
+	return strings.Join(pairs, ",")
+}
+
+// originalTargetPorts parses the annotationOriginalTargetPort annotation, returning the
+// original target port of each tapped Service port. A single target port, the format of
+// earlier versions of kubetap, is returned for port 0 and applies to the Service port
+// redirected to kubetapProxyListenPort.
+func originalTargetPorts(value string) map[int32]intstr.IntOrString {
+	ports := make(map[int32]intstr.IntOrString)
+	if value == "" {
+		return ports
+	}
+	if !strings.Contains(value, "=") {
+		// NOTE: it is critical to Parse here (vs FromString)
+		ports[0] = intstr.Parse(value)
+		return ports
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		port, err := strconv.Atoi(kv[0])
+		if err != nil || len(kv) != 2 {
+			continue
+		}
+		ports[int32(port)] = intstr.Parse(kv[1])
+	}
+	return ports
+}
+
 // untapSvc modifies a target port point to the original service, not our proxy sidecar.
 func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
@@ -697,18 +1386,21 @@ func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 		if getErr != nil {
 			return getErr
 		}
-		// NOTE: it is critical to Parse here (vs FromString)
-		origSvcTargetPort := intstr.Parse(svc.GetAnnotations()[annotationOriginalTargetPort])
+		originalPorts := originalTargetPorts(svc.GetAnnotations()[annotationOriginalTargetPort])
 		var servicePorts []v1.ServicePort
 		for _, sp := range svc.Spec.Ports {
 			if sp.Name == kubetapServicePortName {
 				continue
 			}
-			if sp.TargetPort.IntValue() == kubetapProxyListenPort {
+			target, ok := originalPorts[sp.Port]
+			if legacy, isLegacy := originalPorts[0]; isLegacy {
+				target, ok = legacy, sp.TargetPort.IntValue() == kubetapProxyListenPort
+			}
+			if ok {
 				if sp.Name == kubetapPortName {
 					sp.Name = ""
 				}
-				sp.TargetPort = origSvcTargetPort
+				sp.TargetPort = target
 			}
 			servicePorts = append(servicePorts, sp)
 		}
@@ -716,7 +1408,7 @@ func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 		anns := svc.GetAnnotations()
 		newAnns := make(map[string]string)
 		for k, v := range anns {
-			if k != annotationOriginalTargetPort {
+			if k != annotationOriginalTargetPort && k != annotationAudit {
 				newAnns[k] = v
 			}
 		}
@@ -730,6 +1422,16 @@ func untapSvc(svcClient corev1.ServiceInterface, svcName string) error {
 	return nil
 }
 
+// targetNamespace returns the namespace to work in. main resolves it from --namespace and
+// the current kubeconfig context, like kubectl does, so defaultNamespace is only used
+// when neither is known.
+func targetNamespace(viper *viper.Viper) string {
+	if namespace := viper.GetString("namespace"); namespace != "" {
+		return namespace
+	}
+	return defaultNamespace
+}
+
 // hasNamespace checks if a given Namespace exists.
 func hasNamespace(client kubernetes.Interface, namespace string) (bool, error) {
 	if namespace == "" {
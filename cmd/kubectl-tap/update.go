@@ -0,0 +1,400 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/util/retry"
+)
+
+// mitmwebRequestTimeout bounds each call to the mitmweb API, including establishing
+// the port-forward to reach it.
+const mitmwebRequestTimeout = 15 * time.Second
+
+var (
+	ErrServiceNotTapped = errors.New("the target Service has not been tapped")
+	ErrNothingToUpdate  = errors.New("nothing to update")
+	ErrMitmwebOptions   = errors.New("mitmweb did not accept the options")
+)
+
+// NewUpdateCommand changes an active tap without untapping and re-tapping the Service.
+// The Deployment is only rolled if the sidecar itself changed, or if a proxy option
+// cannot be applied to the running proxy.
+func NewUpdateCommand(client kubernetes.Interface, config *rest.Config, viper *viper.Viper) func(*cobra.Command, []string) error { //nolint: gocyclo
+	return func(cmd *cobra.Command, args []string) error {
+		targetSvcName := args[0]
+		namespace := targetNamespace(viper)
+		exists, err := hasNamespace(client, namespace)
+		if err != nil {
+			return fmt.Errorf("error fetching namespaces: %w", err)
+		}
+		if !exists {
+			return ErrNamespaceNotExist
+		}
+		scripts, err := mitmproxyScriptsFromFlags(viper.GetStringSlice("scripts"))
+		if err != nil {
+			return err
+		}
+		extraOptions, err := mitmproxyOptionsFromFlags(viper.GetStringSlice("proxySet"), viper.GetString("proxyConfig"))
+		if err != nil {
+			return err
+		}
+		setHeaders, err := headerRulesFromFlags(viper.GetStringSlice("setHeaders"))
+		if err != nil {
+			return err
+		}
+		replaceBody, err := bodyRulesFromFlags(viper.GetStringSlice("replaceBody"))
+		if err != nil {
+			return err
+		}
+		mapLocal, mapLocalFiles, err := mapLocalRulesFromFlags(viper.GetStringSlice("mapLocal"))
+		if err != nil {
+			return err
+		}
+		redact, err := redactPatternsFromFlags(viper.GetStringSlice("redact"))
+		if err != nil {
+			return err
+		}
+		// an empty --redact value removes the current patterns
+		redactChanged := len(viper.GetStringSlice("redact")) > 0 || viper.IsSet("redactDefaults")
+		clearRewrites := viper.GetBool("clearRewrites")
+		rewrites := len(setHeaders) > 0 || len(replaceBody) > 0 || len(mapLocal) > 0 || clearRewrites
+		mirrorTo := viper.GetString("mirrorTo")
+		if mirrorTo != "" {
+			if err := validateMirrorTarget(client, namespace, mirrorTo); err != nil {
+				return err
+			}
+		}
+		if len(scripts) == 0 && len(extraOptions) == 0 && !rewrites && !redactChanged && !viper.IsSet("mirrorTo") && !viper.IsSet("https") && !viper.IsSet("proxyImage") && !viper.IsSet("commandArgs") {
+			return fmt.Errorf("%w, see kubectl tap update --help", ErrNothingToUpdate)
+		}
+
+		targetService, err := client.CoreV1().Services(namespace).Get(context.TODO(), targetSvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if targetService.Annotations[annotationOriginalTargetPort] == "" {
+			return ErrServiceNotTapped
+		}
+		deploymentsClient := client.AppsV1().Deployments(namespace)
+		dpl, err := deploymentFromSelectors(deploymentsClient, targetService.Spec.Selector)
+		if err != nil {
+			return err
+		}
+
+		proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dpl.Name)
+		if err != nil {
+			return err
+		}
+		if viper.IsSet("https") {
+			proxyOpts.UpstreamHTTPS = viper.GetBool("https")
+			// the ports of other Services sharing the proxy keep their scheme
+			for i, u := range proxyOpts.Upstreams {
+				if u.Service == targetSvcName {
+					proxyOpts.Upstreams[i].HTTPS = proxyOpts.UpstreamHTTPS
+				}
+			}
+		}
+		if viper.IsSet("proxyImage") {
+			proxyOpts.Image = viper.GetString("proxyImage")
+		}
+		if viper.IsSet("commandArgs") {
+			proxyOpts.CommandArgs = strings.Fields(viper.GetString("commandArgs"))
+		}
+		if viper.IsSet("mirrorTo") {
+			// an empty target stops mirroring
+			proxyOpts.MirrorTo = mirrorTo
+		}
+		if len(viper.GetStringSlice("redact")) > 0 {
+			proxyOpts.Redact = redact
+		}
+		if viper.IsSet("redactDefaults") {
+			proxyOpts.NoDefaultRedaction = !viper.GetBool("redactDefaults")
+		}
+		if proxyOpts.ExtraOptions == nil {
+			proxyOpts.ExtraOptions = make(map[string]interface{})
+		}
+		for k, v := range extraOptions {
+			proxyOpts.ExtraOptions[k] = v
+		}
+		for name, script := range scripts {
+			proxyOpts.Scripts[name] = script
+		}
+		// rewrite rules given on the command line replace the current rules of their kind
+		if clearRewrites {
+			proxyOpts.SetHeaders = nil
+			proxyOpts.ReplaceBody = nil
+			proxyOpts.MapLocal = nil
+			proxyOpts.MapLocalFiles = nil
+		}
+		if len(setHeaders) > 0 {
+			proxyOpts.SetHeaders = setHeaders
+		}
+		if len(replaceBody) > 0 {
+			proxyOpts.ReplaceBody = replaceBody
+		}
+		if len(mapLocal) > 0 {
+			proxyOpts.MapLocal = mapLocal
+			proxyOpts.MapLocalFiles = mapLocalFiles
+		}
+
+		proxy := NewMitmproxy(client, proxyOpts)
+		update, err := proxy.UpdateEnv()
+		if err != nil {
+			return err
+		}
+
+		// Update the sidecar, which rolls the Deployment and loads the new ConfigMap.
+		var current v1.Container
+		for _, c := range dpl.Spec.Template.Spec.Containers {
+			if c.Name == kubetapContainerName {
+				current = c
+			}
+		}
+		sidecar := proxy.Sidecar(dpl.Name)
+		sidecar.Image = current.Image
+		if viper.IsSet("proxyImage") {
+			sidecar.Image = proxyOpts.Image
+		}
+		sidecar.Args = current.Args
+		if viper.IsSet("commandArgs") {
+			sidecar.Args = proxyOpts.CommandArgs
+		}
+		if sidecar.Image != current.Image || !reflect.DeepEqual(sidecar.Args, current.Args) {
+			if err := updateSidecar(deploymentsClient, dpl.Name, sidecar); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Updated the tap of Service %q, rolling Deployment %q with the new sidecar.\n", targetSvcName, dpl.Name)
+			return nil
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Updated the tap of Service %q.\n", targetSvcName)
+		if err := applyTapUpdate(cmd, client, config, namespace, dpl.Name, update); err != nil {
+			return err
+		}
+		if len(scripts) > 0 {
+			fmt.Fprintf(cmd.OutOrStdout(), "mitmproxy reloads changed scripts once the ConfigMap change reaches the Pod, usually within a minute.\n")
+		}
+		return nil
+	}
+}
+
+// applyTapUpdate brings the running proxy in line with an updated environment, applying
+// changed options through the mitmweb API where possible and restarting the Deployment
+// otherwise.
+func applyTapUpdate(cmd *cobra.Command, client kubernetes.Interface, config *rest.Config, namespace, deploymentName string, update TapUpdate) error {
+	deploymentsClient := client.AppsV1().Deployments(namespace)
+	switch {
+	case update.Restart:
+		if err := restartDeployment(deploymentsClient, deploymentName); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "The proxy cannot apply the change while running, restarting Deployment %q.\n", deploymentName)
+	case len(update.Options) > 0:
+		if err := setMitmwebOptions(client, config, namespace, deploymentName, update.Options); err != nil {
+			if err := restartDeployment(deploymentsClient, deploymentName); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Could not apply options to the running proxy (%v), restarting Deployment %q instead.\n", err, deploymentName)
+			return nil
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Applied the changed options to the running proxy.\n")
+	}
+	return nil
+}
+
+// updateSidecar replaces the kubetap container of a Deployment.
+func updateSidecar(deploymentsClient appsv1.DeploymentInterface, name string, sidecar v1.Container) error {
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, getErr := deploymentsClient.Get(context.TODO(), name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		for i, c := range deployment.Spec.Template.Spec.Containers {
+			if c.Name == kubetapContainerName {
+				deployment.Spec.Template.Spec.Containers[i] = sidecar
+			}
+		}
+		_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if retryErr != nil {
+		return fmt.Errorf("failed to update the sidecar: %w", retryErr)
+	}
+	return nil
+}
+
+// restartDeployment rolls the Pods of a Deployment, the same way "kubectl rollout restart" does.
+func restartDeployment(deploymentsClient appsv1.DeploymentInterface, name string) error {
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, getErr := deploymentsClient.Get(context.TODO(), name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		anns := deployment.Spec.Template.GetAnnotations()
+		if anns == nil {
+			anns = map[string]string{}
+		}
+		anns[annotationRestartedAt] = time.Now().Format(time.RFC3339)
+		deployment.Spec.Template.SetAnnotations(anns)
+		_, updateErr := deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+		return updateErr
+	})
+	if retryErr != nil {
+		return fmt.Errorf("failed to restart Deployment: %w", retryErr)
+	}
+	return nil
+}
+
+// setMitmwebOptions applies options to every ready kubetap Pod of a Deployment through
+// the mitmweb API, port-forwarding to each Pod for the duration of the call.
+func setMitmwebOptions(client kubernetes.Interface, config *rest.Config, namespace, deploymentName string, options map[string]interface{}) error {
+	password, err := webPassword(client.CoreV1().Secrets(namespace), deploymentName)
+	if err != nil {
+		return err
+	}
+	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, pod := range pods.Items {
+		if !isTapPod(pod, deploymentName) || !podReady(pod) {
+			continue
+		}
+		found = true
+		if err := setPodMitmwebOptions(config, namespace, pod.Name, password, options); err != nil {
+			return fmt.Errorf("Pod %q: %w", pod.Name, err)
+		}
+	}
+	if !found {
+		return ErrKubetapPodNoMatch
+	}
+	return nil
+}
+
+// setPodMitmwebOptions port-forwards a random local port to the mitmweb port of a Pod
+// and sets options through it, authenticating with password if it is not empty.
+func setPodMitmwebOptions(config *rest.Config, namespace, podName, password string, options map[string]interface{}) error {
+	dialer, err := podPortForwardDialer(config, namespace, podName)
+	if err != nil {
+		return err
+	}
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	fw, err := portforward.New(dialer, []string{":" + strconv.Itoa(kubetapProxyWebInterfacePort)}, stopCh, readyCh, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	fwErrCh := make(chan error, 1)
+	go func() {
+		fwErrCh <- fw.ForwardPorts()
+	}()
+	defer close(stopCh)
+	select {
+	case <-readyCh:
+	case err := <-fwErrCh:
+		return fmt.Errorf("port-forward failed: %w", err)
+	case <-time.After(mitmwebRequestTimeout):
+		return fmt.Errorf("timed out establishing port-forward")
+	}
+	ports, err := fw.GetPorts()
+	if err != nil {
+		return err
+	}
+	return putMitmwebOptions(fmt.Sprintf("http://127.0.0.1:%d", ports[0].Local), password, options)
+}
+
+// putMitmwebOptions sets options through the mitmweb API at baseURL. mitmweb rejects
+// changes that do not echo back the XSRF token from the cookie it sets on first visit.
+// A password is passed as the token mitmweb exchanges for its authentication cookie,
+// and as a bearer token.
+func putMitmwebOptions(baseURL, password string, options map[string]interface{}) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Jar: jar, Timeout: mitmwebRequestTimeout}
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		req.URL.RawQuery = url.Values{"token": []string{password}}.Encode()
+		req.Header.Set("Authorization", "Bearer "+password)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: the web interface rejected the password: %s", ErrMitmwebOptions, resp.Status)
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	var xsrf string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "_xsrf" {
+			xsrf = c.Value
+		}
+	}
+
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequest(http.MethodPut, baseURL+"/options", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-XSRFToken", xsrf)
+	if password != "" {
+		req.Header.Set("Authorization", "Bearer "+password)
+	}
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %s: %s", ErrMitmwebOptions, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
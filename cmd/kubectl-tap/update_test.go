@@ -0,0 +1,174 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_NewUpdateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubetap")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "token_swap.py")
+	require.Nil(t, ioutil.WriteFile(script, []byte("def request(flow):\n    pass\n"), 0600))
+
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Tap        bool
+		Scripts    []string
+		Err        error
+	}{
+		{"simple", fakeClientUntappedSimple, true, []string{script}, nil},
+		{"untapped", fakeClientUntappedSimple, false, []string{script}, ErrServiceNotTapped},
+		{"no_changes", fakeClientUntappedSimple, true, nil, ErrNothingToUpdate},
+		{"not_python", fakeClientUntappedSimple, true, []string{filepath.Join(dir, "config.yaml")}, ErrScriptInvalid},
+		{"no_proxy_options", fakeClientTappedSimple, false, []string{script}, ErrProxyOptionsMissing},
+		{"no_namespace_in_cluster", fakeClientUntappedWithoutNamespace, false, []string{script}, ErrNamespaceNotExist},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := tc.ClientFunc()
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			if tc.Tap {
+				tapViper := viper.New()
+				tapViper.Set("proxyPort", 80)
+				require.Nil(NewTapCommand(fakeClient, &rest.Config{}, tapViper)(cmd, []string{"sample-service"}))
+				b.Reset()
+			}
+			testViper := viper.New()
+			testViper.Set("scripts", tc.Scripts)
+			err := NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"})
+			if tc.Err != nil {
+				require.True(errors.Is(err, tc.Err), "expected (%q), got (%q)", tc.Err, err)
+				return
+			}
+			require.Nil(err)
+			// there are no tap Pods to apply the new scripts option to, so the proxy is restarted
+			require.Contains(b.String(), "restarting Deployment")
+
+			cm, err := fakeClient.CoreV1().ConfigMaps("default").Get(context.TODO(), kubetapConfigMapPrefix+"sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.Contains(cm.BinaryData, "token_swap.py")
+			var options map[string]interface{}
+			require.Nil(yaml.Unmarshal(cm.BinaryData[mitmproxyConfigFile], &options))
+			require.Equal([]interface{}{mitmproxyConfigDir + mitmproxyFaultsAddon, mitmproxyConfigDir + mitmproxyMirrorAddon, mitmproxyConfigDir + mitmproxyRedactAddon, mitmproxyConfigDir + "token_swap.py"}, options["scripts"])
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			require.NotEmpty(dpl.Spec.Template.Annotations[annotationRestartedAt])
+
+			// replacing a script that is already loaded must not restart the proxy
+			b.Reset()
+			require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			require.NotContains(b.String(), "restarting Deployment")
+		})
+	}
+}
+
+func Test_NewUpdateCommandSidecar(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	tapViper := viper.New()
+	tapViper.Set("proxyPort", 80)
+	tapViper.Set("proxyImage", defaultImageHTTP)
+	tapViper.Set("commandArgs", "mitmweb")
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, tapViper)(cmd, []string{"sample-service"}))
+
+	// an unchanged image must leave the Deployment alone
+	testViper := viper.New()
+	testViper.Set("proxyImage", defaultImageHTTP)
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	require.Empty(dpl.Spec.Template.Annotations[annotationRestartedAt])
+
+	testViper.Set("proxyImage", "example.com/kubetap-mitmproxy:test")
+	require.Nil(NewUpdateCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+	dpl, err = fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+	require.Nil(err)
+	var image string
+	for _, c := range dpl.Spec.Template.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			image = c.Image
+		}
+	}
+	require.Equal("example.com/kubetap-mitmproxy:test", image)
+	require.Empty(dpl.Spec.Template.Annotations[annotationRestartedAt])
+}
+
+func Test_PutMitmwebOptions(t *testing.T) {
+	require := require.New(t)
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/":
+			if r.URL.Query().Get("token") != "secret" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "_xsrf", Value: "token"})
+			http.SetCookie(w, &http.Cookie{Name: "mitmproxy-auth", Value: "authenticated"})
+		case r.Method == http.MethodPut && r.URL.Path == "/options":
+			if c, err := r.Cookie("mitmproxy-auth"); err != nil || c.Value != "authenticated" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			c, err := r.Cookie("_xsrf")
+			if err != nil || c.Value != r.Header.Get("X-XSRFToken") {
+				http.Error(w, "'_xsrf' argument missing from POST", http.StatusForbidden)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, ok := got["not_an_option"]; ok {
+				http.Error(w, "Unknown option", http.StatusBadRequest)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	require.Nil(putMitmwebOptions(srv.URL, "secret", map[string]interface{}{"anticache": true}))
+	require.Equal(map[string]interface{}{"anticache": true}, got)
+	err := putMitmwebOptions(srv.URL, "secret", map[string]interface{}{"not_an_option": true})
+	require.True(errors.Is(err, ErrMitmwebOptions), "expected (%q), got (%q)", ErrMitmwebOptions, err)
+	err = putMitmwebOptions(srv.URL, "wrong", map[string]interface{}{"anticache": true})
+	require.True(errors.Is(err, ErrMitmwebOptions), "expected (%q), got (%q)", ErrMitmwebOptions, err)
+}
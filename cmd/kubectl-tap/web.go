@@ -0,0 +1,118 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+const (
+	// kubetapWebSecretPrefix prefixes the Secret holding the web interface password of a
+	// tapped Deployment.
+	kubetapWebSecretPrefix = "kubetap-web-"
+	// webPasswordKey is the Secret key of the web interface password.
+	webPasswordKey = "password"
+	// webPasswordEnv passes the web interface password to the entrypoint of the sidecar.
+	webPasswordEnv = "KUBETAP_WEB_PASSWORD"
+	// webPasswordBytes is the entropy of generated passwords.
+	webPasswordBytes = 24
+)
+
+// isExternalService reports whether the ports of a Service are reachable from outside the
+// cluster, in which case adding the web interface port to it also exposes the proxy.
+func isExternalService(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeLoadBalancer || svc.Spec.Type == v1.ServiceTypeNodePort
+}
+
+// generateWebPassword returns a random password for the web interface.
+func generateWebPassword() (string, error) {
+	b := make([]byte, webPasswordBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating the web interface password: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createWebPasswordSecret stores a new random web interface password for a tapped
+// Deployment, replacing the Secret left over by a previous tap.
+func createWebPasswordSecret(secretsClient corev1.SecretInterface, deploymentName string) error {
+	password, err := generateWebPassword()
+	if err != nil {
+		return err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: kubetapWebSecretPrefix + deploymentName,
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			webPasswordKey: []byte(password),
+		},
+	}
+	_, err = secretsClient.Create(context.TODO(), secret, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("error storing the web interface password: %w", err)
+	}
+	return nil
+}
+
+// destroyWebPasswordSecret deletes the web interface password of a tapped Deployment.
+func destroyWebPasswordSecret(secretsClient corev1.SecretInterface, deploymentName string) error {
+	err := secretsClient.Delete(context.TODO(), kubetapWebSecretPrefix+deploymentName, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// webPassword returns the web interface password of a tapped Deployment, or an empty
+// string for taps created before the web interface required one.
+func webPassword(secretsClient corev1.SecretInterface, deploymentName string) (string, error) {
+	secret, err := secretsClient.Get(context.TODO(), kubetapWebSecretPrefix+deploymentName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error fetching the web interface password: %w", err)
+	}
+	return string(secret.Data[webPasswordKey]), nil
+}
+
+// webPasswordEnvVar passes the web interface password of a tapped Deployment to the
+// sidecar. It is optional so that Pods still start if the Secret is missing, in which
+// case mitmweb generates a password of its own.
+func webPasswordEnvVar(deploymentName string) v1.EnvVar {
+	optional := true
+	return v1.EnvVar{
+		Name: webPasswordEnv,
+		ValueFrom: &v1.EnvVarSource{
+			SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: kubetapWebSecretPrefix + deploymentName},
+				Key:                  webPasswordKey,
+				Optional:             &optional,
+			},
+		},
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_NewTapCommandWebPassword(t *testing.T) {
+	tests := []struct {
+		Name        string
+		ServiceType v1.ServiceType
+		ExposeWeb   bool
+		WebTarget   string
+		Warning     bool
+	}{
+		{"expose_web", v1.ServiceTypeClusterIP, true, "svc/sample-service", false},
+		{"pod_only", v1.ServiceTypeClusterIP, false, "deploy/sample-deployment", false},
+		{"load_balancer", v1.ServiceTypeLoadBalancer, false, "deploy/sample-deployment", false},
+		{"load_balancer_expose_web", v1.ServiceTypeLoadBalancer, true, "svc/sample-service", true},
+		{"node_port_expose_web", v1.ServiceTypeNodePort, true, "svc/sample-service", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			fakeClient := fakeClientUntappedSimple()
+			svc, err := fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			svc.Spec.Type = tc.ServiceType
+			_, err = fakeClient.CoreV1().Services("default").Update(context.TODO(), svc, metav1.UpdateOptions{})
+			require.Nil(err)
+			b := bytes.NewBufferString("")
+			cmd := &cobra.Command{}
+			cmd.SetOutput(b)
+			testViper := viper.New()
+			testViper.Set("proxyPort", 80)
+			testViper.Set("exposeWeb", tc.ExposeWeb)
+			require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+			password, err := webPassword(fakeClient.CoreV1().Secrets("default"), "sample-deployment")
+			require.Nil(err)
+			require.Len(password, webPasswordBytes*2)
+			require.Contains(b.String(), "The web interface password is "+password)
+			require.Contains(b.String(), "kubectl port-forward "+tc.WebTarget+" -n default 2244:2244")
+			require.Equal(tc.Warning, strings.Contains(b.String(), "reachable from outside the cluster"))
+
+			dpl, err := fakeClient.AppsV1().Deployments("default").Get(context.TODO(), "sample-deployment", metav1.GetOptions{})
+			require.Nil(err)
+			var env []string
+			for _, c := range dpl.Spec.Template.Spec.Containers {
+				for _, e := range c.Env {
+					if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil {
+						env = append(env, e.Name+"="+e.ValueFrom.SecretKeyRef.Name)
+					}
+				}
+			}
+			require.Equal([]string{webPasswordEnv + "=" + kubetapWebSecretPrefix + "sample-deployment"}, env)
+
+			svc, err = fakeClient.CoreV1().Services("default").Get(context.TODO(), "sample-service", metav1.GetOptions{})
+			require.Nil(err)
+			var exposed bool
+			for _, p := range svc.Spec.Ports {
+				if p.Name == kubetapServicePortName {
+					exposed = true
+				}
+			}
+			require.Equal(tc.ExposeWeb, exposed)
+
+			require.Nil(NewUntapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+			_, err = fakeClient.CoreV1().Secrets("default").Get(context.TODO(), kubetapWebSecretPrefix+"sample-deployment", metav1.GetOptions{})
+			require.True(k8serrors.IsNotFound(err), "the web interface password was not removed: %v", err)
+		})
+	}
+}
+
+func Test_CreateWebPasswordSecret(t *testing.T) {
+	require := require.New(t)
+	secretsClient := fakeClientUntappedSimple().CoreV1().Secrets("default")
+	require.Nil(createWebPasswordSecret(secretsClient, "sample-deployment"))
+	first, err := webPassword(secretsClient, "sample-deployment")
+	require.Nil(err)
+	// a Secret left over by a previous tap is replaced with a new password
+	require.Nil(createWebPasswordSecret(secretsClient, "sample-deployment"))
+	second, err := webPassword(secretsClient, "sample-deployment")
+	require.Nil(err)
+	require.NotEqual(first, second)
+
+	password, err := webPassword(secretsClient, "other-deployment")
+	require.Nil(err)
+	require.Empty(password)
+}
@@ -0,0 +1,605 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	k8sappsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	kubetapSystemNamespace = "kubetap-system"
+	kubetapWebhookName     = "kubetap-webhook"
+	kubetapWebhookTLSName  = "kubetap-webhook-tls"
+	webhookListenPort      = 8443
+	webhookPath            = "/mutate"
+	webhookCertValidity    = 5 * 365 * 24 * time.Hour
+	webhookTimeoutSeconds  = 5
+
+	// labelTapEnabled opts a Namespace or Pod into the webhook, labelTapDisabled opts a
+	// Pod of a labeled Namespace out of it.
+	labelTapEnabled  = "enabled"
+	labelTapDisabled = "disabled"
+)
+
+var ErrWebhookBadRequest = errors.New("the admission request could not be decoded")
+
+// jsonPatchOp is a single RFC 6902 JSON Patch operation.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// NewInstallWebhookCommand installs the kubetap mutating admission webhook, which injects
+// the kubetap sidecar into Pods whose Namespace or Pod template carry the tap label.
+func NewInstallWebhookCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		image := viper.GetString("webhookImage")
+		if image == "" {
+			image = defaultImageKubetap
+		}
+		proxyImage := viper.GetString("proxyImage")
+		if proxyImage == "" {
+			proxyImage = defaultImageHTTP
+		}
+		commandArgs := viper.GetString("commandArgs")
+		if commandArgs == "" {
+			commandArgs = "mitmweb"
+		}
+
+		caPEM, certPEM, keyPEM, err := webhookCertificates(kubetapWebhookName + "." + kubetapSystemNamespace + ".svc")
+		if err != nil {
+			return fmt.Errorf("error generating webhook certificates: %w", err)
+		}
+		if err := installWebhookResources(client, image, proxyImage, commandArgs, certPEM, keyPEM); err != nil {
+			return err
+		}
+		if err := applyMutatingWebhookConfiguration(client, webhookConfiguration(caPEM)); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Installed the kubetap webhook in the %s namespace.\n\n", kubetapSystemNamespace)
+		fmt.Fprintf(cmd.OutOrStdout(), "Pods are injected with the kubetap sidecar when their Namespace or Pod template\n")
+		fmt.Fprintf(cmd.OutOrStdout(), "is labeled %s=%s and their Deployment has been tapped with kubectl tap on:\n\n", labelTap, labelTapEnabled)
+		fmt.Fprintf(cmd.OutOrStdout(), "  kubectl label namespace my-namespace %s=%s\n", labelTap, labelTapEnabled)
+		return nil
+	}
+}
+
+// NewUninstallWebhookCommand removes everything created by NewInstallWebhookCommand.
+func NewUninstallWebhookCommand(client kubernetes.Interface) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		deletes := []func() error{
+			func() error {
+				return client.AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.RbacV1().ClusterRoleBindings().Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.RbacV1().ClusterRoles().Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.AppsV1().Deployments(kubetapSystemNamespace).Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.CoreV1().Services(kubetapSystemNamespace).Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.CoreV1().Secrets(kubetapSystemNamespace).Delete(context.TODO(), kubetapWebhookTLSName, metav1.DeleteOptions{})
+			},
+			func() error {
+				return client.CoreV1().ServiceAccounts(kubetapSystemNamespace).Delete(context.TODO(), kubetapWebhookName, metav1.DeleteOptions{})
+			},
+		}
+		for _, del := range deletes {
+			if err := del(); err != nil && !k8serrors.IsNotFound(err) {
+				return fmt.Errorf("error removing the kubetap webhook: %w", err)
+			}
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), "Removed the kubetap webhook. Already injected Pods keep their sidecar until recreated.")
+		return nil
+	}
+}
+
+// NewWebhookServeCommand runs the admission webhook server. It is run in-cluster by
+// the Deployment created with install-webhook.
+func NewWebhookServeCommand(client kubernetes.Interface, viper *viper.Viper) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		image := viper.GetString("proxyImage")
+		if image == "" {
+			image = defaultImageHTTP
+		}
+		commandArgs := strings.Fields(viper.GetString("commandArgs"))
+		mux := http.NewServeMux()
+		mux.Handle(webhookPath, webhookHandler(client, image, commandArgs))
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		server := &http.Server{
+			Addr:    viper.GetString("listenAddress"),
+			Handler: mux,
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Serving kubetap webhook on %s\n", server.Addr)
+		return server.ListenAndServeTLS(viper.GetString("tlsCertFile"), viper.GetString("tlsKeyFile"))
+	}
+}
+
+// webhookHandler decodes AdmissionReviews for Pods and responds with a patch
+// injecting the kubetap sidecar.
+func webhookHandler(client kubernetes.Interface, image string, commandArgs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+			http.Error(w, ErrWebhookBadRequest.Error(), http.StatusBadRequest)
+			return
+		}
+		review.Response = admitPod(client, review.Request, image, commandArgs)
+		review.Response.UID = review.Request.UID
+		review.Request = nil
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	})
+}
+
+// admitPod always allows the Pod, patching in the kubetap sidecar when the Pod belongs
+// to a tapped Deployment. Errors are surfaced as warnings so a broken tap never blocks
+// a workload from starting.
+func admitPod(client kubernetes.Interface, req *admissionv1.AdmissionRequest, image string, commandArgs []string) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{Allowed: true}
+	var pod v1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		resp.Warnings = []string{"kubetap: " + ErrWebhookBadRequest.Error()}
+		return resp
+	}
+	patch, err := sidecarPatch(client, req.Namespace, pod, image, commandArgs)
+	if err != nil {
+		resp.Warnings = []string{"kubetap: " + err.Error()}
+		return resp
+	}
+	if len(patch) == 0 {
+		return resp
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		resp.Warnings = []string{"kubetap: " + err.Error()}
+		return resp
+	}
+	pt := admissionv1.PatchTypeJSONPatch
+	resp.Patch = b
+	resp.PatchType = &pt
+	return resp
+}
+
+// sidecarPatch builds the JSON Patch adding the kubetap sidecar and volumes to a Pod,
+// reusing the same Tap that kubectl tap on applies to Deployments. An empty patch is
+// returned if the Pod should not be tapped.
+func sidecarPatch(client kubernetes.Interface, namespace string, pod v1.Pod, image string, commandArgs []string) ([]jsonPatchOp, error) {
+	if pod.Labels[labelTap] == labelTapDisabled {
+		return nil, nil
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == kubetapContainerName {
+			return nil, nil
+		}
+	}
+	dplName := deploymentNameForPod(pod)
+	if dplName == "" {
+		return nil, nil
+	}
+	// only Deployments that were tapped with "kubectl tap on" have a proxy configuration
+	proxyOpts, err := loadMitmproxyOptions(client.CoreV1().ConfigMaps(namespace), dplName)
+	switch {
+	case k8serrors.IsNotFound(err):
+		return nil, fmt.Errorf("the Deployment %q is labeled for tapping but has no proxy configuration, run kubectl tap on first", dplName)
+	case errors.Is(err, ErrProxyOptionsMissing):
+		// tapped by an older kubetap, which only supported the default options
+		proxyOpts = ProxyOptions{dplName: dplName}
+	case err != nil:
+		return nil, err
+	}
+	proxyOpts.Namespace = namespace
+
+	proxy := NewMitmproxy(client, proxyOpts)
+	dpl := k8sappsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dplName,
+			Namespace: namespace,
+		},
+	}
+	dpl.Spec.Template.Spec = *pod.Spec.DeepCopy()
+	// the sidecar of the tap is injected, the webhook flags only cover older taps
+	// that did not record them
+	sidecar := proxy.Sidecar(dplName)
+	sidecar.Image = proxyOpts.Image
+	if sidecar.Image == "" {
+		sidecar.Image = image
+	}
+	sidecar.Args = proxyOpts.CommandArgs
+	if len(sidecar.Args) == 0 {
+		sidecar.Args = commandArgs
+	}
+	dpl.Spec.Template.Spec.Containers = append(dpl.Spec.Template.Spec.Containers, sidecar)
+	proxy.PatchDeployment(&dpl)
+
+	patch := []jsonPatchOp{
+		{Op: "add", Path: "/spec/containers", Value: dpl.Spec.Template.Spec.Containers},
+		{Op: "add", Path: "/spec/volumes", Value: dpl.Spec.Template.Spec.Volumes},
+	}
+	if pod.Annotations == nil {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: "/metadata/annotations", Value: map[string]string{annotationIsTapped: dplName}})
+	} else {
+		patch = append(patch, jsonPatchOp{Op: "add", Path: "/metadata/annotations/" + jsonPointerEscape(annotationIsTapped), Value: dplName})
+	}
+	return patch, nil
+}
+
+// deploymentNameForPod returns the name of the Deployment owning a Pod through its
+// ReplicaSet, or an empty string if the Pod is not owned by a Deployment.
+func deploymentNameForPod(pod v1.Pod) string {
+	hash := pod.Labels[k8sappsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" {
+		return ""
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "ReplicaSet" && strings.HasSuffix(ref.Name, "-"+hash) {
+			return strings.TrimSuffix(ref.Name, "-"+hash)
+		}
+	}
+	return ""
+}
+
+// jsonPointerEscape escapes a JSON Pointer reference token.
+func jsonPointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+// webhookConfiguration returns the MutatingWebhookConfiguration for the kubetap webhook.
+// Pods are matched either by a labeled Namespace or by their own labels. The ObjectSelector
+// only sees the labels of the Pod, so a Deployment opts in or out through the labels of
+// its Pod template, not its own.
+func webhookConfiguration(caPEM []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	path := webhookPath
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeout := int32(webhookTimeoutSeconds)
+	reinvocation := admissionregistrationv1.IfNeededReinvocationPolicy
+	enabledSelector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: labelTap, Operator: metav1.LabelSelectorOpIn, Values: []string{labelTapEnabled}},
+		},
+	}
+	notDisabledSelector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: labelTap, Operator: metav1.LabelSelectorOpNotIn, Values: []string{labelTapDisabled}},
+		},
+	}
+	webhook := func(name string) admissionregistrationv1.MutatingWebhook {
+		return admissionregistrationv1.MutatingWebhook{
+			Name: name,
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: kubetapSystemNamespace,
+					Name:      kubetapWebhookName,
+					Path:      &path,
+				},
+				CABundle: caPEM,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{
+				{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods"},
+					},
+				},
+			},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			ReinvocationPolicy:      &reinvocation,
+			AdmissionReviewVersions: []string{"v1"},
+		}
+	}
+	nsWebhook := webhook("namespace.webhook.kubetap.io")
+	nsWebhook.NamespaceSelector = enabledSelector
+	nsWebhook.ObjectSelector = notDisabledSelector
+	podWebhook := webhook("pod.webhook.kubetap.io")
+	podWebhook.ObjectSelector = enabledSelector
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: kubetapWebhookName,
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{nsWebhook, podWebhook},
+	}
+}
+
+// installWebhookResources creates or updates the in-cluster resources running the webhook server.
+func installWebhookResources(client kubernetes.Interface, image, proxyImage, commandArgs string, certPEM, keyPEM []byte) error {
+	labels := map[string]string{"app.kubernetes.io/name": kubetapWebhookName}
+	meta := metav1.ObjectMeta{
+		Name:      kubetapWebhookName,
+		Namespace: kubetapSystemNamespace,
+		Labels:    labels,
+	}
+	if err := ensureSystemNamespace(client); err != nil {
+		return err
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: kubetapWebhookTLSName, Namespace: kubetapSystemNamespace, Labels: labels},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       certPEM,
+			v1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	secretsClient := client.CoreV1().Secrets(kubetapSystemNamespace)
+	if err := createOrUpdate("Secret", func() error {
+		_, err := secretsClient.Create(context.TODO(), secret, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+
+	rules := []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get"}},
+	}
+	if err := installServiceAccount(client, meta, rules); err != nil {
+		return err
+	}
+
+	if err := applyDeployment(client, webhookDeployment(meta, image, proxyImage, commandArgs)); err != nil {
+		return err
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			Selector: labels,
+			Ports: []v1.ServicePort{
+				{Name: "https", Port: 443, TargetPort: intstr.FromInt(webhookListenPort)},
+			},
+		},
+	}
+	if _, err := client.CoreV1().Services(kubetapSystemNamespace).Create(context.TODO(), svc, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating Service: %w", err)
+	}
+	return nil
+}
+
+// ensureSystemNamespace creates the Namespace that kubetap's in-cluster components run in.
+func ensureSystemNamespace(client kubernetes.Interface) error {
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: kubetapSystemNamespace}}
+	if _, err := client.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating Namespace %q: %w", kubetapSystemNamespace, err)
+	}
+	return nil
+}
+
+// installServiceAccount creates or updates a ServiceAccount bound to a ClusterRole with
+// the given rules. All three share the name and labels of meta.
+func installServiceAccount(client kubernetes.Interface, meta metav1.ObjectMeta, rules []rbacv1.PolicyRule) error {
+	sa := &v1.ServiceAccount{ObjectMeta: meta}
+	if _, err := client.CoreV1().ServiceAccounts(meta.Namespace).Create(context.TODO(), sa, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating ServiceAccount: %w", err)
+	}
+	role := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: meta.Name, Labels: meta.Labels},
+		Rules:      rules,
+	}
+	if err := createOrUpdate("ClusterRole", func() error {
+		_, err := client.RbacV1().ClusterRoles().Create(context.TODO(), role, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().ClusterRoles().Update(context.TODO(), role, metav1.UpdateOptions{})
+		return err
+	}); err != nil {
+		return err
+	}
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: meta.Name, Labels: meta.Labels},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: meta.Name},
+		Subjects: []rbacv1.Subject{
+			{Kind: rbacv1.ServiceAccountKind, Name: meta.Name, Namespace: meta.Namespace},
+		},
+	}
+	return createOrUpdate("ClusterRoleBinding", func() error {
+		_, err := client.RbacV1().ClusterRoleBindings().Create(context.TODO(), binding, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := client.RbacV1().ClusterRoleBindings().Update(context.TODO(), binding, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// applyDeployment creates or updates an in-cluster kubetap component.
+func applyDeployment(client kubernetes.Interface, dpl *k8sappsv1.Deployment) error {
+	deploymentsClient := client.AppsV1().Deployments(dpl.Namespace)
+	return createOrUpdate("Deployment", func() error {
+		_, err := deploymentsClient.Create(context.TODO(), dpl, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		_, err := deploymentsClient.Update(context.TODO(), dpl, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// webhookDeployment runs "kubectl tap webhook" with the generated serving certificate.
+func webhookDeployment(meta metav1.ObjectMeta, image, proxyImage, commandArgs string) *k8sappsv1.Deployment {
+	return &k8sappsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: k8sappsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: meta.Labels},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: meta.Labels},
+				Spec: v1.PodSpec{
+					ServiceAccountName: kubetapWebhookName,
+					Containers: []v1.Container{
+						{
+							Name:  kubetapWebhookName,
+							Image: image,
+							Args: []string{
+								"webhook",
+								"--listen", fmt.Sprintf(":%d", webhookListenPort),
+								"--tls-cert-file", "/tls/" + v1.TLSCertKey,
+								"--tls-key-file", "/tls/" + v1.TLSPrivateKeyKey,
+								"--proxy-image", proxyImage,
+								"--command-args", commandArgs,
+							},
+							Ports: []v1.ContainerPort{
+								{Name: "https", ContainerPort: webhookListenPort, Protocol: v1.ProtocolTCP},
+							},
+							ReadinessProbe: &v1.Probe{
+								Handler: v1.Handler{
+									HTTPGet: &v1.HTTPGetAction{
+										Path:   "/healthz",
+										Port:   intstr.FromInt(webhookListenPort),
+										Scheme: v1.URISchemeHTTPS,
+									},
+								},
+							},
+							VolumeMounts: []v1.VolumeMount{
+								{Name: kubetapWebhookTLSName, MountPath: "/tls", ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []v1.Volume{
+						{
+							Name: kubetapWebhookTLSName,
+							VolumeSource: v1.VolumeSource{
+								Secret: &v1.SecretVolumeSource{SecretName: kubetapWebhookTLSName},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// applyMutatingWebhookConfiguration creates or updates the webhook registration.
+func applyMutatingWebhookConfiguration(client kubernetes.Interface, mwc *admissionregistrationv1.MutatingWebhookConfiguration) error {
+	mwcClient := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	return createOrUpdate("MutatingWebhookConfiguration", func() error {
+		_, err := mwcClient.Create(context.TODO(), mwc, metav1.CreateOptions{})
+		return err
+	}, func() error {
+		existing, err := mwcClient.Get(context.TODO(), mwc.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mwc.ResourceVersion = existing.ResourceVersion
+		_, err = mwcClient.Update(context.TODO(), mwc, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// createOrUpdate calls create, falling back to update if the resource already exists.
+func createOrUpdate(kind string, create, update func() error) error {
+	err := create()
+	if k8serrors.IsAlreadyExists(err) {
+		err = update()
+	}
+	if err != nil {
+		return fmt.Errorf("error applying %s: %w", kind, err)
+	}
+	return nil
+}
+
+// webhookCertificates generates a self-signed CA and a serving certificate for dnsName,
+// returned PEM encoded.
+func webhookCertificates(dnsName string) (caPEM, certPEM, keyPEM []byte, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubetap-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(webhookCertValidity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(webhookCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return caPEM, certPEM, keyPEM, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Soluble Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func Test_WebhookHandler(t *testing.T) {
+	tests := []struct {
+		Name       string
+		ClientFunc func() *fake.Clientset
+		Pod        func() v1.Pod
+		Patched    bool
+		Warning    bool
+	}{
+		{"tapped_deployment", fakeClientTappedSimple, webhookPod, true, false},
+		{"untapped_deployment", fakeClientUntappedSimple, webhookPod, false, true},
+		{"already_injected", fakeClientTappedSimple, func() v1.Pod {
+			pod := webhookPod()
+			pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: kubetapContainerName})
+			return pod
+		}, false, false},
+		{"opted_out", fakeClientTappedSimple, func() v1.Pod {
+			pod := webhookPod()
+			pod.Labels[labelTap] = "disabled"
+			return pod
+		}, false, false},
+		{"no_deployment", fakeClientTappedSimple, func() v1.Pod {
+			pod := webhookPod()
+			pod.OwnerReferences = nil
+			return pod
+		}, false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			require := require.New(t)
+			server := httptest.NewServer(webhookHandler(tc.ClientFunc(), defaultImageHTTP, []string{"mitmweb"}))
+			defer server.Close()
+
+			raw, err := json.Marshal(tc.Pod())
+			require.Nil(err)
+			review := admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       types.UID("1234"),
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			}
+			body, err := json.Marshal(review)
+			require.Nil(err)
+			resp, err := http.Post(server.URL+webhookPath, "application/json", bytes.NewReader(body))
+			require.Nil(err)
+			defer resp.Body.Close()
+			out, err := ioutil.ReadAll(resp.Body)
+			require.Nil(err)
+			var result admissionv1.AdmissionReview
+			require.Nil(json.Unmarshal(out, &result))
+			require.NotNil(result.Response)
+			require.True(result.Response.Allowed, "the webhook must never reject Pods")
+			require.Equal(types.UID("1234"), result.Response.UID)
+			require.Equal(tc.Warning, len(result.Response.Warnings) > 0)
+			if !tc.Patched {
+				require.Empty(result.Response.Patch)
+				return
+			}
+			var patch []jsonPatchOp
+			require.Nil(json.Unmarshal(result.Response.Patch, &patch))
+			require.Len(patch, 3)
+			var containers []v1.Container
+			b, err := json.Marshal(patch[0].Value)
+			require.Nil(err)
+			require.Nil(json.Unmarshal(b, &containers))
+			require.Len(containers, 2)
+			require.Equal(kubetapContainerName, containers[1].Name)
+			require.Equal(defaultImageHTTP, containers[1].Image)
+			require.Equal(kubetapConfigMapPrefix+"sample-deployment", containers[1].VolumeMounts[0].Name)
+			require.Equal("/metadata/annotations/kubetap.io~1tapped", patch[2].Path)
+		})
+	}
+}
+
+func Test_SidecarPatchRecordedSidecar(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fakeClientUntappedSimple()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	testViper := viper.New()
+	testViper.Set("proxyPort", 80)
+	testViper.Set("proxyImage", "example.com/mitmproxy:custom")
+	testViper.Set("commandArgs", "mitmdump --set flow_detail=2")
+	require.Nil(NewTapCommand(fakeClient, &rest.Config{}, testViper)(cmd, []string{"sample-service"}))
+
+	// the webhook flags only apply to taps that did not record their sidecar
+	patch, err := sidecarPatch(fakeClient, "default", webhookPod(), defaultImageHTTP, []string{"mitmweb"})
+	require.Nil(err)
+	require.NotEmpty(patch)
+	containers, ok := patch[0].Value.([]v1.Container)
+	require.True(ok)
+	require.Equal(kubetapContainerName, containers[len(containers)-1].Name)
+	require.Equal("example.com/mitmproxy:custom", containers[len(containers)-1].Image)
+	require.Equal([]string{"mitmdump", "--set", "flow_detail=2"}, containers[len(containers)-1].Args)
+}
+
+func Test_WebhookHandlerBadRequest(t *testing.T) {
+	require := require.New(t)
+	server := httptest.NewServer(webhookHandler(fake.NewSimpleClientset(), defaultImageHTTP, nil))
+	defer server.Close()
+	resp, err := http.Post(server.URL+webhookPath, "application/json", bytes.NewBufferString("{}"))
+	require.Nil(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_NewInstallWebhookCommand(t *testing.T) {
+	require := require.New(t)
+	fakeClient := fake.NewSimpleClientset()
+	cmd := &cobra.Command{}
+	cmd.SetOutput(ioutil.Discard)
+	// installing twice must update rather than fail
+	for i := 0; i < 2; i++ {
+		require.Nil(NewInstallWebhookCommand(fakeClient, viper.New())(cmd, []string{}))
+	}
+	mwc, err := fakeClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), kubetapWebhookName, metav1.GetOptions{})
+	require.Nil(err)
+	require.Len(mwc.Webhooks, 2)
+	for _, wh := range mwc.Webhooks {
+		require.NotEmpty(wh.ClientConfig.CABundle)
+	}
+	dpl, err := fakeClient.AppsV1().Deployments(kubetapSystemNamespace).Get(context.TODO(), kubetapWebhookName, metav1.GetOptions{})
+	require.Nil(err)
+	require.Equal(defaultImageKubetap, dpl.Spec.Template.Spec.Containers[0].Image)
+	secret, err := fakeClient.CoreV1().Secrets(kubetapSystemNamespace).Get(context.TODO(), kubetapWebhookTLSName, metav1.GetOptions{})
+	require.Nil(err)
+	require.NotEmpty(secret.Data[v1.TLSCertKey])
+
+	require.Nil(NewUninstallWebhookCommand(fakeClient)(cmd, []string{}))
+	_, err = fakeClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), kubetapWebhookName, metav1.GetOptions{})
+	require.NotNil(err)
+}
+
+func Test_WebhookConfigurationSelectors(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Namespace map[string]string
+		Pod       map[string]string
+		Webhooks  int
+	}{
+		{"unlabeled", nil, nil, 0},
+		{"namespace_enabled", map[string]string{labelTap: labelTapEnabled}, nil, 1},
+		{"namespace_disabled", map[string]string{labelTap: labelTapDisabled}, nil, 0},
+		{"namespace_other_value", map[string]string{labelTap: "true"}, nil, 0},
+		{"pod_enabled", nil, map[string]string{labelTap: labelTapEnabled}, 1},
+		{"pod_disabled", map[string]string{labelTap: labelTapEnabled}, map[string]string{labelTap: labelTapDisabled}, 0},
+		{"both_enabled", map[string]string{labelTap: labelTapEnabled}, map[string]string{labelTap: labelTapEnabled}, 2},
+	}
+	matches := func(t *testing.T, ls *metav1.LabelSelector, set map[string]string) bool {
+		if ls == nil {
+			return true
+		}
+		sel, err := metav1.LabelSelectorAsSelector(ls)
+		require.Nil(t, err)
+		return sel.Matches(labels.Set(set))
+	}
+	for _, tc := range tests {
+		t.Run(tc.Name, func(t *testing.T) {
+			var n int
+			for _, wh := range webhookConfiguration(nil).Webhooks {
+				if matches(t, wh.NamespaceSelector, tc.Namespace) && matches(t, wh.ObjectSelector, tc.Pod) {
+					n++
+				}
+			}
+			require.Equal(t, tc.Webhooks, n)
+		})
+	}
+}
+
+func Test_DeploymentNameForPod(t *testing.T) {
+	require := require.New(t)
+	require.Equal("sample-deployment", deploymentNameForPod(webhookPod()))
+	pod := webhookPod()
+	pod.Labels = map[string]string{}
+	require.Equal("", deploymentNameForPod(pod))
+}
+
+func webhookPod() v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "sample-deployment-5d4f8c7b9-",
+			Labels: map[string]string{
+				"app":               "myapp",
+				"pod-template-hash": "5d4f8c7b9",
+				labelTap:            "enabled",
+			},
+			Annotations: map[string]string{
+				"my-annotation": "some-annotation",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "sample-deployment-5d4f8c7b9"},
+			},
+		},
+		Spec: *simpleDeployment.Spec.Template.Spec.DeepCopy(),
+	}
+}
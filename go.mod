@@ -25,4 +25,5 @@ require (
 	k8s.io/apimachinery v0.20.2
 	k8s.io/cli-runtime v0.20.2
 	k8s.io/client-go v0.20.2
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -7,6 +7,47 @@ set -o nounset
 # HACK: this fixes permission issues
 cp /home/mitmproxy/config/config.yaml /home/mitmproxy/.mitmproxy/config.yaml
 
+# The web interface password generated for the tap is passed from a Secret. It
+# goes into the config rather than the command line, to keep it out of the
+# process list.
+if [ -n "${KUBETAP_WEB_PASSWORD:-}" ] && [ "${1}" = 'mitmweb' ]; then
+  echo "web_password: '${KUBETAP_WEB_PASSWORD}'" >> /home/mitmproxy/.mitmproxy/config.yaml
+  echo "kubetap: the web interface requires the password from the tap's Secret"
+fi
+
+# A CA stored in a Secret with --ca-secret replaces the one mitmproxy would
+# generate, so that clients can keep trusting the proxy across taps.
+if [ -e /home/mitmproxy/ca/tls.crt ]; then
+  cat /home/mitmproxy/ca/tls.key /home/mitmproxy/ca/tls.crt > /home/mitmproxy/.mitmproxy/mitmproxy-ca.pem
+  cp /home/mitmproxy/ca/tls.crt /home/mitmproxy/.mitmproxy/mitmproxy-ca-cert.pem
+  echo "kubetap: using the CA from /home/mitmproxy/ca"
+fi
+
+# mitmproxy reads a certificate and its key from a single file, so combine
+# the kubernetes.io/tls Secret given with --tls-secret.
+if [ -e /home/mitmproxy/tls/tls.crt ]; then
+  cat /home/mitmproxy/tls/tls.key /home/mitmproxy/tls/tls.crt > /home/mitmproxy/.mitmproxy/kubetap-tls.pem
+  echo "kubetap: presenting the certificate from /home/mitmproxy/tls"
+fi
+
+# Likewise for the client certificate presented to mTLS upstreams, given with
+# --upstream-client-cert-secret.
+if [ -e /home/mitmproxy/upstream-client/tls.crt ]; then
+  cat /home/mitmproxy/upstream-client/tls.key /home/mitmproxy/upstream-client/tls.crt > /home/mitmproxy/.mitmproxy/kubetap-upstream-client.pem
+  echo "kubetap: presenting the client certificate from /home/mitmproxy/upstream-client"
+fi
+
+# Addon scripts listed in config.yaml are loaded straight from the ConfigMap
+# mount rather than copied, so that "kubectl tap update --script" reaches the
+# running proxy and mitmproxy reloads them. The mount is read-only, so keep
+# python from trying to write bytecode next to them.
+export PYTHONDONTWRITEBYTECODE=1
+for script in /home/mitmproxy/config/*.py; do
+  if [ -e "${script}" ]; then
+    echo "kubetap: loading addon script ${script}"
+  fi
+done
+
 prog=${1}
 if [[ ${1} == 'mitmdump' || ${1} == 'mitmproxy' || ${1} == 'mitmweb' ]]; then
   MITMPROXY_PATH='/home/mitmproxy/.mitmproxy'